@@ -3,9 +3,11 @@ module github.com/Templum/Spediteur
 go 1.15
 
 require (
+	github.com/prometheus/client_golang v1.12.2
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.4.0
 	github.com/valyala/fasthttp v1.34.0
 	go.uber.org/automaxprocs v1.4.0
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -2,17 +2,24 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path"
+	"reflect"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/auth"
 	"github.com/Templum/Spediteur/pkg/config"
 	"github.com/Templum/Spediteur/pkg/controller"
+	"github.com/Templum/Spediteur/pkg/health"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/reuseport"
@@ -20,6 +27,8 @@ import (
 	_ "go.uber.org/automaxprocs"
 )
 
+const configPollInterval = 5 * time.Second
+
 var (
 	confPath string
 	logLevel uint
@@ -59,10 +68,20 @@ func init() {
 
 type server struct {
 	HTTPServer *fasthttp.Server
+	Handler    *controller.ForwardHandler
+	AccessLog  *accesslog.Logger
+	TLS        *controller.ListenerTLS
 }
 
-func newServer(conf *config.ForwardProxyConfig) *server {
+func newServer(conf *config.ForwardProxyConfig, authenticator controller.Authenticator, accessLog *accesslog.Logger, listenerTLS *controller.ListenerTLS) *server {
 	handler := controller.NewForwardHandler(conf)
+	handler.SetAuthenticator(authenticator)
+	if accessLog != nil {
+		handler.SetAccessLogger(accessLog)
+	}
+	if listenerTLS != nil {
+		handler.SetListenerTLS(listenerTLS)
+	}
 
 	// time.ParseDuration is already called during validation, hence an error is impossible at this location
 	readTimeout, _ := time.ParseDuration(conf.Proxy.Timeouts.Read)
@@ -91,58 +110,309 @@ func newServer(conf *config.ForwardProxyConfig) *server {
 
 	return &server{
 		HTTPServer: http,
+		Handler:    handler,
+		AccessLog:  accessLog,
+		TLS:        listenerTLS,
 	}
 }
 
-func startMonitoringServer(conf *config.ForwardProxyConfig) {
+func loadConfig() (*config.ForwardProxyConfig, error) {
+	file, err := os.Open(confPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading config at %s due to %s", confPath, err)
+	}
+
+	conf, err := config.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed while parsing provided config due to %s", err)
+	}
+
+	return conf, nil
+}
+
+func loadAuthenticator(conf *config.ForwardProxyConfig) (controller.Authenticator, error) {
+	if len(conf.Authentication.HtpasswdFile) == 0 {
+		log.Info("Proxy-Authorization is disabled as no htpasswd file is configured")
+		return nil, nil
+	}
+
+	file, err := os.Open(conf.Authentication.HtpasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading htpasswd file at %s due to %s", conf.Authentication.HtpasswdFile, err)
+	}
+
+	htpasswd, err := auth.NewHtpasswd(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed while parsing provided htpasswd file due to %s", err)
+	}
+
+	log.Infof("Proxy-Authorization is enabled with %d users from %s", htpasswd.Users(), conf.Authentication.HtpasswdFile)
+	return htpasswd, nil
+}
+
+func loadAccessLog(conf *config.ForwardProxyConfig) (*accesslog.Logger, error) {
+	if !conf.Logging.Access.Enabled {
+		return nil, nil
+	}
+
+	logger, err := accesslog.New(conf.Logging.Access)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening access log at %s due to %s", conf.Logging.Access.Output, err)
+	}
+
+	log.Infof("Access log is enabled with format %s writing to %s", conf.Logging.Access.Format, conf.Logging.Access.Output)
+	return logger, nil
+}
+
+func loadListenerTLS(conf *config.ForwardProxyConfig) (*controller.ListenerTLS, error) {
+	if !conf.Proxy.TLS.Enabled() {
+		log.Info("Proxy listener accepts clients in cleartext as no TLS certificate is configured")
+		return nil, nil
+	}
+
+	listenerTLS, err := controller.NewListenerTLS(conf.Proxy.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading proxy tls due to %s", err)
+	}
+
+	log.Infof("Proxy listener terminates TLS with %d certificates and client auth %s", len(conf.Proxy.TLS.Certificates), conf.Proxy.TLS.ClientAuth)
+	return listenerTLS, nil
+}
+
+// watchListenerTLS reloads the certificates of the proxy listener once any of their files changed.
+func watchListenerTLS(listenerTLS *controller.ListenerTLS, stop <-chan struct{}) {
+	for _, file := range listenerTLS.Files() {
+		go config.Watch(file, configPollInterval, stop, func() {
+			// Certificate and key are rarely replaced at once, hence failures are expected until both were written
+			if err := listenerTLS.Reload(); err != nil {
+				log.Errorf("Keeping current proxy certificates as reloading failed: %s", err)
+				return
+			}
+			log.Info("Reloaded proxy certificates")
+		})
+	}
+}
+
+// applyLogLevel sets the log level from the config, which takes precedence over the logLevel flag.
+func applyLogLevel(conf *config.ForwardProxyConfig) {
+	if len(conf.Logging.Level) == 0 {
+		return
+	}
+
+	// log.ParseLevel is already called during validation, hence an error is impossible at this location
+	level, _ := log.ParseLevel(conf.Logging.Level)
+	log.SetLevel(level)
+}
+
+// reload re-reads the config and the htpasswd file and swaps them into the running handler. If either of them
+// is invalid the current config is kept, which is returned in that case. Otherwise the applied config is returned,
+// which keeps the current values of the fields that only take effect after a restart.
+func reload(server *server, current *config.ForwardProxyConfig) *config.ForwardProxyConfig {
+	conf, err := loadConfig()
+	if err != nil {
+		log.Errorf("Keeping current config as reloading failed: %s", err)
+		return current
+	}
+
+	authenticator, err := loadAuthenticator(conf)
+	if err != nil {
+		log.Errorf("Keeping current config as reloading failed: %s", err)
+		return current
+	}
+
+	if err := server.Handler.Reload(conf, authenticator); err != nil {
+		log.Errorf("Keeping current config as reloading failed: %s", err)
+		return current
+	}
+	applyLogLevel(conf)
+
+	applied := withRestartFields(conf, current)
+	if !reflect.DeepEqual(applied, conf) {
+		log.Warn("Changes to addresses, ports, buffer sizes, limits, the read timeout, the access log, the upstream pool, the proxy tls, the cache, coalescing and concurrency limits only take effect after a restart")
+	}
+
+	log.Infof("Reloaded config from %s", confPath)
+	return applied
+}
+
+// withRestartFields returns a copy of conf, where the fields that only take effect after a restart are taken from
+// current. Hence, later reloads still compare against the values that are actually in use.
+func withRestartFields(conf *config.ForwardProxyConfig, current *config.ForwardProxyConfig) *config.ForwardProxyConfig {
+	applied := *conf
+	applied.Proxy.Server, applied.Proxy.Port, applied.Proxy.SOCKS5Port = current.Proxy.Server, current.Proxy.Port, current.Proxy.SOCKS5Port
+	applied.Monitoring.Port = current.Monitoring.Port
+	applied.Proxy.BufferSizes, applied.Proxy.Limits = current.Proxy.BufferSizes, current.Proxy.Limits
+	applied.Proxy.Timeouts.Read = current.Proxy.Timeouts.Read
+	applied.Proxy.TLS = current.Proxy.TLS
+	applied.Logging.Access = current.Logging.Access
+	applied.Upstream.Pool = current.Upstream.Pool
+	applied.Cache, applied.Coalescing, applied.Concurrency = current.Cache, current.Coalescing, current.Concurrency
+	return &applied
+}
+
+// watchHtpasswd notifies about changes of the htpasswd file at path, as credentials are re-read during reloads only.
+// The returned channel stops the watch, which is nil if no htpasswd file is configured.
+func watchHtpasswd(path string, notify func()) chan struct{} {
+	if len(path) == 0 {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	go config.Watch(path, configPollInterval, stop, notify)
+	return stop
+}
+
+func startMonitoringServer(conf *config.ForwardProxyConfig, probe *health.Probe) {
+	// pprof registers itself on the default mux via the blank import
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", probe.Liveness)
+	http.HandleFunc("/readyz", probe.Readiness)
+
 	port := ":" + strconv.Itoa(int(conf.Monitoring.Port))
 	err := http.ListenAndServe(port, nil)
 	log.Warnf("Failed to start monitoring server under %s due to %s", strconv.Itoa(int(conf.Monitoring.Port)), err)
 }
 
-func startForwardProxyServer(server *server, conf *config.ForwardProxyConfig) {
+func startForwardProxyServer(server *server, conf *config.ForwardProxyConfig, probe *health.Probe) {
 	address := conf.Proxy.Server + ":" + strconv.Itoa(int(conf.Proxy.Port))
 	ln, err := reuseport.Listen("tcp4", address)
 	if err != nil {
 		log.Fatalf("Error during creating listener for %s: %s", address, err)
 	}
 
+	if server.TLS != nil {
+		ln = server.TLS.Listener(ln)
+	}
+
+	probe.SetReady(true)
+
 	err = server.HTTPServer.Serve(ln)
 	if err != nil {
 		log.Fatalf("Error during setup of http server: %s", err)
 	}
 }
 
+func startSOCKS5Server(server *server, conf *config.ForwardProxyConfig) {
+	address := conf.Proxy.Server + ":" + strconv.Itoa(int(conf.Proxy.SOCKS5Port))
+	ln, err := reuseport.Listen("tcp4", address)
+	if err != nil {
+		log.Fatalf("Error during creating listener for %s: %s", address, err)
+	}
+
+	err = server.Handler.ServeSOCKS5(ln)
+	if err != nil {
+		log.Fatalf("Error during serving socks5 clients: %s", err)
+	}
+}
+
 func main() {
-	file, err := os.Open(confPath)
+	conf, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Failed reading config at %s due to %s", confPath, err)
+		log.Fatal(err)
 	}
+	applyLogLevel(conf)
 
-	conf, err := config.New(file)
+	authenticator, err := loadAuthenticator(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	accessLog, err := loadAccessLog(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listenerTLS, err := loadListenerTLS(conf)
 	if err != nil {
-		log.Fatalf("Failed while parsing provided config due to %s", err)
+		log.Fatal(err)
 	}
 
-	server := newServer(conf)
+	server := newServer(conf, authenticator, accessLog, listenerTLS)
+
+	probe := health.New()
 
-	go startMonitoringServer(conf)
-	go startForwardProxyServer(server, conf)
+	go startMonitoringServer(conf, probe)
+	go startForwardProxyServer(server, conf, probe)
 
 	log.Infof("Spediteur started Metric server under :%d and Proxy Server under %s:%d", conf.Monitoring.Port, conf.Proxy.Server, conf.Proxy.Port)
 
-	// Listening for relevant signals from os indicating shutdown
+	if conf.Proxy.SOCKS5Port > 0 {
+		go startSOCKS5Server(server, conf)
+		log.Infof("Spediteur started SOCKS5 Server under %s:%d", conf.Proxy.Server, conf.Proxy.SOCKS5Port)
+	}
+
+	// Changes to the config and htpasswd file are detected by polling, while SIGHUP allows to trigger a reload manually
+	changes := make(chan struct{}, 1)
+	stopWatching := make(chan struct{})
+	if listenerTLS != nil {
+		watchListenerTLS(listenerTLS, stopWatching)
+	}
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+			// A reload is already pending
+		}
+	}
+	go config.Watch(confPath, configPollInterval, stopWatching, notify)
+	stopHtpasswd := watchHtpasswd(conf.Authentication.HtpasswdFile, notify)
+
+	// Listening for relevant signals from os indicating shutdown or reload
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	log.Info("Spediteur is now listening for SIGTERM & SIGINT signals to perform gracefully shutdown and SIGHUP to reload its config")
+
+	var sig os.Signal
+	for sig == nil {
+		previous := conf
+		select {
+		case received := <-sigs:
+			if received != syscall.SIGHUP {
+				sig = received
+				continue
+			}
+			log.Info("Reload signal received.")
+			conf = reload(server, conf)
+		case <-changes:
+			log.Infof("Change of config at %s or its htpasswd file detected.", confPath)
+			conf = reload(server, conf)
+		}
 
-	log.Info("Spediteur is now listening for SIGTERM & SIGINT signals to perform gracefully shutdown")
+		if conf.Authentication.HtpasswdFile != previous.Authentication.HtpasswdFile {
+			if stopHtpasswd != nil {
+				close(stopHtpasswd)
+			}
+			stopHtpasswd = watchHtpasswd(conf.Authentication.HtpasswdFile, notify)
+		}
+	}
 
-	sig := <-sigs
+	close(stopWatching)
+	if stopHtpasswd != nil {
+		close(stopHtpasswd)
+	}
 	log.Infof("Shutdown signal %s received.", sig)
+	probe.SetReady(false)
+
+	// Hijacked tunnels are not tracked by fasthttp, hence they are drained in parallel
+	var drain sync.WaitGroup
+	drain.Add(1)
+	go func() {
+		defer drain.Done()
+		server.Handler.Shutdown()
+	}()
 
 	if err := server.HTTPServer.Shutdown(); err != nil {
 		log.Warnf("Error during shutdown: %s", err)
 	}
 
+	drain.Wait()
+
+	if server.AccessLog != nil {
+		if err := server.AccessLog.Close(); err != nil {
+			log.Warnf("Error during closing access log: %s", err)
+		}
+	}
+
 	log.Info("Server gracefully stopped.")
 }
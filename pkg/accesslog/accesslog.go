@@ -0,0 +1,170 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+)
+
+// Reasons describing why a request or tunnel terminated
+const (
+	ReasonCompleted            = "completed"
+	ReasonTimeout              = "timeout"
+	ReasonError                = "error"
+	ReasonShutdown             = "shutdown"
+	ReasonClientRejected       = "client_rejected"
+	ReasonAuthentication       = "authentication_required"
+	ReasonAccessDenied         = "access_denied"
+	ReasonPolicyDenied         = "policy_denied"
+	ReasonDestinationForbidden = "destination_forbidden"
+	ReasonUpstreamUnreachable  = "upstream_unreachable"
+	ReasonServiceUnavailable   = "service_unavailable"
+	ReasonSNIMismatch          = "sni_mismatch"
+	ReasonRateLimited          = "rate_limited"
+	ReasonOverloaded           = "overloaded"
+)
+
+const (
+	clfTimeLayout   = "02/Jan/2006:15:04:05 -0700"
+	defaultProtocol = "HTTP/1.1"
+	megabyte        = 1024 * 1024
+)
+
+// Entry describes a proxied request or tunnel that finished.
+type Entry struct {
+	Time       time.Time     `json:"time"`
+	ClientIP   string        `json:"client_ip"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	Target     string        `json:"target"`
+	URI        string        `json:"uri,omitempty"`
+	Protocol   string        `json:"protocol,omitempty"`
+	ResolvedIP string        `json:"resolved_ip,omitempty"`
+	SNI        string        `json:"sni,omitempty"`
+	Cache      string        `json:"cache,omitempty"`
+	Status     int           `json:"status"`
+	BytesUp    int64         `json:"bytes_up"`
+	BytesDown  int64         `json:"bytes_down"`
+	Duration   time.Duration `json:"-"`
+	Reason     string        `json:"reason"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+}
+
+// Logger writes entries in the configured format, where it is safe for concurrent use.
+type Logger struct {
+	mu     sync.Mutex
+	format string
+	out    io.Writer
+	closer io.Closer
+}
+
+// New creates a Logger based on the provided config, which writes either to stdout or to a rotating file.
+func New(conf config.AccessLog) (*Logger, error) {
+	if conf.Output == config.OutputStdout || len(conf.Output) == 0 {
+		return &Logger{format: conf.Format, out: os.Stdout}, nil
+	}
+
+	file, err := newRotatingFile(conf.Output, int64(conf.MaxSize)*megabyte, conf.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{format: conf.Format, out: file, closer: file}, nil
+}
+
+// NewWriter creates a Logger writing to the provided writer, which is mostly useful for testing.
+func NewWriter(format string, out io.Writer) *Logger {
+	return &Logger{format: format, out: out}
+}
+
+// Log writes the entry as a single line. Failures are not reported, as the proxy should keep serving.
+func (l *Logger) Log(entry Entry) {
+	var line []byte
+	switch l.format {
+	case config.FormatCommon:
+		line = []byte(commonLine(entry, false))
+	case config.FormatCombined:
+		line = []byte(commonLine(entry, true))
+	default:
+		line = jsonLine(entry)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+// Close closes the underlying file if the Logger is writing to one.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+func jsonLine(entry Entry) []byte {
+	type alias Entry
+	line, _ := json.Marshal(struct {
+		alias
+		DurationMs float64 `json:"duration_ms"`
+	}{alias: alias(entry), DurationMs: roundMillis(entry.Duration)})
+
+	return append(line, '\n')
+}
+
+// commonLine formats the entry in Common Log Format, while combined appends referer and user agent. As not all
+// fields fit into the format, the proxy specific fields are appended as key=value pairs.
+func commonLine(entry Entry, combined bool) string {
+	var b strings.Builder
+
+	requestTarget := entry.URI
+	if len(requestTarget) == 0 {
+		requestTarget = entry.Target
+	}
+
+	protocol := entry.Protocol
+	if len(protocol) == 0 {
+		protocol = defaultProtocol
+	}
+
+	fmt.Fprintf(&b, "%s - %s [%s] \"%s %s %s\" %d %s",
+		orDash(entry.ClientIP), orDash(entry.User), entry.Time.Format(clfTimeLayout),
+		entry.Method, requestTarget, protocol, entry.Status, bytesField(entry.BytesDown))
+
+	if combined {
+		fmt.Fprintf(&b, " %q %q", orDash(entry.Referer), orDash(entry.UserAgent))
+	}
+
+	fmt.Fprintf(&b, " target=%s resolved=%s up=%d down=%d duration=%s reason=%s\n",
+		entry.Target, orDash(entry.ResolvedIP), entry.BytesUp, entry.BytesDown,
+		strconv.FormatFloat(entry.Duration.Seconds(), 'f', 3, 64), entry.Reason)
+
+	return b.String()
+}
+
+func roundMillis(d time.Duration) float64 {
+	// Microsecond precision is plenty for an access log
+	return float64(d.Round(time.Microsecond)) / float64(time.Millisecond)
+}
+
+func bytesField(bytes int64) string {
+	if bytes <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,103 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var entry = Entry{
+	Time:       time.Date(2021, time.March, 14, 9, 26, 53, 0, time.UTC),
+	ClientIP:   "10.0.0.7",
+	User:       "ci",
+	Method:     "GET",
+	Target:     "example.com:80",
+	URI:        "http://example.com/index.html",
+	ResolvedIP: "93.184.216.34",
+	Status:     200,
+	BytesUp:    12,
+	BytesDown:  2326,
+	Duration:   1532 * time.Millisecond,
+	Reason:     ReasonCompleted,
+	UserAgent:  "curl/7.68.0",
+}
+
+func TestLogger_Log(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		entry  Entry
+		want   string
+	}{
+		{
+			name: "common log format", format: config.FormatCommon, entry: entry,
+			want: `10.0.0.7 - ci [14/Mar/2021:09:26:53 +0000] "GET http://example.com/index.html HTTP/1.1" 200 2326 target=example.com:80 resolved=93.184.216.34 up=12 down=2326 duration=1.532 reason=completed` + "\n",
+		},
+		{
+			name: "combined log format", format: config.FormatCombined, entry: entry,
+			want: `10.0.0.7 - ci [14/Mar/2021:09:26:53 +0000] "GET http://example.com/index.html HTTP/1.1" 200 2326 "-" "curl/7.68.0" target=example.com:80 resolved=93.184.216.34 up=12 down=2326 duration=1.532 reason=completed` + "\n",
+		},
+		{
+			name: "common log format for anonymous tunnel", format: config.FormatCommon,
+			entry: Entry{Time: entry.Time, ClientIP: "10.0.0.7", Method: "CONNECT", Target: "example.com:443", Status: 503, Reason: ReasonUpstreamUnreachable},
+			want:  `10.0.0.7 - - [14/Mar/2021:09:26:53 +0000] "CONNECT example.com:443 HTTP/1.1" 503 - target=example.com:443 resolved=- up=0 down=0 duration=0.000 reason=upstream_unreachable` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			NewWriter(tt.format, &out).Log(tt.entry)
+
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		NewWriter(config.FormatJSON, &out).Log(entry)
+
+		var got map[string]interface{}
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &got), "should be valid json")
+		assert.Equal(t, "10.0.0.7", got["client_ip"])
+		assert.Equal(t, "ci", got["user"])
+		assert.Equal(t, "example.com:80", got["target"])
+		assert.Equal(t, "93.184.216.34", got["resolved_ip"])
+		assert.EqualValues(t, 200, got["status"])
+		assert.EqualValues(t, 12, got["bytes_up"])
+		assert.EqualValues(t, 2326, got["bytes_down"])
+		assert.EqualValues(t, 1532, got["duration_ms"])
+		assert.Equal(t, "completed", got["reason"])
+		assert.Equal(t, byte('\n'), out.Bytes()[out.Len()-1], "should end with a newline")
+	})
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not throw error")
+	defer os.RemoveAll(dir)
+
+	t.Run("writes to file", func(t *testing.T) {
+		output := path.Join(dir, "access.log")
+		logger, err := New(config.AccessLog{Format: config.FormatCommon, Output: output, MaxSize: 1, MaxBackups: 1})
+		assert.NoError(t, err, "should not throw error")
+
+		logger.Log(entry)
+		assert.NoError(t, logger.Close())
+
+		content, _ := ioutil.ReadFile(output)
+		assert.Contains(t, string(content), `"GET http://example.com/index.html HTTP/1.1" 200`)
+	})
+
+	t.Run("fails for unwritable file", func(t *testing.T) {
+		_, err := New(config.AccessLog{Format: config.FormatCommon, Output: path.Join(dir, "missing", "access.log"), MaxSize: 1, MaxBackups: 1})
+		assert.Error(t, err, "should throw error")
+	})
+}
@@ -0,0 +1,55 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not throw error")
+	defer os.RemoveAll(dir)
+
+	output := path.Join(dir, "access.log")
+	file, err := newRotatingFile(output, 10, 2)
+	assert.NoError(t, err, "should not throw error")
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		assert.NoError(t, err, "should not throw error")
+	}
+	assert.NoError(t, file.Close())
+
+	current, _ := ioutil.ReadFile(output)
+	newest, _ := ioutil.ReadFile(output + ".1")
+	oldest, _ := ioutil.ReadFile(output + ".2")
+
+	assert.Equal(t, "fourth\n", string(current))
+	assert.Equal(t, "third\n", string(newest))
+	assert.Equal(t, "second\n", string(oldest))
+
+	_, err = os.Stat(output + ".3")
+	assert.True(t, os.IsNotExist(err), "should only keep max backups")
+}
+
+func TestRotatingFile_Append(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not throw error")
+	defer os.RemoveAll(dir)
+
+	output := path.Join(dir, "access.log")
+	assert.NoError(t, ioutil.WriteFile(output, []byte("existing\n"), 0600))
+
+	file, err := newRotatingFile(output, 1024, 1)
+	assert.NoError(t, err, "should not throw error")
+
+	_, _ = file.Write([]byte("appended\n"))
+	assert.NoError(t, file.Close())
+
+	content, _ := ioutil.ReadFile(output)
+	assert.Equal(t, "existing\nappended\n", string(content))
+}
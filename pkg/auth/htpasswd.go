@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 SHA1 is required to support the {SHA} scheme of htpasswd files
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const shaPrefix = "{SHA}"
+
+// verifiedFor is how long successful verifications are remembered, as clients send their credentials along with
+// every request and bcrypt is slow on purpose.
+const verifiedFor = time.Minute
+
+// Htpasswd contains the users of an htpasswd file. Supported are bcrypt ($2y$, $2a$, $2b$) and SHA1 ({SHA}) hashes.
+type Htpasswd struct {
+	users map[string]string
+	// dummy is verified in place of the hash of unknown users, so they cannot be told apart by the time it takes
+	dummy string
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// NewHtpasswd creates an Htpasswd from the provided reader, which should point towards an htpasswd file.
+// Lines starting with # and empty lines are ignored. During reading it will validate the hash of each user.
+func NewHtpasswd(reader io.ReadCloser) (*Htpasswd, error) {
+	defer reader.Close()
+	users := make(map[string]string)
+	cost := 0
+
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if len(entry) == 0 || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		sepIdx := strings.IndexRune(entry, ':')
+		if sepIdx <= 0 {
+			return nil, fmt.Errorf("htpasswd line %d is not in the format user:hash", line)
+		}
+
+		user, hash := entry[:sepIdx], entry[sepIdx+1:]
+		if !isSupportedHash(hash) {
+			return nil, fmt.Errorf("htpasswd line %d uses an unsupported hash for user %s, only bcrypt and SHA are supported", line, user)
+		}
+
+		users[user] = hash
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil && c > cost {
+			cost = c
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// The dummy is as expensive as the most expensive hash, which is SHA if there is no bcrypt hash at all
+	dummy := shaPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha1.Size))
+	if cost > 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+		if err != nil {
+			return nil, fmt.Errorf("failed generating dummy hash: %w", err)
+		}
+		dummy = string(hash)
+	}
+
+	return &Htpasswd{users: users, dummy: dummy, verified: make(map[[sha256.Size]byte]time.Time)}, nil
+}
+
+// Authenticate reports whether the provided password matches the stored hash of the user. Successful verifications
+// are remembered for a short time, where only a hash of the credentials is kept.
+func (h *Htpasswd) Authenticate(user string, password string) bool {
+	// The length of the user keeps apart credentials that would read the same once joined
+	key := sha256.Sum256([]byte(strconv.Itoa(len(user)) + ":" + user + password))
+	now := time.Now()
+
+	h.mu.Lock()
+	verified, found := h.verified[key]
+	h.mu.Unlock()
+	if found && now.Before(verified.Add(verifiedFor)) {
+		return true
+	}
+
+	hash, found := h.users[user]
+	if !found {
+		verify(h.dummy, password)
+		return false
+	}
+
+	if !verify(hash, password) {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Expired verifications are dropped along the way, so the map does not grow beyond the number of users
+	for k, v := range h.verified {
+		if !now.Before(v.Add(verifiedFor)) {
+			delete(h.verified, k)
+		}
+	}
+	h.verified[key] = now
+	return true
+}
+
+// Users returns the number of users that are known.
+func (h *Htpasswd) Users() int {
+	return len(h.users)
+}
+
+// verify reports whether the password matches the hash.
+func verify(hash string, password string) bool {
+	if strings.HasPrefix(hash, shaPrefix) {
+		// #nosec G401 SHA1 is required to support the {SHA} scheme of htpasswd files
+		sum := sha1.Sum([]byte(password))
+		expected := shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func isSupportedHash(hash string) bool {
+	if strings.HasPrefix(hash, shaPrefix) {
+		return len(hash) > len(shaPrefix)
+	}
+
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
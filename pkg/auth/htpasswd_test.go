@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type faultyReader int
+
+func (faultyReader) Read(p []byte) (n int, err error) {
+	return 0, errors.New("test error")
+}
+
+func TestNewHtpasswd(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantUsers   int
+		expectErr   bool
+		wantMessage string
+	}{
+		{name: "bcrypt and sha entries", content: "ci:$2y$05$4Y7Y2Vt0O6rnq1eXfO8eduJ0f4Xw5Kx5kM0pB5uH1yYJ0cJ5o8p7e\ndev:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", wantUsers: 2},
+		{name: "comments and empty lines are skipped", content: "# users\n\nci:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", wantUsers: 1},
+		{name: "missing separator", content: "ci\n", expectErr: true, wantMessage: "line 1 is not in the format user:hash"},
+		{name: "missing user", content: ":{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", expectErr: true, wantMessage: "line 1 is not in the format user:hash"},
+		{name: "unsupported md5 hash", content: "ci:$apr1$abc$def\n", expectErr: true, wantMessage: "line 1 uses an unsupported hash for user ci"},
+		{name: "plain text password", content: "# users\nci:password\n", expectErr: true, wantMessage: "line 2 uses an unsupported hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewHtpasswd(ioutil.NopCloser(strings.NewReader(tt.content)))
+
+			if tt.expectErr {
+				assert.Error(t, err, "should throw err")
+				assert.Contains(t, err.Error(), tt.wantMessage, "Did not throw expected error")
+			} else {
+				assert.NoError(t, err, "should not throw error")
+				assert.Equal(t, tt.wantUsers, got.Users())
+			}
+		})
+	}
+
+	t.Run("faulty reader", func(t *testing.T) {
+		_, err := NewHtpasswd(ioutil.NopCloser(faultyReader(0)))
+		assert.Error(t, err, "should throw err")
+	})
+}
+
+func TestHtpasswd_Authenticate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	// {SHA} of "password"
+	content := "ci:" + string(hash) + "\ndev:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+
+	htpasswd, err := NewHtpasswd(ioutil.NopCloser(strings.NewReader(content)))
+	assert.NoError(t, err, "should not throw error")
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     bool
+	}{
+		{name: "valid bcrypt password", user: "ci", password: "secret", want: true},
+		{name: "invalid bcrypt password", user: "ci", password: "password", want: false},
+		{name: "valid sha password", user: "dev", password: "password", want: true},
+		{name: "invalid sha password", user: "dev", password: "secret", want: false},
+		{name: "unknown user", user: "ops", password: "secret", want: false},
+		{name: "empty credentials", user: "", password: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, htpasswd.Authenticate(tt.user, tt.password))
+		})
+	}
+}
+
+func TestHtpasswd_AuthenticateCache(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswd, err := NewHtpasswd(ioutil.NopCloser(strings.NewReader("ci:" + string(hash) + "\n")))
+	assert.NoError(t, err, "should not throw error")
+
+	cost, err := bcrypt.Cost([]byte(htpasswd.dummy))
+	assert.NoError(t, err, "should verify unknown users against a bcrypt hash")
+	assert.Equal(t, bcrypt.MinCost, cost, "should be as expensive as the stored hashes")
+
+	assert.False(t, htpasswd.Authenticate("ci", "wrong"))
+	assert.Empty(t, htpasswd.verified, "should not remember failed verifications")
+
+	assert.True(t, htpasswd.Authenticate("ci", "secret"))
+	assert.True(t, htpasswd.Authenticate("ci", "secret"))
+	assert.Len(t, htpasswd.verified, 1, "should remember successful verifications")
+	assert.False(t, htpasswd.Authenticate("c", "isecret"), "should not mistake other credentials for remembered ones")
+
+	for key := range htpasswd.verified {
+		htpasswd.verified[key] = time.Now().Add(-verifiedFor)
+	}
+	assert.True(t, htpasswd.Authenticate("ci", "secret"), "should verify again once expired")
+	assert.Len(t, htpasswd.verified, 1, "should drop expired verifications")
+
+	t.Run("sha only", func(t *testing.T) {
+		htpasswd, err := NewHtpasswd(ioutil.NopCloser(strings.NewReader("dev:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")))
+		assert.NoError(t, err, "should not throw error")
+		assert.True(t, strings.HasPrefix(htpasswd.dummy, shaPrefix), "should not verify unknown users against bcrypt")
+		assert.False(t, htpasswd.Authenticate("ops", ""))
+	})
+}
@@ -1,19 +1,74 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 type ForwardProxyConfig struct {
-	Proxy      Proxy      `yaml:"Proxy"`
-	Monitoring Monitoring `yaml:"Monitoring"`
+	Proxy          Proxy          `yaml:"Proxy"`
+	Monitoring     Monitoring     `yaml:"Monitoring"`
+	Access         Access         `yaml:"Access"`
+	Destinations   Destinations   `yaml:"Destinations"`
+	Clients        Clients        `yaml:"Clients"`
+	Authentication Authentication `yaml:"Authentication"`
+	Policy         Policy         `yaml:"Policy"`
+	Logging        Logging        `yaml:"Logging"`
+	Upstream       Upstream       `yaml:"Upstream"`
+	Headers        Headers        `yaml:"Headers"`
+	UpstreamTLS    UpstreamTLS    `yaml:"UpstreamTLS"`
+	Interception   Interception   `yaml:"Interception"`
+	SNI            SNI            `yaml:"SNI"`
+	Cache          Cache          `yaml:"Cache"`
+	Coalescing     Coalescing     `yaml:"Coalescing"`
+	RateLimits     RateLimits     `yaml:"RateLimits"`
+	Bandwidth      Bandwidth      `yaml:"Bandwidth"`
+	Concurrency    Concurrency    `yaml:"Concurrency"`
 }
 
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+
+	OutputStdout = "stdout"
+)
+
+// RouteDirect is used by upstream rules for destinations that are reached without a parent proxy.
+const RouteDirect = "direct"
+
+const (
+	ParentHTTP   = "http"
+	ParentSOCKS5 = "socks5"
+)
+
+// Modes of the headers that announce the proxy hop
+const (
+	HeaderAdd       = "add"
+	HeaderAnonymize = "anonymize"
+	HeaderSuppress  = "suppress"
+)
+
 type BufferSizes struct {
 	Read  int `yaml:"Read"`
 	Write int `yaml:"Write"`
@@ -28,20 +83,305 @@ type Timeouts struct {
 	Read    string `yaml:"Read"`
 	Write   string `yaml:"Write"`
 	Connect string `yaml:"Connect"`
+	// Drain is the maximum time live tunnels get to finish during shutdown before they are closed forcefully
+	Drain string `yaml:"Drain"`
 }
 
 type Proxy struct {
-	Server      string      `yaml:"Server"`
-	Port        uint16      `yaml:"Port"`
+	Server string `yaml:"Server"`
+	Port   uint16 `yaml:"Port"`
+	// SOCKS5Port enables an additional SOCKS5 listener on Server, which is disabled if left empty
+	SOCKS5Port  uint16      `yaml:"SOCKS5Port"`
 	BufferSizes BufferSizes `yaml:"BufferSizes"`
 	Limits      Limits      `yaml:"Limits"`
 	Timeouts    Timeouts    `yaml:"Timeouts"`
+	TLS         ListenerTLS `yaml:"TLS"`
+}
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// ListenerTLS terminates TLS on the proxy listener, which stays in cleartext without Certificates. The certificate is
+// selected by the server name that clients indicate, where the first one serves clients without a matching name.
+// ClientAuth is one of none, optional or require and verifies client certificates against ClientCAFile, where the
+// common name of a verified certificate identifies the client as user. The files are reloaded once they change.
+type ListenerTLS struct {
+	Certificates []CertificateFiles `yaml:"Certificates,omitempty"`
+	MinVersion   string             `yaml:"MinVersion"`
+	ClientCAFile string             `yaml:"ClientCAFile"`
+	ClientAuth   string             `yaml:"ClientAuth"`
+}
+
+// Enabled reports whether the proxy listener terminates TLS.
+func (l ListenerTLS) Enabled() bool {
+	return len(l.Certificates) > 0
+}
+
+// CertificateFiles points to a PEM encoded certificate chain and its private key.
+type CertificateFiles struct {
+	CertFile string `yaml:"CertFile"`
+	KeyFile  string `yaml:"KeyFile"`
 }
 
 type Monitoring struct {
 	Port uint16 `yaml:"Port"`
 }
 
+// Access contains the domain patterns that decide which destinations are reachable through the proxy.
+// A pattern is either an exact host (example.com), a wildcard for all subdomains (*.example.com) or
+// a regular expression enclosed in slashes (/^mirror[0-9]+\.example\.com$/).
+type Access struct {
+	Allow []string `yaml:"Allow,omitempty"`
+	Deny  []string `yaml:"Deny,omitempty"`
+}
+
+// Destinations contains CIDR ranges (or single addresses) that are checked against the resolved address of an
+// upstream right before dialing it. Loopback, link-local and cloud metadata addresses are always denied, unless
+// they are covered by an entry within Allow.
+type Destinations struct {
+	Allow []string `yaml:"Allow,omitempty"`
+	Deny  []string `yaml:"Deny,omitempty"`
+}
+
+// Clients contains CIDR ranges (or single addresses) of the clients that are permitted to use the proxy.
+// An empty list permits every client.
+type Clients struct {
+	Allow []string `yaml:"Allow,omitempty"`
+}
+
+// Authentication enables Proxy-Authorization using Basic credentials, where the users are loaded from the
+// htpasswd file at HtpasswdFile. Leaving HtpasswdFile empty disables authentication.
+type Authentication struct {
+	HtpasswdFile string `yaml:"HtpasswdFile"`
+	Realm        string `yaml:"Realm"`
+}
+
+// Logging configures the log output of the proxy. If set, Level takes precedence over the logLevel flag
+// and has to be one of debug, info, warn, error, fatal or panic.
+type Logging struct {
+	Level  string    `yaml:"Level"`
+	Access AccessLog `yaml:"Access"`
+}
+
+// AccessLog configures the audit trail, which records every proxied request and tunnel once it finished.
+// Format is one of json, common or combined, while Output is either stdout or the path of a file. Files are
+// rotated once they exceed MaxSize megabytes, where MaxBackups of the rotated files are kept.
+type AccessLog struct {
+	Enabled    bool   `yaml:"Enabled"`
+	Format     string `yaml:"Format"`
+	Output     string `yaml:"Output"`
+	MaxSize    int    `yaml:"MaxSize"`
+	MaxBackups int    `yaml:"MaxBackups"`
+}
+
+// Policy contains rules that are evaluated in order for each request, where the first matching rule decides.
+// Requests that are not matched by any rule are handled according to Default, which is either allow or deny.
+type Policy struct {
+	Default string              `yaml:"Default"`
+	Groups  map[string][]string `yaml:"Groups,omitempty"`
+	Rules   []Rule              `yaml:"Rules,omitempty"`
+}
+
+// Rule matches requests by the identity of the client, the destination domain, port and method.
+// Criteria that are left empty match every request.
+type Rule struct {
+	Name    string   `yaml:"Name"`
+	Action  string   `yaml:"Action"`
+	Users   []string `yaml:"Users,omitempty"`
+	Groups  []string `yaml:"Groups,omitempty"`
+	Domains []string `yaml:"Domains,omitempty"`
+	Ports   []uint16 `yaml:"Ports,omitempty"`
+	Methods []string `yaml:"Methods,omitempty"`
+}
+
+// Upstream configures parent proxies the proxy can chain requests through. Rules are evaluated in order, where the
+// first rule matching the destination domain decides whether it is reached via a parent or directly. Via is either
+// direct or the name of a parent, while destinations not matched by any rule use Default.
+type Upstream struct {
+	Default string         `yaml:"Default"`
+	Parents []Parent       `yaml:"Parents,omitempty"`
+	Rules   []UpstreamRule `yaml:"Rules,omitempty"`
+	Pool    Pool           `yaml:"Pool"`
+}
+
+// Pool configures the reuse of connections for forwarded requests, which are pooled per destination or per parent
+// proxy. MaxConnsPerHost limits the open connections of each of them, where 0 means unlimited. Up to MaxIdleConns
+// unused connections are kept open in total, each for at most IdleTimeout.
+type Pool struct {
+	MaxConnsPerHost int    `yaml:"MaxConnsPerHost"`
+	MaxIdleConns    int    `yaml:"MaxIdleConns"`
+	IdleTimeout     string `yaml:"IdleTimeout"`
+}
+
+// Parent is a proxy reachable at Address (host:port), where Type is either http or socks5. Username and Password
+// are optional and either sent as Basic Proxy-Authorization or used for the SOCKS5 username/password method.
+type Parent struct {
+	Name     string `yaml:"Name"`
+	Type     string `yaml:"Type"`
+	Address  string `yaml:"Address"`
+	Username string `yaml:"Username"`
+	Password string `yaml:"Password"`
+}
+
+// UpstreamRule routes destinations matching Domains via the named parent or directly.
+type UpstreamRule struct {
+	Domains []string `yaml:"Domains,omitempty"`
+	Via     string   `yaml:"Via"`
+}
+
+// UpstreamTLS configures the TLS connections that are established for forwarded https:// requests. Hosts override
+// the settings for matching destination domains, where the first matching entry wins and only its non-empty fields
+// take precedence.
+type UpstreamTLS struct {
+	TLSSettings `yaml:",inline"`
+	Hosts       []TLSHost `yaml:"Hosts,omitempty"`
+}
+
+// TLSSettings of upstream connections. CAFile adds PEM encoded certificates to the system roots, while CertFile and
+// KeyFile provide a client certificate. MinVersion is one of 1.0, 1.1, 1.2 or 1.3 and CipherSuites uses the names of
+// crypto/tls, which only apply up to TLS 1.2. Pins are base64 encoded SHA-256 hashes of a subject public key info, where
+// one of the certificates presented by the upstream has to match any of them.
+type TLSSettings struct {
+	CAFile       string   `yaml:"CAFile"`
+	CertFile     string   `yaml:"CertFile"`
+	KeyFile      string   `yaml:"KeyFile"`
+	MinVersion   string   `yaml:"MinVersion"`
+	CipherSuites []string `yaml:"CipherSuites,omitempty"`
+	Pins         []string `yaml:"Pins,omitempty"`
+}
+
+// TLSHost overrides the upstream TLS settings for destinations matching Domains.
+type TLSHost struct {
+	Domains     []string `yaml:"Domains,omitempty"`
+	TLSSettings `yaml:",inline"`
+}
+
+// TLSVersions maps the supported values of MinVersion to their crypto/tls constant.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CipherSuite returns the id of the cipher suite by its crypto/tls name.
+func CipherSuite(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Interception terminates TLS of CONNECT tunnels towards Domains, so their decrypted requests pass through the same
+// pipeline as forwarded requests. Certificates are minted per server name, signed by the CA of CACertFile and
+// CAKeyFile, which clients have to trust. Up to CacheSize minted certificates are kept in memory. Tunnels towards
+// other domains are relayed without looking into them.
+type Interception struct {
+	Domains    []string `yaml:"Domains,omitempty"`
+	CACertFile string   `yaml:"CACertFile"`
+	CAKeyFile  string   `yaml:"CAKeyFile"`
+	CacheSize  int      `yaml:"CacheSize"`
+}
+
+const (
+	SNIOff     = "off"
+	SNILog     = "log"
+	SNIEnforce = "enforce"
+)
+
+// SNI peeks at the TLS ClientHello of tunnels towards Ports without terminating TLS. Mode is one of off, log or
+// enforce, where enforce closes tunnels whose server name neither matches the requested host nor any of Allow,
+// while log only records them. Tunnels without server name are closed in enforce mode only if RequireSNI is set.
+type SNI struct {
+	Mode       string   `yaml:"Mode"`
+	Ports      []uint16 `yaml:"Ports,omitempty"`
+	Allow      []string `yaml:"Allow,omitempty"`
+	RequireSNI bool     `yaml:"RequireSNI"`
+}
+
+// Cache stores responses of forwarded requests as a shared cache according to RFC 9111. Responses are kept in memory
+// up to MemorySize bytes, from where the least recently used ones move to DiskPath up to DiskSize bytes if it is set.
+// Responses larger than MaxEntrySize are not stored at all. Caching is disabled while MemorySize is 0.
+type Cache struct {
+	MemorySize   int64  `yaml:"MemorySize"`
+	MaxEntrySize int64  `yaml:"MaxEntrySize"`
+	DiskPath     string `yaml:"DiskPath"`
+	DiskSize     int64  `yaml:"DiskSize"`
+}
+
+// Enabled reports whether responses are cached.
+func (c Cache) Enabled() bool {
+	return c.MemorySize > 0
+}
+
+// Coalescing lets identical cacheable requests that arrive while one of them is forwarded wait for its response,
+// rather than asking the upstream on their own. Waiters give up after MaxWait, while responses whose body exceeds
+// MaxBodySize are not shared. In both cases the waiters forward their requests on their own.
+type Coalescing struct {
+	Enabled     bool   `yaml:"Enabled"`
+	MaxWait     string `yaml:"MaxWait"`
+	MaxBodySize int64  `yaml:"MaxBodySize"`
+}
+
+// RateLimits throttles requests along with the bandwidth of tunnels. Each client IP, authenticated user and
+// destination domain has buckets of its own, which are filled according to the limit of its kind.
+type RateLimits struct {
+	Clients      RateLimit `yaml:"Clients"`
+	Users        RateLimit `yaml:"Users"`
+	Destinations RateLimit `yaml:"Destinations"`
+}
+
+// RateLimit is a token bucket for requests and one for bytes. Up to Burst requests are accepted at once, which are
+// refilled by RequestsPerSecond, while tunnels may transfer BytesPerSecond after an initial ByteBurst. Burst and
+// ByteBurst default to a second worth of their rate, while rates of 0 are unlimited.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"RequestsPerSecond"`
+	Burst             int     `yaml:"Burst"`
+	BytesPerSecond    int64   `yaml:"BytesPerSecond"`
+	ByteBurst         int64   `yaml:"ByteBurst"`
+}
+
+// Bandwidth shapes the throughput of tunnels, where Total caps all of them together and Tunnel every one of them on
+// its own. Changes apply to established tunnels as well.
+type Bandwidth struct {
+	Total  BandwidthLimit `yaml:"Total"`
+	Tunnel BandwidthLimit `yaml:"Tunnel"`
+}
+
+// BandwidthLimit caps the bytes per second sent towards the destination by Upload and towards the client by
+// Download, where 0 is unlimited.
+type BandwidthLimit struct {
+	Upload   int64 `yaml:"Upload"`
+	Download int64 `yaml:"Download"`
+}
+
+// Concurrency bounds the tunnels that are open in total and per client IP as well as the requests that are forwarded
+// to each destination host at once, where 0 is unlimited. Beyond a limit up to QueueSize requests wait for at most
+// QueueTimeout, while further ones are answered with 503.
+type Concurrency struct {
+	Tunnels          int    `yaml:"Tunnels"`
+	TunnelsPerClient int    `yaml:"TunnelsPerClient"`
+	RequestsPerHost  int    `yaml:"RequestsPerHost"`
+	QueueSize        int    `yaml:"QueueSize"`
+	QueueTimeout     string `yaml:"QueueTimeout"`
+}
+
+// Headers configures the headers that announce the proxy hop within forwarded messages. Via is either add or
+// suppress and identifies the proxy by Pseudonym, while XForwardedFor and Forwarded additionally accept anonymize,
+// which discloses the hop without the address of the client. Suppress removes the header including values of
+// previous hops.
+type Headers struct {
+	Via           string `yaml:"Via"`
+	XForwardedFor string `yaml:"XForwardedFor"`
+	Forwarded     string `yaml:"Forwarded"`
+	Pseudonym     string `yaml:"Pseudonym"`
+}
+
 // New creates a config from the provided reader that should point towards a valid yaml version.
 // During reading it will validate ports and timeouts.
 func New(reader io.ReadCloser) (*ForwardProxyConfig, error) {
@@ -69,6 +409,98 @@ func New(reader io.ReadCloser) (*ForwardProxyConfig, error) {
 		return nil, err
 	}
 
+	err = validateAccess(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateNetworks(conf.Destinations.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateNetworks(conf.Destinations.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateListenerTLS(conf.Proxy.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateNetworks(conf.Clients.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validatePolicy(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.Logging.Level) > 0 {
+		_, err = log.ParseLevel(conf.Logging.Level)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = validateUpstream(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateHeaders(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateUpstreamTLS(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateInterception(conf.Interception)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateCache(conf.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateRateLimits(conf.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateBandwidth(conf.Bandwidth)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateConcurrency(conf.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateCoalescing(conf.Coalescing)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateSNI(conf.SNI)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateAccessLog(conf.Logging.Access)
+	if err != nil {
+		return nil, err
+	}
+
 	fillDefaults(&conf)
 	return &conf, nil
 }
@@ -92,6 +524,21 @@ func validateDurations(conf ForwardProxyConfig) error {
 		return err
 	}
 
+	// Drain is optional and will be filled with a default if it is missing
+	if len(conf.Proxy.Timeouts.Drain) > 0 {
+		_, err = time.ParseDuration(conf.Proxy.Timeouts.Drain)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(conf.Upstream.Pool.IdleTimeout) > 0 {
+		_, err = time.ParseDuration(conf.Upstream.Pool.IdleTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -108,11 +555,509 @@ func validatePorts(conf ForwardProxyConfig) error {
 		return errors.New("monitoring port is not within valid range 1 < port < 65535")
 	}
 
+	// The SOCKS5 listener is optional, hence 0 is valid as well
+	if conf.Proxy.SOCKS5Port > 0 {
+		validSOCKS5Port := conf.Proxy.SOCKS5Port > 1 && conf.Proxy.SOCKS5Port < 65535
+		if !validSOCKS5Port {
+			return errors.New("socks5 port is not within valid range 1 < port < 65535")
+		}
+
+		if conf.Proxy.SOCKS5Port == conf.Proxy.Port {
+			return errors.New("socks5 port must differ from proxy port")
+		}
+	}
+
+	return nil
+}
+
+// validateAccess ensures that all regular expressions used within the access lists can be compiled.
+func validateAccess(conf ForwardProxyConfig) error {
+	err := validatePatterns(conf.Access.Allow)
+	if err != nil {
+		return err
+	}
+
+	return validatePatterns(conf.Access.Deny)
+}
+
+// validatePatterns ensures that the provided domain patterns are well formed.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if len(strings.TrimSpace(pattern)) == 0 {
+			return errors.New("domain pattern must not be empty")
+		}
+
+		if IsRegexPattern(pattern) {
+			_, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return fmt.Errorf("domain pattern %s is not a valid regular expression: %s", pattern, err)
+			}
+		}
+	}
+
 	return nil
 }
 
+// validatePolicy ensures that all actions are known and that rules only reference defined groups.
+func validatePolicy(conf ForwardProxyConfig) error {
+	if len(conf.Policy.Default) > 0 && !isValidAction(conf.Policy.Default) {
+		return fmt.Errorf("policy default %s is neither %s nor %s", conf.Policy.Default, ActionAllow, ActionDeny)
+	}
+
+	for idx, rule := range conf.Policy.Rules {
+		if !isValidAction(rule.Action) {
+			return fmt.Errorf("policy rule %d (%s) has action %s which is neither %s nor %s", idx, rule.Name, rule.Action, ActionAllow, ActionDeny)
+		}
+
+		for _, group := range rule.Groups {
+			if _, found := conf.Policy.Groups[group]; !found {
+				return fmt.Errorf("policy rule %d (%s) references unknown group %s", idx, rule.Name, group)
+			}
+		}
+
+		err := validatePatterns(rule.Domains)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateUpstream ensures that parents are uniquely named with valid addresses and that rules only reference them.
+func validateUpstream(conf ForwardProxyConfig) error {
+	parents := make(map[string]struct{}, len(conf.Upstream.Parents))
+	for idx, parent := range conf.Upstream.Parents {
+		if len(parent.Name) == 0 || parent.Name == RouteDirect {
+			return fmt.Errorf("upstream parent %d must have a name other than %s", idx, RouteDirect)
+		}
+
+		if _, found := parents[parent.Name]; found {
+			return fmt.Errorf("upstream parent %s is defined more than once", parent.Name)
+		}
+		parents[parent.Name] = struct{}{}
+
+		switch parent.Type {
+		case "", ParentHTTP:
+		case ParentSOCKS5:
+			// RFC 1929 limits both to 255 bytes
+			if len(parent.Username) > 255 || len(parent.Password) > 255 {
+				return fmt.Errorf("upstream parent %s has credentials exceeding 255 bytes", parent.Name)
+			}
+		default:
+			return fmt.Errorf("upstream parent %s has type %s which is neither %s nor %s", parent.Name, parent.Type, ParentHTTP, ParentSOCKS5)
+		}
+
+		_, _, err := net.SplitHostPort(parent.Address)
+		if err != nil {
+			return fmt.Errorf("upstream parent %s has invalid address %s: %s", parent.Name, parent.Address, err)
+		}
+	}
+
+	isValidRoute := func(via string) bool {
+		_, found := parents[via]
+		return found || via == RouteDirect
+	}
+
+	if len(conf.Upstream.Default) > 0 && !isValidRoute(conf.Upstream.Default) {
+		return fmt.Errorf("upstream default %s is neither %s nor a defined parent", conf.Upstream.Default, RouteDirect)
+	}
+
+	for idx, rule := range conf.Upstream.Rules {
+		if !isValidRoute(rule.Via) {
+			return fmt.Errorf("upstream rule %d routes via %s which is neither %s nor a defined parent", idx, rule.Via, RouteDirect)
+		}
+
+		err := validatePatterns(rule.Domains)
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.Upstream.Pool.MaxConnsPerHost < 0 || conf.Upstream.Pool.MaxIdleConns < 0 {
+		return errors.New("upstream pool limits must not be negative")
+	}
+
+	return nil
+}
+
+// validateHeaders ensures that the modes of the hop headers are known and that the pseudonym is a valid token.
+func validateHeaders(conf ForwardProxyConfig) error {
+	switch conf.Headers.Via {
+	case "", HeaderAdd, HeaderSuppress:
+	default:
+		return fmt.Errorf("headers via mode %s is neither %s nor %s", conf.Headers.Via, HeaderAdd, HeaderSuppress)
+	}
+
+	modes := map[string]string{"x-forwarded-for": conf.Headers.XForwardedFor, "forwarded": conf.Headers.Forwarded}
+	for name, mode := range modes {
+		switch mode {
+		case "", HeaderAdd, HeaderAnonymize, HeaderSuppress:
+		default:
+			return fmt.Errorf("headers %s mode %s is neither %s, %s nor %s", name, mode, HeaderAdd, HeaderAnonymize, HeaderSuppress)
+		}
+	}
+
+	// The pseudonym becomes part of the Via header, where whitespace or separators would corrupt its syntax
+	if strings.ContainsAny(conf.Headers.Pseudonym, " \t,;()\"") {
+		return fmt.Errorf("headers pseudonym %q must not contain whitespace, separators or quotes", conf.Headers.Pseudonym)
+	}
+
+	return nil
+}
+
+// validateUpstreamTLS ensures that certificates can be loaded and that versions, cipher suites and pins are known.
+func validateUpstreamTLS(conf ForwardProxyConfig) error {
+	err := validateTLSSettings("upstream tls", conf.UpstreamTLS.TLSSettings)
+	if err != nil {
+		return err
+	}
+
+	for idx, host := range conf.UpstreamTLS.Hosts {
+		if len(host.Domains) == 0 {
+			return fmt.Errorf("upstream tls host %d must match at least one domain", idx)
+		}
+
+		err := validatePatterns(host.Domains)
+		if err != nil {
+			return err
+		}
+
+		err = validateTLSSettings(fmt.Sprintf("upstream tls host %d", idx), host.TLSSettings)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTLSSettings(name string, settings TLSSettings) error {
+	if len(settings.CAFile) > 0 {
+		_, err := LoadCertPool(settings.CAFile, true)
+		if err != nil {
+			return fmt.Errorf("%s ca file %s is invalid: %s", name, settings.CAFile, err)
+		}
+	}
+
+	if (len(settings.CertFile) > 0) != (len(settings.KeyFile) > 0) {
+		return fmt.Errorf("%s requires both cert file and key file", name)
+	}
+
+	if len(settings.CertFile) > 0 {
+		_, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return fmt.Errorf("%s client certificate is invalid: %s", name, err)
+		}
+	}
+
+	if _, found := TLSVersions[settings.MinVersion]; len(settings.MinVersion) > 0 && !found {
+		return fmt.Errorf("%s min version %s is neither 1.0, 1.1, 1.2 nor 1.3", name, settings.MinVersion)
+	}
+
+	for _, suite := range settings.CipherSuites {
+		if _, found := CipherSuite(suite); !found {
+			return fmt.Errorf("%s cipher suite %s is unknown", name, suite)
+		}
+	}
+
+	for _, pin := range settings.Pins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%s pin %s is not a base64 encoded SHA-256 hash", name, pin)
+		}
+	}
+
+	return nil
+}
+
+// validateListenerTLS ensures that certificates can be loaded and that client authentication is possible.
+func validateListenerTLS(conf ListenerTLS) error {
+	if !conf.Enabled() {
+		if len(conf.ClientCAFile) > 0 || (len(conf.ClientAuth) > 0 && conf.ClientAuth != ClientAuthNone) {
+			return errors.New("proxy tls client authentication requires at least one certificate")
+		}
+		return nil
+	}
+
+	for idx, files := range conf.Certificates {
+		_, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("proxy tls certificate %d is invalid: %s", idx, err)
+		}
+	}
+
+	if _, found := TLSVersions[conf.MinVersion]; len(conf.MinVersion) > 0 && !found {
+		return fmt.Errorf("proxy tls min version %s is neither 1.0, 1.1, 1.2 nor 1.3", conf.MinVersion)
+	}
+
+	switch conf.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if len(conf.ClientCAFile) == 0 {
+			return fmt.Errorf("proxy tls client auth %s requires a client ca file", conf.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("proxy tls client auth %s is neither none, optional nor require", conf.ClientAuth)
+	}
+
+	if len(conf.ClientCAFile) > 0 {
+		_, err := LoadCertPool(conf.ClientCAFile, false)
+		if err != nil {
+			return fmt.Errorf("proxy tls client ca file %s is invalid: %s", conf.ClientCAFile, err)
+		}
+	}
+
+	return nil
+}
+
+// validateInterception ensures that the CA can sign certificates once domains are intercepted.
+func validateInterception(conf Interception) error {
+	if conf.CacheSize < 0 {
+		return errors.New("interception cache size must not be negative")
+	}
+
+	if len(conf.Domains) == 0 {
+		return nil
+	}
+
+	err := validatePatterns(conf.Domains)
+	if err != nil {
+		return err
+	}
+
+	if len(conf.CACertFile) == 0 || len(conf.CAKeyFile) == 0 {
+		return errors.New("interception requires both ca cert file and ca key file")
+	}
+
+	_, err = LoadCA(conf.CACertFile, conf.CAKeyFile)
+	if err != nil {
+		return fmt.Errorf("interception ca is invalid: %s", err)
+	}
+
+	return nil
+}
+
+// validateCache ensures that the sizes of the cache are sensible and that the disk tier has a directory to use.
+func validateCache(conf Cache) error {
+	if conf.MemorySize < 0 || conf.MaxEntrySize < 0 || conf.DiskSize < 0 {
+		return errors.New("cache sizes must not be negative")
+	}
+
+	if conf.DiskSize > 0 && len(conf.DiskPath) == 0 {
+		return errors.New("cache disk size requires a disk path")
+	}
+
+	if len(conf.DiskPath) > 0 {
+		info, err := os.Stat(conf.DiskPath)
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("cache disk path %s is not a directory", conf.DiskPath)
+		}
+	}
+
+	return nil
+}
+
+// validateRateLimits ensures that none of the rates and bursts is negative.
+func validateRateLimits(conf RateLimits) error {
+	for _, limit := range []RateLimit{conf.Clients, conf.Users, conf.Destinations} {
+		if limit.RequestsPerSecond < 0 || limit.Burst < 0 || limit.BytesPerSecond < 0 || limit.ByteBurst < 0 {
+			return errors.New("rate limits must not be negative")
+		}
+	}
+
+	return nil
+}
+
+// validateBandwidth ensures that none of the bandwidth limits is negative.
+func validateBandwidth(conf Bandwidth) error {
+	for _, limit := range []BandwidthLimit{conf.Total, conf.Tunnel} {
+		if limit.Upload < 0 || limit.Download < 0 {
+			return errors.New("bandwidth limits must not be negative")
+		}
+	}
+
+	return nil
+}
+
+// validateConcurrency ensures that none of the concurrency limits is negative and that the queue timeout can be parsed.
+func validateConcurrency(conf Concurrency) error {
+	if conf.Tunnels < 0 || conf.TunnelsPerClient < 0 || conf.RequestsPerHost < 0 || conf.QueueSize < 0 {
+		return errors.New("concurrency limits must not be negative")
+	}
+
+	if len(conf.QueueTimeout) > 0 {
+		if _, err := time.ParseDuration(conf.QueueTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateCoalescing ensures that the max body size is not negative and that the max wait can be parsed.
+func validateCoalescing(conf Coalescing) error {
+	if conf.MaxBodySize < 0 {
+		return errors.New("coalescing max body size must not be negative")
+	}
+
+	if len(conf.MaxWait) > 0 {
+		if _, err := time.ParseDuration(conf.MaxWait); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateSNI ensures that the mode is known and that all patterns of the allow list can be compiled.
+func validateSNI(conf SNI) error {
+	switch conf.Mode {
+	case "", SNIOff, SNILog, SNIEnforce:
+	default:
+		return fmt.Errorf("sni mode %s is neither off, log nor enforce", conf.Mode)
+	}
+
+	return validatePatterns(conf.Allow)
+}
+
+// validateAccessLog ensures that the format of the access log is known.
+func validateAccessLog(conf AccessLog) error {
+	switch conf.Format {
+	case "", FormatJSON, FormatCommon, FormatCombined:
+	default:
+		return fmt.Errorf("access log format %s is neither %s, %s nor %s", conf.Format, FormatJSON, FormatCommon, FormatCombined)
+	}
+
+	return nil
+}
+
+// LoadCA reads a CA certificate along with its key, where the certificate has to be allowed to sign certificates.
+func LoadCA(certFile string, keyFile string) (tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ca, err
+	}
+
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return ca, err
+	}
+
+	if !ca.Leaf.IsCA || ca.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return ca, fmt.Errorf("certificate %s is not allowed to sign certificates", certFile)
+	}
+	return ca, nil
+}
+
+// LoadCertPool reads the PEM encoded certificates of path into a pool, which extends the system roots if
+// systemRoots is set.
+func LoadCertPool(path string, systemRoots bool) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if systemRoots {
+		if system, err := x509.SystemCertPool(); err == nil {
+			pool = system
+		}
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("it contains no PEM encoded certificate")
+	}
+	return pool, nil
+}
+
+func isValidAction(action string) bool {
+	return action == ActionAllow || action == ActionDeny
+}
+
+// validateNetworks ensures that all provided entries are either valid CIDR ranges or plain IP addresses.
+func validateNetworks(entries []string) error {
+	for _, entry := range entries {
+		_, err := ParseNetwork(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseNetwork parses either a CIDR range or a plain IP address, where the latter is treated as a single host network.
+func ParseNetwork(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("network %s is not a valid CIDR range: %s", entry, err)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("network %s is neither a valid CIDR range nor an IP address", entry)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// IsRegexPattern reports whether the provided domain pattern is a regular expression enclosed in slashes.
+func IsRegexPattern(pattern string) bool {
+	return len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
 // fillDefaults ensures that the fields of the config that are unspecified by the user are set to defaults
 func fillDefaults(conf *ForwardProxyConfig) {
+	if len(conf.SNI.Mode) == 0 {
+		conf.SNI.Mode = SNIOff
+	}
+
+	if len(conf.SNI.Ports) == 0 {
+		conf.SNI.Ports = []uint16{443}
+	}
+
+	if conf.Interception.CacheSize == 0 {
+		conf.Interception.CacheSize = 1000
+	}
+
+	if conf.Cache.MaxEntrySize == 0 {
+		conf.Cache.MaxEntrySize = 10 << 20
+	}
+
+	for _, limit := range []*RateLimit{&conf.RateLimits.Clients, &conf.RateLimits.Users, &conf.RateLimits.Destinations} {
+		if limit.Burst == 0 && limit.RequestsPerSecond > 0 {
+			limit.Burst = int(math.Ceil(limit.RequestsPerSecond))
+		}
+		if limit.ByteBurst == 0 {
+			limit.ByteBurst = limit.BytesPerSecond
+		}
+	}
+
+	if len(conf.Concurrency.QueueTimeout) == 0 {
+		conf.Concurrency.QueueTimeout = "10s"
+	}
+
+	if len(conf.Coalescing.MaxWait) == 0 {
+		conf.Coalescing.MaxWait = "30s"
+	}
+
+	if conf.Coalescing.MaxBodySize == 0 {
+		conf.Coalescing.MaxBodySize = 10 << 20
+	}
+
+	if len(conf.Proxy.TLS.ClientAuth) == 0 {
+		conf.Proxy.TLS.ClientAuth = ClientAuthNone
+	}
+
 	// First check for buffer sizes
 	if conf.Proxy.BufferSizes.Read <= 0 {
 		// This is the default value of fasthttp
@@ -128,4 +1073,67 @@ func fillDefaults(conf *ForwardProxyConfig) {
 		// This is the default value of fasthttp
 		conf.Proxy.Limits.MaxBodySize = 4 * 1024 * 1024
 	}
+
+	if len(conf.Proxy.Timeouts.Drain) == 0 {
+		conf.Proxy.Timeouts.Drain = "30s"
+	}
+
+	if len(conf.Logging.Access.Format) == 0 {
+		conf.Logging.Access.Format = FormatJSON
+	}
+
+	if len(conf.Logging.Access.Output) == 0 {
+		conf.Logging.Access.Output = OutputStdout
+	}
+
+	if conf.Logging.Access.MaxSize <= 0 {
+		conf.Logging.Access.MaxSize = 100
+	}
+
+	if conf.Logging.Access.MaxBackups <= 0 {
+		conf.Logging.Access.MaxBackups = 5
+	}
+
+	if len(conf.Authentication.Realm) == 0 {
+		conf.Authentication.Realm = "Spediteur"
+	}
+
+	if len(conf.Policy.Default) == 0 {
+		// Keeps the proxy usable for setups without any rules
+		conf.Policy.Default = ActionAllow
+	}
+
+	if len(conf.Upstream.Default) == 0 {
+		conf.Upstream.Default = RouteDirect
+	}
+
+	for idx := range conf.Upstream.Parents {
+		if len(conf.Upstream.Parents[idx].Type) == 0 {
+			conf.Upstream.Parents[idx].Type = ParentHTTP
+		}
+	}
+
+	if conf.Upstream.Pool.MaxIdleConns == 0 {
+		conf.Upstream.Pool.MaxIdleConns = 100
+	}
+
+	if len(conf.Upstream.Pool.IdleTimeout) == 0 {
+		conf.Upstream.Pool.IdleTimeout = "90s"
+	}
+
+	if len(conf.Headers.Via) == 0 {
+		conf.Headers.Via = HeaderAdd
+	}
+
+	if len(conf.Headers.XForwardedFor) == 0 {
+		conf.Headers.XForwardedFor = HeaderAdd
+	}
+
+	if len(conf.Headers.Forwarded) == 0 {
+		conf.Headers.Forwarded = HeaderAdd
+	}
+
+	if len(conf.Headers.Pseudonym) == 0 {
+		conf.Headers.Pseudonym = "spediteur"
+	}
 }
@@ -2,10 +2,21 @@ package config
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
@@ -28,8 +39,326 @@ func ReaderFrom(conf interface{}) io.ReadCloser {
 
 func TestNew(t *testing.T) {
 	var validConfig = &ForwardProxyConfig{
-		Proxy:      Proxy{Server: "localhost", Port: 1994, BufferSizes: BufferSizes{Read: 1024, Write: 1024}, Limits: Limits{MaxConnsPerIP: 0, MaxBodySize: 1024}, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Proxy:          Proxy{Server: "localhost", Port: 1994, SOCKS5Port: 1080, BufferSizes: BufferSizes{Read: 1024, Write: 1024}, Limits: Limits{MaxConnsPerIP: 0, MaxBodySize: 1024}, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s", Drain: "1m"}, TLS: ListenerTLS{ClientAuth: ClientAuthNone}},
+		Monitoring:     Monitoring{Port: 2000},
+		Access:         Access{Allow: []string{"example.com", "*.github.com", "/^mirror[0-9]+\\.corp$/"}, Deny: []string{"*.internal"}},
+		Destinations:   Destinations{Allow: []string{"10.0.0.1"}, Deny: []string{"10.0.0.0/8", "fd00::/8"}},
+		Clients:        Clients{Allow: []string{"192.168.10.0/24", "192.168.20.5"}},
+		Authentication: Authentication{HtpasswdFile: "/etc/spediteur/htpasswd", Realm: "Build Agents"},
+		Logging:        Logging{Level: "warn", Access: AccessLog{Enabled: true, Format: FormatCombined, Output: "/var/log/spediteur/access.log", MaxSize: 10, MaxBackups: 3}},
+		Upstream: Upstream{
+			Default: "corporate",
+			Parents: []Parent{{Name: "corporate", Type: ParentHTTP, Address: "proxy.corp:3128", Username: "spediteur", Password: "secret"}, {Name: "backup", Type: ParentSOCKS5, Address: "10.0.0.2:1080"}},
+			Rules:   []UpstreamRule{{Domains: []string{"*.corp", "/^mirror[0-9]+\\.corp$/"}, Via: RouteDirect}, {Domains: []string{"*.github.com"}, Via: "backup"}},
+			Pool:    Pool{MaxConnsPerHost: 32, MaxIdleConns: 256, IdleTimeout: "2m"},
+		},
+		Headers:      Headers{Via: HeaderSuppress, XForwardedFor: HeaderAnonymize, Forwarded: HeaderAdd, Pseudonym: "egress-1"},
+		Interception: Interception{CacheSize: 500},
+		SNI:          SNI{Mode: SNIEnforce, Ports: []uint16{443, 8443}, Allow: []string{"*.cdn.example.com"}, RequireSNI: true},
+		Cache:        Cache{MemorySize: 64 << 20, MaxEntrySize: 1 << 20},
+		Coalescing:   Coalescing{Enabled: true, MaxWait: "5s", MaxBodySize: 1 << 20},
+		RateLimits: RateLimits{
+			Clients:      RateLimit{RequestsPerSecond: 20, Burst: 40, BytesPerSecond: 10 << 20, ByteBurst: 20 << 20},
+			Destinations: RateLimit{RequestsPerSecond: 100, Burst: 100},
+		},
+		Bandwidth:   Bandwidth{Total: BandwidthLimit{Download: 100 << 20}, Tunnel: BandwidthLimit{Upload: 1 << 20, Download: 5 << 20}},
+		Concurrency: Concurrency{Tunnels: 1000, TunnelsPerClient: 50, RequestsPerHost: 20, QueueSize: 100, QueueTimeout: "5s"},
+		UpstreamTLS: UpstreamTLS{
+			TLSSettings: TLSSettings{MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			Hosts:       []TLSHost{{Domains: []string{"*.corp"}, TLSSettings: TLSSettings{MinVersion: "1.3", Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}}},
+		},
+		Policy: Policy{
+			Default: ActionDeny,
+			Groups:  map[string][]string{"ci": {"agent-1", "agent-2"}, "dev": {"alice"}},
+			Rules: []Rule{
+				{Name: "ci registries", Action: ActionAllow, Groups: []string{"ci"}, Domains: []string{"*.github.com", "registry.npmjs.org"}, Ports: []uint16{443}},
+				{Name: "dev internal", Action: ActionDeny, Groups: []string{"dev"}, Domains: []string{"*.internal"}},
+				{Name: "dev", Action: ActionAllow, Groups: []string{"dev"}, Methods: []string{"GET", "CONNECT"}},
+			},
+		},
+	}
+
+	var invalidLogLevel = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Logging:    Logging{Level: "verbose"},
+	}
+
+	var invalidAccessLogFormat = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Logging:    Logging{Access: AccessLog{Enabled: true, Format: "xml"}},
+	}
+
+	var invalidUpstreamAddress = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Parents: []Parent{{Name: "corporate", Address: "proxy.corp"}}},
+	}
+
+	var duplicateUpstreamParent = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Parents: []Parent{{Name: "corporate", Address: "proxy.corp:3128"}, {Name: "corporate", Address: "10.0.0.2:8080"}}},
+	}
+
+	var unnamedUpstreamParent = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Parents: []Parent{{Address: "proxy.corp:3128"}}},
+	}
+
+	var invalidUpstreamDefault = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Default: "corporate"},
+	}
+
+	var invalidUpstreamRule = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Rules: []UpstreamRule{{Domains: []string{"*.corp"}, Via: "corporate"}}},
+	}
+
+	var invalidUpstreamDomain = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Rules: []UpstreamRule{{Domains: []string{"/mirror[/"}, Via: RouteDirect}}},
+	}
+
+	var invalidUpstreamType = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Parents: []Parent{{Name: "corporate", Type: "socks4", Address: "proxy.corp:1080"}}},
+	}
+
+	var invalidSOCKS5Credentials = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Parents: []Parent{{Name: "gateway", Type: ParentSOCKS5, Address: "gateway.corp:1080", Username: strings.Repeat("u", 256)}}},
+	}
+
+	var untypedUpstreamParent = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "40s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Parents: []Parent{{Name: "corporate", Address: "proxy.corp:3128"}}},
+	}
+
+	var untypedUpstreamParentFilled = &ForwardProxyConfig{
+		Proxy:          Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "40s", Write: "30s", Connect: "30s", Drain: "30s"}, Limits: Limits{MaxConnsPerIP: 0, MaxBodySize: 4 * 1024 * 1024}, BufferSizes: BufferSizes{Read: 4096, Write: 4096}, TLS: ListenerTLS{ClientAuth: ClientAuthNone}},
+		Monitoring:     Monitoring{Port: 2000},
+		Authentication: Authentication{Realm: "Spediteur"},
+		Policy:         Policy{Default: ActionAllow},
+		Logging:        Logging{Access: AccessLog{Format: FormatJSON, Output: OutputStdout, MaxSize: 100, MaxBackups: 5}},
+		Upstream:       Upstream{Default: RouteDirect, Parents: []Parent{{Name: "corporate", Type: ParentHTTP, Address: "proxy.corp:3128"}}, Pool: Pool{MaxIdleConns: 100, IdleTimeout: "90s"}},
+		Headers:        Headers{Via: HeaderAdd, XForwardedFor: HeaderAdd, Forwarded: HeaderAdd, Pseudonym: "spediteur"},
+		Interception:   Interception{CacheSize: 1000},
+		SNI:            SNI{Mode: SNIOff, Ports: []uint16{443}},
+		Cache:          Cache{MaxEntrySize: 10 << 20},
+		Coalescing:     Coalescing{MaxWait: "30s", MaxBodySize: 10 << 20},
+		Concurrency:    Concurrency{QueueTimeout: "10s"},
+	}
+
+	var invalidPoolLimit = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Pool: Pool{MaxConnsPerHost: -1}},
+	}
+
+	var invalidPoolIdleTimeout = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Upstream:   Upstream{Pool: Pool{IdleTimeout: "90"}},
+	}
+
+	var clientAuthWithoutCertificate = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}, TLS: ListenerTLS{ClientAuth: ClientAuthRequire}},
+		Monitoring: Monitoring{Port: 2000},
+	}
+
+	var invalidListenerCertificate = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}, TLS: ListenerTLS{Certificates: []CertificateFiles{{CertFile: "/etc/spediteur/missing.pem", KeyFile: "/etc/spediteur/missing-key.pem"}}}},
+		Monitoring: Monitoring{Port: 2000},
+	}
+
+	var invalidSNIMode = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
 		Monitoring: Monitoring{Port: 2000},
+		SNI:        SNI{Mode: "block"},
+	}
+
+	var negativeCacheSize = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Cache:      Cache{MemorySize: -1},
+	}
+
+	var cacheDiskWithoutPath = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Cache:      Cache{MemorySize: 1 << 20, DiskSize: 1 << 30},
+	}
+
+	var cacheDiskPathIsFile = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Cache:      Cache{MemorySize: 1 << 20, DiskPath: "config.go", DiskSize: 1 << 30},
+	}
+
+	var invalidCoalescingWait = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Coalescing: Coalescing{Enabled: true, MaxWait: "soon"},
+	}
+
+	var negativeCoalescingBody = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Coalescing: Coalescing{Enabled: true, MaxBodySize: -1},
+	}
+
+	var negativeRateLimit = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		RateLimits: RateLimits{Users: RateLimit{BytesPerSecond: -1}},
+	}
+
+	var negativeBandwidth = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Bandwidth:  Bandwidth{Tunnel: BandwidthLimit{Download: -1}},
+	}
+
+	var negativeConcurrency = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		Concurrency: Concurrency{TunnelsPerClient: -1},
+	}
+
+	var invalidQueueTimeout = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		Concurrency: Concurrency{Tunnels: 10, QueueTimeout: "eventually"},
+	}
+
+	var negativeInterceptionCache = &ForwardProxyConfig{
+		Proxy:        Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:   Monitoring{Port: 2000},
+		Interception: Interception{CacheSize: -1},
+	}
+
+	var interceptionWithoutCA = &ForwardProxyConfig{
+		Proxy:        Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:   Monitoring{Port: 2000},
+		Interception: Interception{Domains: []string{"*.example.com"}, CACertFile: "/etc/spediteur/ca.pem"},
+	}
+
+	var invalidTLSVersion = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		UpstreamTLS: UpstreamTLS{TLSSettings: TLSSettings{MinVersion: "1.4"}},
+	}
+
+	var invalidTLSCipherSuite = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		UpstreamTLS: UpstreamTLS{TLSSettings: TLSSettings{CipherSuites: []string{"TLS_RSA_WITH_NULL_MD5"}}},
+	}
+
+	var invalidTLSPin = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		UpstreamTLS: UpstreamTLS{Hosts: []TLSHost{{Domains: []string{"*.corp"}, TLSSettings: TLSSettings{Pins: []string{"c2hvcnQ="}}}}},
+	}
+
+	var invalidTLSHost = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		UpstreamTLS: UpstreamTLS{Hosts: []TLSHost{{TLSSettings: TLSSettings{MinVersion: "1.3"}}}},
+	}
+
+	var missingTLSKey = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		UpstreamTLS: UpstreamTLS{TLSSettings: TLSSettings{CertFile: "/etc/spediteur/client.pem"}},
+	}
+
+	var missingTLSCAFile = &ForwardProxyConfig{
+		Proxy:       Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:  Monitoring{Port: 2000},
+		UpstreamTLS: UpstreamTLS{TLSSettings: TLSSettings{CAFile: "/etc/spediteur/missing-ca.pem"}},
+	}
+
+	var invalidViaMode = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Headers:    Headers{Via: HeaderAnonymize},
+	}
+
+	var invalidForwardedMode = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Headers:    Headers{Forwarded: "hide"},
+	}
+
+	var invalidPseudonym = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Headers:    Headers{Pseudonym: "egress proxy"},
+	}
+
+	var invalidPolicyDefault = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Policy:     Policy{Default: "maybe"},
+	}
+
+	var invalidPolicyAction = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Policy:     Policy{Rules: []Rule{{Name: "everything", Action: "permit"}}},
+	}
+
+	var invalidPolicyGroup = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Policy:     Policy{Rules: []Rule{{Name: "ci", Action: ActionAllow, Groups: []string{"ci"}}}},
+	}
+
+	var invalidPolicyDomain = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Policy:     Policy{Rules: []Rule{{Name: "mirrors", Action: ActionAllow, Domains: []string{"/mirror[/"}}}},
+	}
+
+	var invalidClientNetwork = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Clients:    Clients{Allow: []string{"build-agent-1"}},
+	}
+
+	var invalidDestinationNetwork = &ForwardProxyConfig{
+		Proxy:        Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:   Monitoring{Port: 2000},
+		Destinations: Destinations{Deny: []string{"10.0.0.0/33"}},
+	}
+
+	var invalidDestinationAddress = &ForwardProxyConfig{
+		Proxy:        Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring:   Monitoring{Port: 2000},
+		Destinations: Destinations{Allow: []string{"localhost"}},
+	}
+
+	var invalidAccessRegex = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Access:     Access{Deny: []string{"/mirror[0-9+\\.corp/"}},
+	}
+
+	var emptyAccessPattern = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		Access:     Access{Allow: []string{" "}},
 	}
 
 	var invalidProxyPort = &ForwardProxyConfig{
@@ -42,6 +371,16 @@ func TestNew(t *testing.T) {
 		Monitoring: Monitoring{Port: 1},
 	}
 
+	var invalidSOCKS5Port = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, SOCKS5Port: 1, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+	}
+
+	var conflictingSOCKS5Port = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, SOCKS5Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+	}
+
 	var invalidConnectTime = &ForwardProxyConfig{
 		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "40"}},
 		Monitoring: Monitoring{Port: 2000},
@@ -52,6 +391,11 @@ func TestNew(t *testing.T) {
 		Monitoring: Monitoring{Port: 2000},
 	}
 
+	var invalidDrainTime = &ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s", Drain: "60"}},
+		Monitoring: Monitoring{Port: 2000},
+	}
+
 	var invalidReadTime = &ForwardProxyConfig{
 		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "40", Write: "30s", Connect: "30s"}},
 		Monitoring: Monitoring{Port: 2000},
@@ -63,8 +407,18 @@ func TestNew(t *testing.T) {
 	}
 
 	var defaultsFilled = &ForwardProxyConfig{
-		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "40s", Write: "30s", Connect: "30s"}, Limits: Limits{MaxConnsPerIP: 0, MaxBodySize: 4 * 1024 * 1024}, BufferSizes: BufferSizes{Read: 4096, Write: 4096}},
-		Monitoring: Monitoring{Port: 2000},
+		Proxy:          Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "40s", Write: "30s", Connect: "30s", Drain: "30s"}, Limits: Limits{MaxConnsPerIP: 0, MaxBodySize: 4 * 1024 * 1024}, BufferSizes: BufferSizes{Read: 4096, Write: 4096}, TLS: ListenerTLS{ClientAuth: ClientAuthNone}},
+		Monitoring:     Monitoring{Port: 2000},
+		Authentication: Authentication{Realm: "Spediteur"},
+		Policy:         Policy{Default: ActionAllow},
+		Logging:        Logging{Access: AccessLog{Format: FormatJSON, Output: OutputStdout, MaxSize: 100, MaxBackups: 5}},
+		Upstream:       Upstream{Default: RouteDirect, Pool: Pool{MaxIdleConns: 100, IdleTimeout: "90s"}},
+		Headers:        Headers{Via: HeaderAdd, XForwardedFor: HeaderAdd, Forwarded: HeaderAdd, Pseudonym: "spediteur"},
+		Interception:   Interception{CacheSize: 1000},
+		SNI:            SNI{Mode: SNIOff, Ports: []uint16{443}},
+		Cache:          Cache{MaxEntrySize: 10 << 20},
+		Coalescing:     Coalescing{MaxWait: "30s", MaxBodySize: 10 << 20},
+		Concurrency:    Concurrency{QueueTimeout: "10s"},
 	}
 
 	invalidYaml := &struct {
@@ -89,9 +443,57 @@ func TestNew(t *testing.T) {
 		{name: "fill defaults config", args: args{reader: ReaderFrom(minimalConfig)}, want: defaultsFilled, expectErr: false},
 		{name: "invalid monitoring port", args: args{reader: ReaderFrom(invalidMetricPort)}, expectErr: true, wantMessage: "monitoring port is not within valid range"},
 		{name: "invalid proxy port", args: args{reader: ReaderFrom(invalidProxyPort)}, expectErr: true, wantMessage: "proxy port is not within valid range"},
+		{name: "invalid socks5 port", args: args{reader: ReaderFrom(invalidSOCKS5Port)}, expectErr: true, wantMessage: "socks5 port is not within valid range"},
+		{name: "conflicting socks5 port", args: args{reader: ReaderFrom(conflictingSOCKS5Port)}, expectErr: true, wantMessage: "socks5 port must differ from proxy port"},
 		{name: "invalid connect time", args: args{reader: ReaderFrom(invalidConnectTime)}, expectErr: true, wantMessage: "missing unit in duration"},
 		{name: "invalid write time", args: args{reader: ReaderFrom(invalidWriteTime)}, expectErr: true, wantMessage: "missing unit in duration"},
+		{name: "invalid drain time", args: args{reader: ReaderFrom(invalidDrainTime)}, expectErr: true, wantMessage: "missing unit in duration"},
 		{name: "invalid read time", args: args{reader: ReaderFrom(invalidReadTime)}, expectErr: true, wantMessage: "missing unit in duration"},
+		{name: "invalid access regex", args: args{reader: ReaderFrom(invalidAccessRegex)}, expectErr: true, wantMessage: "not a valid regular expression"},
+		{name: "empty access pattern", args: args{reader: ReaderFrom(emptyAccessPattern)}, expectErr: true, wantMessage: "domain pattern must not be empty"},
+		{name: "invalid destination network", args: args{reader: ReaderFrom(invalidDestinationNetwork)}, expectErr: true, wantMessage: "not a valid CIDR range"},
+		{name: "invalid destination address", args: args{reader: ReaderFrom(invalidDestinationAddress)}, expectErr: true, wantMessage: "neither a valid CIDR range nor an IP address"},
+		{name: "invalid client network", args: args{reader: ReaderFrom(invalidClientNetwork)}, expectErr: true, wantMessage: "network build-agent-1 is neither"},
+		{name: "invalid policy default", args: args{reader: ReaderFrom(invalidPolicyDefault)}, expectErr: true, wantMessage: "policy default maybe is neither allow nor deny"},
+		{name: "invalid policy action", args: args{reader: ReaderFrom(invalidPolicyAction)}, expectErr: true, wantMessage: "policy rule 0 (everything) has action permit"},
+		{name: "invalid policy group", args: args{reader: ReaderFrom(invalidPolicyGroup)}, expectErr: true, wantMessage: "references unknown group ci"},
+		{name: "invalid policy domain", args: args{reader: ReaderFrom(invalidPolicyDomain)}, expectErr: true, wantMessage: "not a valid regular expression"},
+		{name: "invalid log level", args: args{reader: ReaderFrom(invalidLogLevel)}, expectErr: true, wantMessage: "not a valid logrus Level"},
+		{name: "invalid access log format", args: args{reader: ReaderFrom(invalidAccessLogFormat)}, expectErr: true, wantMessage: "access log format xml is neither"},
+		{name: "fill parent type", args: args{reader: ReaderFrom(untypedUpstreamParent)}, want: untypedUpstreamParentFilled, expectErr: false},
+		{name: "invalid upstream type", args: args{reader: ReaderFrom(invalidUpstreamType)}, expectErr: true, wantMessage: "upstream parent corporate has type socks4"},
+		{name: "invalid socks5 credentials", args: args{reader: ReaderFrom(invalidSOCKS5Credentials)}, expectErr: true, wantMessage: "upstream parent gateway has credentials exceeding 255 bytes"},
+		{name: "invalid upstream address", args: args{reader: ReaderFrom(invalidUpstreamAddress)}, expectErr: true, wantMessage: "upstream parent corporate has invalid address proxy.corp"},
+		{name: "duplicate upstream parent", args: args{reader: ReaderFrom(duplicateUpstreamParent)}, expectErr: true, wantMessage: "upstream parent corporate is defined more than once"},
+		{name: "unnamed upstream parent", args: args{reader: ReaderFrom(unnamedUpstreamParent)}, expectErr: true, wantMessage: "upstream parent 0 must have a name"},
+		{name: "invalid upstream default", args: args{reader: ReaderFrom(invalidUpstreamDefault)}, expectErr: true, wantMessage: "upstream default corporate is neither direct"},
+		{name: "invalid upstream rule", args: args{reader: ReaderFrom(invalidUpstreamRule)}, expectErr: true, wantMessage: "upstream rule 0 routes via corporate"},
+		{name: "invalid upstream domain", args: args{reader: ReaderFrom(invalidUpstreamDomain)}, expectErr: true, wantMessage: "not a valid regular expression"},
+		{name: "invalid pool limit", args: args{reader: ReaderFrom(invalidPoolLimit)}, expectErr: true, wantMessage: "upstream pool limits must not be negative"},
+		{name: "invalid pool idle timeout", args: args{reader: ReaderFrom(invalidPoolIdleTimeout)}, expectErr: true, wantMessage: "missing unit in duration"},
+		{name: "client auth without certificate", args: args{reader: ReaderFrom(clientAuthWithoutCertificate)}, expectErr: true, wantMessage: "proxy tls client authentication requires at least one certificate"},
+		{name: "invalid listener certificate", args: args{reader: ReaderFrom(invalidListenerCertificate)}, expectErr: true, wantMessage: "proxy tls certificate 0 is invalid"},
+		{name: "invalid sni mode", args: args{reader: ReaderFrom(invalidSNIMode)}, expectErr: true, wantMessage: "sni mode block is neither off, log nor enforce"},
+		{name: "negative cache size", args: args{reader: ReaderFrom(negativeCacheSize)}, expectErr: true, wantMessage: "cache sizes must not be negative"},
+		{name: "cache disk without path", args: args{reader: ReaderFrom(cacheDiskWithoutPath)}, expectErr: true, wantMessage: "cache disk size requires a disk path"},
+		{name: "cache disk path is a file", args: args{reader: ReaderFrom(cacheDiskPathIsFile)}, expectErr: true, wantMessage: "cache disk path config.go is not a directory"},
+		{name: "invalid coalescing wait", args: args{reader: ReaderFrom(invalidCoalescingWait)}, expectErr: true, wantMessage: "soon"},
+		{name: "negative coalescing body size", args: args{reader: ReaderFrom(negativeCoalescingBody)}, expectErr: true, wantMessage: "coalescing max body size must not be negative"},
+		{name: "negative rate limit", args: args{reader: ReaderFrom(negativeRateLimit)}, expectErr: true, wantMessage: "rate limits must not be negative"},
+		{name: "negative bandwidth", args: args{reader: ReaderFrom(negativeBandwidth)}, expectErr: true, wantMessage: "bandwidth limits must not be negative"},
+		{name: "negative concurrency", args: args{reader: ReaderFrom(negativeConcurrency)}, expectErr: true, wantMessage: "concurrency limits must not be negative"},
+		{name: "invalid queue timeout", args: args{reader: ReaderFrom(invalidQueueTimeout)}, expectErr: true, wantMessage: "eventually"},
+		{name: "negative interception cache", args: args{reader: ReaderFrom(negativeInterceptionCache)}, expectErr: true, wantMessage: "interception cache size must not be negative"},
+		{name: "interception without ca", args: args{reader: ReaderFrom(interceptionWithoutCA)}, expectErr: true, wantMessage: "interception requires both ca cert file and ca key file"},
+		{name: "invalid tls version", args: args{reader: ReaderFrom(invalidTLSVersion)}, expectErr: true, wantMessage: "upstream tls min version 1.4 is neither"},
+		{name: "invalid tls cipher suite", args: args{reader: ReaderFrom(invalidTLSCipherSuite)}, expectErr: true, wantMessage: "upstream tls cipher suite TLS_RSA_WITH_NULL_MD5 is unknown"},
+		{name: "invalid tls pin", args: args{reader: ReaderFrom(invalidTLSPin)}, expectErr: true, wantMessage: "upstream tls host 0 pin c2hvcnQ= is not a base64 encoded SHA-256 hash"},
+		{name: "invalid tls host", args: args{reader: ReaderFrom(invalidTLSHost)}, expectErr: true, wantMessage: "upstream tls host 0 must match at least one domain"},
+		{name: "missing tls key", args: args{reader: ReaderFrom(missingTLSKey)}, expectErr: true, wantMessage: "upstream tls requires both cert file and key file"},
+		{name: "missing tls ca file", args: args{reader: ReaderFrom(missingTLSCAFile)}, expectErr: true, wantMessage: "upstream tls ca file /etc/spediteur/missing-ca.pem is invalid"},
+		{name: "invalid via mode", args: args{reader: ReaderFrom(invalidViaMode)}, expectErr: true, wantMessage: "headers via mode anonymize is neither add nor suppress"},
+		{name: "invalid forwarded mode", args: args{reader: ReaderFrom(invalidForwardedMode)}, expectErr: true, wantMessage: "headers forwarded mode hide is neither"},
+		{name: "invalid pseudonym", args: args{reader: ReaderFrom(invalidPseudonym)}, expectErr: true, wantMessage: "headers pseudonym \"egress proxy\" must not contain whitespace"},
 		{name: "invalid config", args: args{reader: ReaderFrom(invalidYaml)}, expectErr: true, wantMessage: "cannot unmarshal"},
 		{name: "faulty reader", args: args{reader: ioutil.NopCloser(faultyReader(0))}, expectErr: true, wantMessage: "test error"},
 	}
@@ -109,3 +511,170 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+// writeCertificate creates a self-signed certificate along with its key within dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "should not fail generating key")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "spediteur"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err, "should not fail creating certificate")
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err, "should not fail marshalling key")
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+	return certFile, keyFile
+}
+
+func TestNew_UpstreamTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir)
+
+	base := ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+	}
+
+	t.Run("loads ca file and client certificate", func(t *testing.T) {
+		conf := base
+		conf.UpstreamTLS = UpstreamTLS{TLSSettings: TLSSettings{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}}
+
+		_, err := New(ReaderFrom(conf))
+		assert.NoError(t, err, "should not throw error")
+	})
+
+	t.Run("rejects ca file without certificates", func(t *testing.T) {
+		conf := base
+		conf.UpstreamTLS = UpstreamTLS{TLSSettings: TLSSettings{CAFile: keyFile}}
+
+		_, err := New(ReaderFrom(conf))
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "contains no PEM encoded certificate")
+	})
+
+	t.Run("rejects mismatching key", func(t *testing.T) {
+		otherDir := filepath.Join(dir, "other")
+		_ = os.Mkdir(otherDir, 0700)
+		_, otherKey := writeCertificate(t, otherDir)
+
+		conf := base
+		conf.UpstreamTLS = UpstreamTLS{Hosts: []TLSHost{{Domains: []string{"*.corp"}, TLSSettings: TLSSettings{CertFile: certFile, KeyFile: otherKey}}}}
+
+		_, err := New(ReaderFrom(conf))
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "upstream tls host 0 client certificate is invalid")
+	})
+}
+
+func TestNew_ListenerTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir)
+	certificates := []CertificateFiles{{CertFile: certFile, KeyFile: keyFile}}
+
+	tests := []struct {
+		name string
+		tls  ListenerTLS
+
+		wantMessage string
+	}{
+		{name: "loads certificates", tls: ListenerTLS{Certificates: certificates, MinVersion: "1.3"}},
+		{name: "loads client ca file", tls: ListenerTLS{Certificates: certificates, ClientCAFile: certFile, ClientAuth: ClientAuthRequire}},
+		{name: "rejects unknown min version", tls: ListenerTLS{Certificates: certificates, MinVersion: "2.0"}, wantMessage: "proxy tls min version 2.0 is neither"},
+		{name: "rejects unknown client auth", tls: ListenerTLS{Certificates: certificates, ClientAuth: "always"}, wantMessage: "proxy tls client auth always is neither none, optional nor require"},
+		{name: "requires client ca file", tls: ListenerTLS{Certificates: certificates, ClientAuth: ClientAuthOptional}, wantMessage: "proxy tls client auth optional requires a client ca file"},
+		{name: "rejects client ca file without certificates", tls: ListenerTLS{Certificates: certificates, ClientCAFile: keyFile, ClientAuth: ClientAuthRequire}, wantMessage: "contains no PEM encoded certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := ForwardProxyConfig{
+				Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}, TLS: tt.tls},
+				Monitoring: Monitoring{Port: 2000},
+			}
+
+			_, err := New(ReaderFrom(conf))
+			if len(tt.wantMessage) == 0 {
+				assert.NoError(t, err, "should not throw error")
+				return
+			}
+			assert.Error(t, err, "should throw error")
+			assert.Contains(t, err.Error(), tt.wantMessage)
+		})
+	}
+}
+
+func TestNew_InterceptionFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir)
+
+	otherDir := filepath.Join(dir, "other")
+	_ = os.Mkdir(otherDir, 0700)
+	_, otherKey := writeCertificate(t, otherDir)
+
+	tests := []struct {
+		name         string
+		interception Interception
+
+		wantMessage string
+	}{
+		{name: "loads ca", interception: Interception{Domains: []string{"*.example.com"}, CACertFile: certFile, CAKeyFile: keyFile}},
+		{name: "rejects mismatching key", interception: Interception{Domains: []string{"*.example.com"}, CACertFile: certFile, CAKeyFile: otherKey}, wantMessage: "interception ca is invalid"},
+		{name: "rejects invalid domains", interception: Interception{Domains: []string{"/[/"}, CACertFile: certFile, CAKeyFile: keyFile}, wantMessage: "/[/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := ForwardProxyConfig{
+				Proxy:        Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+				Monitoring:   Monitoring{Port: 2000},
+				Interception: tt.interception,
+			}
+
+			_, err := New(ReaderFrom(conf))
+			if len(tt.wantMessage) == 0 {
+				assert.NoError(t, err, "should not throw error")
+				return
+			}
+			assert.Error(t, err, "should throw error")
+			assert.Contains(t, err.Error(), tt.wantMessage)
+		})
+	}
+}
+
+func TestNew_RateLimitBursts(t *testing.T) {
+	conf := ForwardProxyConfig{
+		Proxy:      Proxy{Server: "localhost", Port: 1994, Timeouts: Timeouts{Read: "30s", Write: "30s", Connect: "30s"}},
+		Monitoring: Monitoring{Port: 2000},
+		RateLimits: RateLimits{
+			Clients: RateLimit{RequestsPerSecond: 2.5, BytesPerSecond: 1 << 20},
+			Users:   RateLimit{RequestsPerSecond: 10, Burst: 50, BytesPerSecond: 1 << 20, ByteBurst: 4 << 20},
+		},
+	}
+
+	got, err := New(ReaderFrom(conf))
+	assert.NoError(t, err, "should not throw error")
+	assert.Equal(t, RateLimit{RequestsPerSecond: 2.5, Burst: 3, BytesPerSecond: 1 << 20, ByteBurst: 1 << 20}, got.RateLimits.Clients, "should default to a second worth of the rates")
+	assert.Equal(t, RateLimit{RequestsPerSecond: 10, Burst: 50, BytesPerSecond: 1 << 20, ByteBurst: 4 << 20}, got.RateLimits.Users, "should keep configured bursts")
+	assert.Equal(t, RateLimit{}, got.RateLimits.Destinations, "should stay unlimited")
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// Watch polls the file at path every interval and calls onChange whenever its modification time or size changed.
+// Polling is used instead of file system events, as those are unreliable for files that are replaced by renaming
+// (e.g. ConfigMaps mounted in Kubernetes). It returns once stop is closed.
+func Watch(path string, interval time.Duration, stop <-chan struct{}, onChange func()) {
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current, err := os.Stat(path)
+			if err != nil {
+				// The file might be replaced at the moment, hence simply try again at the next tick
+				continue
+			}
+
+			if last == nil || !current.ModTime().Equal(last.ModTime()) || current.Size() != last.Size() {
+				last = current
+				onChange()
+			}
+		}
+	}
+}
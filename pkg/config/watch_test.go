@@ -0,0 +1,51 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not throw error")
+	defer os.RemoveAll(dir)
+
+	confPath := path.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte("Proxy: {}"), 0600))
+
+	changes := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		Watch(confPath, 10*time.Millisecond, stop, func() { changes <- struct{}{} })
+		close(done)
+	}()
+
+	select {
+	case <-changes:
+		t.Fatal("should not report a change for an untouched file")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte("Proxy: {Port: 8080}"), 0600))
+
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("should report a change of the file")
+	}
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("should return once stopped")
+	}
+}
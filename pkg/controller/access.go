@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/Templum/Spediteur/pkg/config"
+)
+
+// domainList is the compiled form of a list of domain patterns. Patterns can be exact hosts,
+// wildcards covering all subdomains (*.example.com) or regular expressions enclosed in slashes.
+type domainList struct {
+	matchAll  bool
+	exact     map[string]struct{}
+	wildcards []string
+	regexes   []*regexp.Regexp
+}
+
+func newDomainList(patterns []string) *domainList {
+	list := &domainList{exact: make(map[string]struct{})}
+
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*":
+			list.matchAll = true
+		case config.IsRegexPattern(pattern):
+			// config.New already validated the expression, hence an error is impossible at this location
+			re, _ := regexp.Compile(pattern[1 : len(pattern)-1])
+			list.regexes = append(list.regexes, re)
+		case strings.HasPrefix(pattern, "*."):
+			// Keeping the dot ensures *.example.com does not match notexample.com
+			list.wildcards = append(list.wildcards, normalizeDomain(pattern[1:]))
+		default:
+			list.exact[normalizeDomain(pattern)] = struct{}{}
+		}
+	}
+
+	return list
+}
+
+// Empty reports whether the list contains no patterns at all.
+func (l *domainList) Empty() bool {
+	return !l.matchAll && len(l.exact) == 0 && len(l.wildcards) == 0 && len(l.regexes) == 0
+}
+
+// Matches reports whether the domain is covered by any of the patterns of the list.
+func (l *domainList) Matches(domain string) bool {
+	if l.matchAll {
+		return true
+	}
+
+	domain = normalizeDomain(domain)
+	if len(domain) == 0 {
+		return false
+	}
+
+	if _, found := l.exact[domain]; found {
+		return true
+	}
+
+	for _, suffix := range l.wildcards {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+
+	for _, re := range l.regexes {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessList decides whether a destination is reachable. Deny entries always win, while a non empty
+// allow list turns the proxy into an allowlist only proxy.
+type accessList struct {
+	allow *domainList
+	deny  *domainList
+}
+
+func newAccessList(conf config.Access) *accessList {
+	return &accessList{allow: newDomainList(conf.Allow), deny: newDomainList(conf.Deny)}
+}
+
+// Permits checks the requested host of a destination against the access list. The name of a reverse lookup is
+// optional and only considered for deny entries, as whoever owns an address controls its PTR record.
+func (a *accessList) Permits(host string, lookup string) bool {
+	if a.deny.Matches(host) || a.deny.Matches(lookup) {
+		return false
+	}
+
+	return a.allow.Empty() || a.allow.Matches(host)
+}
+
+// clientList decides which clients are permitted to use the proxy based on their source address.
+type clientList struct {
+	networks []*net.IPNet
+}
+
+func newClientList(conf config.Clients) *clientList {
+	return &clientList{networks: parseNetworks(conf.Allow)}
+}
+
+// Permits reports whether the client with the provided address may use the proxy.
+func (c *clientList) Permits(ip net.IP) bool {
+	if len(c.networks) == 0 {
+		return true
+	}
+
+	return containsIP(c.networks, ip)
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
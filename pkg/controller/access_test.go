@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainList_Matches(t *testing.T) {
+	list := newDomainList([]string{"example.com", "*.github.com", "/^mirror[0-9]+\\.corp\\.net$/"})
+
+	tests := []struct {
+		name   string
+		domain string
+		want   bool
+	}{
+		{name: "exact match", domain: "example.com", want: true},
+		{name: "exact match ignores case and trailing dot", domain: "Example.COM.", want: true},
+		{name: "exact does not cover subdomains", domain: "www.example.com", want: false},
+		{name: "wildcard matches subdomain", domain: "api.github.com", want: true},
+		{name: "wildcard matches nested subdomain", domain: "a.b.github.com", want: true},
+		{name: "wildcard does not match apex", domain: "github.com", want: false},
+		{name: "wildcard does not match suffix of other domain", domain: "notgithub.com", want: false},
+		{name: "regex matches", domain: "mirror12.corp.net", want: true},
+		{name: "regex does not match", domain: "mirror.corp.net", want: false},
+		{name: "empty domain", domain: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, list.Matches(tt.domain))
+		})
+	}
+
+	t.Run("match all", func(t *testing.T) {
+		assert.True(t, newDomainList([]string{"*"}).Matches("anything.org"))
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		assert.True(t, newDomainList(nil).Empty())
+		assert.False(t, newDomainList(nil).Matches("example.com"))
+	})
+}
+
+func TestAccessList_Permits(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   config.Access
+		host   string
+		lookup string
+		want   bool
+	}{
+		{name: "empty lists permit everything", conf: config.Access{}, host: "example.com", want: true},
+		{name: "deny list blocks", conf: config.Access{Deny: []string{"*.internal"}}, host: "db.internal", want: false},
+		{name: "deny list lets others pass", conf: config.Access{Deny: []string{"*.internal"}}, host: "example.com", want: true},
+		{name: "allow list permits listed", conf: config.Access{Allow: []string{"example.com"}}, host: "example.com", want: true},
+		{name: "allow list blocks unlisted", conf: config.Access{Allow: []string{"example.com"}}, host: "example.org", want: false},
+		{name: "deny wins over allow", conf: config.Access{Allow: []string{"*.example.com"}, Deny: []string{"secret.example.com"}}, host: "secret.example.com", want: false},
+		{name: "reverse lookup does not grant access", conf: config.Access{Allow: []string{"*.github.com"}}, host: "203.0.113.7", lookup: "x.github.com", want: false},
+		{name: "reverse lookup is considered for deny", conf: config.Access{Deny: []string{"localhost"}}, host: "127.0.0.1", lookup: "localhost", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newAccessList(tt.conf).Permits(tt.host, tt.lookup))
+		})
+	}
+}
+
+func TestClientList_Permits(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.Clients
+		ip   string
+		want bool
+	}{
+		{name: "empty list permits everyone", conf: config.Clients{}, ip: "192.168.1.20", want: true},
+		{name: "address within range", conf: config.Clients{Allow: []string{"10.10.0.0/16"}}, ip: "10.10.4.2", want: true},
+		{name: "address outside of range", conf: config.Clients{Allow: []string{"10.10.0.0/16"}}, ip: "10.11.4.2", want: false},
+		{name: "single address", conf: config.Clients{Allow: []string{"10.10.0.0/16", "192.168.1.20"}}, ip: "192.168.1.20", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newClientList(tt.conf).Permits(net.ParseIP(tt.ip)))
+		})
+	}
+}
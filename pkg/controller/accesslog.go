@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/valyala/fasthttp"
+)
+
+const entryKey = "spediteur.accesslog"
+
+// AccessLogger receives an entry for every finished request or tunnel.
+type AccessLogger interface {
+	Log(entry accesslog.Entry)
+}
+
+// SetAccessLogger configures where access log entries are written to, where nil disables the access log.
+// It must be called before the handler starts serving requests.
+func (h *ForwardHandler) SetAccessLogger(logger AccessLogger) {
+	h.accessLogger = logger
+}
+
+// requestLog collects the access log entry of a request while it passes through the handler.
+type requestLog struct {
+	accesslog.Entry
+	start time.Time
+
+	// streaming is set while the response body is still being transferred after the handler returned
+	streaming bool
+}
+
+func newRequestLog(ctx *fasthttp.RequestCtx, start time.Time) *requestLog {
+	rl := &requestLog{start: start, Entry: accesslog.Entry{
+		Time:      start,
+		ClientIP:  ctx.RemoteIP().String(),
+		Method:    string(ctx.Method()),
+		Protocol:  string(ctx.Request.Header.Protocol()),
+		Referer:   string(ctx.Request.Header.Referer()),
+		UserAgent: string(ctx.Request.Header.UserAgent()),
+	}}
+
+	if ctx.IsConnect() {
+		rl.Target = string(ctx.Host())
+	} else {
+		rl.Target = net.JoinHostPort(hostOf(string(ctx.Host())), strconv.Itoa(getPort(ctx)))
+		rl.URI = ctx.Request.URI().String()
+	}
+
+	ctx.SetUserValue(entryKey, rl)
+	return rl
+}
+
+// requestLogOf returns the requestLog attached to the request. Tunnel and Proxy can be called without
+// HandleFastHTTP, hence a detached requestLog is returned if none is attached.
+func requestLogOf(ctx *fasthttp.RequestCtx) *requestLog {
+	if rl, ok := ctx.UserValue(entryKey).(*requestLog); ok {
+		return rl
+	}
+	return &requestLog{start: time.Now()}
+}
+
+// reject records the reason why the request was answered by the proxy itself.
+func (rl *requestLog) reject(reason string) {
+	rl.Reason = reason
+}
+
+func (h *ForwardHandler) logAccess(rl *requestLog) {
+	if h.accessLogger == nil {
+		return
+	}
+
+	rl.Duration = time.Since(rl.start)
+	if len(rl.Reason) == 0 {
+		rl.Reason = accesslog.ReasonCompleted
+	}
+	h.accessLogger.Log(rl.Entry)
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+type recordingLogger chan accesslog.Entry
+
+func (r recordingLogger) Log(entry accesslog.Entry) {
+	r <- entry
+}
+
+func (r recordingLogger) next(t *testing.T) accesslog.Entry {
+	select {
+	case entry := <-r:
+		return entry
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an access log entry")
+		return accesslog.Entry{}
+	}
+}
+
+func TestForwardHandler_AccessLog(t *testing.T) {
+	conf := config.ForwardProxyConfig{
+		Proxy:          config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations:   loopbackAllowed,
+		Access:         config.Access{Deny: []string{"blocked.example.com"}},
+		Authentication: config.Authentication{Realm: "Spediteur"},
+	}
+
+	logger := make(recordingLogger, 10)
+	h := NewForwardHandler(&conf)
+	h.SetAuthenticator(staticAuthenticator{"ci": "secret"})
+	h.SetAccessLogger(logger)
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = io.WriteString(w, "<html><body>Hello World!</body></html>")
+	}
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(upstream))
+	defer srv.Close()
+
+	tlsSrv, certpool := startHTTPSTestEndpoint(http.HandlerFunc(upstream))
+	defer tlsSrv.Close()
+
+	clientFor := func(user *url.Userinfo) *http.Client {
+		proxyURL := &url.URL{Scheme: "http", Host: "mysuperproxy:18080", User: user}
+		return &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+			TLSClientConfig:   &tls.Config{RootCAs: certpool},
+			DisableKeepAlives: true,
+		}}
+	}
+
+	t.Run("[forwarding] logs completed request", func(t *testing.T) {
+		resp, err := clientFor(url.UserPassword("ci", "secret")).Get(srv.URL + "/index.html")
+		assert.NoError(t, err, "should not throw error")
+		resp.Body.Close()
+
+		entry := logger.next(t)
+		assert.Equal(t, "ci", entry.User)
+		assert.Equal(t, "GET", entry.Method)
+		assert.Equal(t, srv.Listener.Addr().String(), entry.Target)
+		assert.Equal(t, srv.URL+"/index.html", entry.URI)
+		assert.Equal(t, "127.0.0.1", entry.ResolvedIP)
+		assert.Equal(t, 200, entry.Status)
+		assert.EqualValues(t, len("<html><body>Hello World!</body></html>"), entry.BytesDown)
+		assert.Equal(t, accesslog.ReasonCompleted, entry.Reason)
+	})
+
+	t.Run("[forwarding] logs missing credentials", func(t *testing.T) {
+		resp, err := clientFor(nil).Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		resp.Body.Close()
+
+		entry := logger.next(t)
+		assert.Empty(t, entry.User)
+		assert.Equal(t, 407, entry.Status)
+		assert.Equal(t, accesslog.ReasonAuthentication, entry.Reason)
+	})
+
+	t.Run("[forwarding] logs access list denial", func(t *testing.T) {
+		resp, err := clientFor(url.UserPassword("ci", "secret")).Get("http://blocked.example.com/")
+		assert.NoError(t, err, "should not throw error")
+		resp.Body.Close()
+
+		entry := logger.next(t)
+		assert.Equal(t, "blocked.example.com:80", entry.Target)
+		assert.Equal(t, 403, entry.Status)
+		assert.Equal(t, accesslog.ReasonAccessDenied, entry.Reason)
+	})
+
+	t.Run("[connect request] logs tunnel once it is closed", func(t *testing.T) {
+		resp, err := clientFor(url.UserPassword("ci", "secret")).Get(tlsSrv.URL)
+		assert.NoError(t, err, "should not throw error")
+		resp.Body.Close()
+
+		entry := logger.next(t)
+		assert.Equal(t, "ci", entry.User)
+		assert.Equal(t, "CONNECT", entry.Method)
+		assert.Equal(t, tlsSrv.Listener.Addr().String(), entry.Target)
+		assert.Equal(t, "127.0.0.1", entry.ResolvedIP)
+		assert.Equal(t, 200, entry.Status)
+		assert.True(t, entry.BytesUp > 0, "should count uploaded bytes")
+		assert.True(t, entry.BytesDown > 0, "should count downloaded bytes")
+		assert.Equal(t, accesslog.ReasonCompleted, entry.Reason)
+	})
+}
+
+func TestTunnelReason(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: &timeoutError{}}
+
+	tests := []struct {
+		name   string
+		forced bool
+		errs   []error
+		want   string
+	}{
+		{name: "both directions finished", errs: []error{nil, nil}, want: accesslog.ReasonCompleted},
+		{name: "deadline exceeded", errs: []error{nil, timeout}, want: accesslog.ReasonTimeout},
+		{name: "transfer failed", errs: []error{io.ErrUnexpectedEOF, nil}, want: accesslog.ReasonError},
+		{name: "closed while draining", forced: true, errs: []error{io.ErrUnexpectedEOF, nil}, want: accesslog.ReasonShutdown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &tunnel{}
+			if tt.forced {
+				tun.closedByDrain = 1
+			}
+
+			assert.Equal(t, tt.want, tunnelReason(tun, tt.errs...))
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
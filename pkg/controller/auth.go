@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/Templum/Spediteur/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// UserKey is the key under which the authenticated user is stored as user value of the fasthttp.RequestCtx.
+const UserKey = "spediteur.user"
+
+var basicPrefix = []byte("Basic ")
+
+// Authenticator validates the credentials that clients provide through Proxy-Authorization.
+type Authenticator interface {
+	Authenticate(user string, password string) bool
+}
+
+// SetAuthenticator enables Proxy-Authorization for all requests, where the provided Authenticator
+// validates the credentials. Passing nil disables authentication again.
+func (h *ForwardHandler) SetAuthenticator(authenticator Authenticator) {
+	// The rest of the settings is kept as is, so the files of the config are not loaded again
+	s := *h.current()
+	s.authenticator = authenticator
+	h.settings.Store(&s)
+}
+
+// User returns the authenticated user of the request or an empty string if the request is anonymous.
+func User(ctx *fasthttp.RequestCtx) string {
+	user, _ := ctx.UserValue(UserKey).(string)
+	return user
+}
+
+// authenticate validates the Proxy-Authorization of the request and responds with 407 if it is missing
+// or invalid. The header is always removed, as the credentials are meant for the proxy only. Clients that presented
+// a verified certificate are identified by it instead, which is passed as identity, hence they do not need to provide
+// credentials.
+func (s *settings) authenticate(ctx *fasthttp.RequestCtx, identity string) bool {
+	if len(identity) > 0 {
+		ctx.Request.Header.Del(fasthttp.HeaderProxyAuthorization)
+		ctx.SetUserValue(UserKey, identity)
+		return true
+	}
+
+	if s.authenticator == nil {
+		return true
+	}
+
+	user, password, ok := parseBasicAuth(ctx.Request.Header.Peek(fasthttp.HeaderProxyAuthorization))
+	ctx.Request.Header.Del(fasthttp.HeaderProxyAuthorization)
+
+	if !ok || !s.authenticator.Authenticate(user, password) {
+		metrics.Errors.WithLabelValues(metrics.ErrorAuthentication).Inc()
+		if ok {
+			log.Warnf("Client %s failed to authenticate as %s", ctx.RemoteIP(), user)
+		}
+
+		ctx.Error("proxy authentication required", fasthttp.StatusProxyAuthRequired)
+		// ctx.Error resets the response, hence the challenge has to be set afterwards
+		ctx.Response.Header.Set(fasthttp.HeaderProxyAuthenticate, fmt.Sprintf("Basic realm=%q", s.conf.Authentication.Realm))
+		return false
+	}
+
+	ctx.SetUserValue(UserKey, user)
+	return true
+}
+
+func parseBasicAuth(header []byte) (string, string, bool) {
+	if len(header) <= len(basicPrefix) || !bytes.EqualFold(header[:len(basicPrefix)], basicPrefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(header[len(basicPrefix):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	sepIdx := bytes.IndexByte(decoded, ':')
+	if sepIdx < 0 {
+		return "", "", false
+	}
+
+	return string(decoded[:sepIdx]), string(decoded[sepIdx+1:]), true
+}
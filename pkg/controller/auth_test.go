@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+type staticAuthenticator map[string]string
+
+func (s staticAuthenticator) Authenticate(user string, password string) bool {
+	expected, found := s[user]
+	return found && expected == password
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		wantUser     string
+		wantPassword string
+		wantOk       bool
+	}{
+		{name: "valid credentials", header: "Basic " + base64.StdEncoding.EncodeToString([]byte("ci:secret")), wantUser: "ci", wantPassword: "secret", wantOk: true},
+		{name: "scheme is case insensitive", header: "basic " + base64.StdEncoding.EncodeToString([]byte("ci:secret")), wantUser: "ci", wantPassword: "secret", wantOk: true},
+		{name: "password containing colon", header: "Basic " + base64.StdEncoding.EncodeToString([]byte("ci:se:cret")), wantUser: "ci", wantPassword: "se:cret", wantOk: true},
+		{name: "missing header", header: "", wantOk: false},
+		{name: "other scheme", header: "Bearer abc", wantOk: false},
+		{name: "invalid base64", header: "Basic %%%", wantOk: false},
+		{name: "missing separator", header: "Basic " + base64.StdEncoding.EncodeToString([]byte("ci")), wantOk: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, password, ok := parseBasicAuth([]byte(tt.header))
+
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantUser, user)
+			assert.Equal(t, tt.wantPassword, password)
+		})
+	}
+}
+
+func TestForwardHandler_Authentication(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ForwardProxyConfig{
+		Proxy:          config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations:   loopbackAllowed,
+		Authentication: config.Authentication{Realm: "Spediteur"},
+	}
+
+	h := NewForwardHandler(&conf)
+	h.SetAuthenticator(staticAuthenticator{"ci": "secret"})
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"), "credentials should not be forwarded")
+		w.WriteHeader(200)
+		_, _ = io.WriteString(w, "<html><body>Hello World!</body></html>")
+	}
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(upstream))
+	defer srv.Close()
+
+	tlsSrv, certpool := startHTTPSTestEndpoint(http.HandlerFunc(upstream))
+	defer tlsSrv.Close()
+
+	clientFor := func(user *url.Userinfo) *http.Client {
+		proxyURL := &url.URL{Scheme: "http", Host: "mysuperproxy:18080", User: user}
+		return &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+			TLSClientConfig: &tls.Config{RootCAs: certpool},
+		}}
+	}
+
+	t.Run("[forwarding] missing credentials are challenged", func(t *testing.T) {
+		resp, err := clientFor(nil).Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 407, resp.StatusCode)
+		assert.Equal(t, `Basic realm="Spediteur"`, resp.Header.Get("Proxy-Authenticate"))
+	})
+
+	t.Run("[forwarding] invalid credentials are challenged", func(t *testing.T) {
+		resp, err := clientFor(url.UserPassword("ci", "wrong")).Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 407, resp.StatusCode)
+	})
+
+	t.Run("[forwarding] valid credentials are accepted", func(t *testing.T) {
+		resp, err := clientFor(url.UserPassword("ci", "secret")).Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 200, resp.StatusCode)
+		assert.EqualValues(t, "<html><body>Hello World!</body></html>", actualBody)
+	})
+
+	t.Run("[connect request] missing credentials are challenged", func(t *testing.T) {
+		resp, err := clientFor(nil).Get(tlsSrv.URL)
+
+		assert.Nil(t, resp, "should not return a response")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "Proxy Authentication Required")
+	})
+
+	t.Run("[connect request] valid credentials are accepted", func(t *testing.T) {
+		resp, err := clientFor(url.UserPassword("ci", "secret")).Get(tlsSrv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 200, resp.StatusCode)
+	})
+
+	t.Run("authenticated user is attached to the request", func(t *testing.T) {
+		var req fasthttp.Request
+		req.SetRequestURI("http://example.com/")
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ci:secret")))
+
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+
+		assert.True(t, h.current().authenticate(&ctx, ""))
+		assert.Equal(t, "ci", User(&ctx))
+		assert.Empty(t, ctx.Request.Header.Peek("Proxy-Authorization"))
+	})
+}
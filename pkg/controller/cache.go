@@ -0,0 +1,693 @@
+package controller
+
+import (
+	"container/list"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// heuristicStatus are the status codes whose responses may be stored without explicit freshness (RFC 9111 4.2.2),
+// apart from 206, as range requests bypass the cache.
+var heuristicStatus = map[int]struct{}{
+	fasthttp.StatusOK: {}, fasthttp.StatusNonAuthoritativeInfo: {}, fasthttp.StatusNoContent: {},
+	fasthttp.StatusMultipleChoices: {}, fasthttp.StatusMovedPermanently: {}, fasthttp.StatusPermanentRedirect: {},
+	fasthttp.StatusNotFound: {}, fasthttp.StatusMethodNotAllowed: {}, fasthttp.StatusGone: {},
+	fasthttp.StatusRequestURITooLong: {}, fasthttp.StatusNotImplemented: {},
+}
+
+// maxHeuristicLifetime caps the freshness that is derived from Last-Modified for responses without explicit one.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// diskEntrySuffix marks the files of the disk tier, which are the only ones that are removed from its directory.
+const diskEntrySuffix = ".entry"
+
+// cacheControl holds the directives of Cache-Control, where directives without argument map to an empty string.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); len(name) > 0 {
+				cc[name] = arg
+			}
+		}
+	}
+	return cc
+}
+
+// Has reports whether the directive is present.
+func (cc cacheControl) Has(name string) bool {
+	_, found := cc[name]
+	return found
+}
+
+// Seconds returns the delta-seconds argument of the directive, where false is returned if it is absent or invalid.
+func (cc cacheControl) Seconds(name string) (time.Duration, bool) {
+	arg, found := cc[name]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// headerValues returns all values of the header called name.
+func headerValues(h header, name string) []string {
+	var values []string
+	h.VisitAll(func(k, v []byte) {
+		if strings.EqualFold(string(k), name) {
+			values = append(values, string(v))
+		}
+	})
+	return values
+}
+
+// cacheableRequest reports whether responses to the request are looked up in and stored by the cache. Range requests
+// are passed on untouched, as partial responses are not stored.
+func cacheableRequest(req *fasthttp.RequestHeader) bool {
+	return req.IsGet() && len(req.Peek(fasthttp.HeaderRange)) == 0
+}
+
+// storable reports whether a shared cache may store the response to the request (RFC 9111 3 and 3.5). Responses
+// that set cookies are never stored, as they are meant for a single client.
+func storable(req *fasthttp.RequestHeader, res *fasthttp.ResponseHeader) bool {
+	if parseCacheControl(headerValues(req, fasthttp.HeaderCacheControl)).Has("no-store") {
+		return false
+	}
+
+	cc := parseCacheControl(headerValues(res, fasthttp.HeaderCacheControl))
+	if cc.Has("no-store") || cc.Has("private") || len(res.Peek(fasthttp.HeaderSetCookie)) > 0 {
+		return false
+	}
+	if len(req.Peek(fasthttp.HeaderAuthorization)) > 0 && !cc.Has("public") && !cc.Has("s-maxage") && !cc.Has("must-revalidate") {
+		return false
+	}
+	for _, name := range varyNames(headerValues(res, fasthttp.HeaderVary)) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	explicit := cc.Has("max-age") || cc.Has("s-maxage") || len(res.Peek(fasthttp.HeaderExpires)) > 0
+	if _, found := heuristicStatus[res.StatusCode()]; found {
+		return explicit || len(res.Peek(fasthttp.HeaderETag)) > 0 || len(res.Peek(fasthttp.HeaderLastModified)) > 0
+	}
+	return explicit && (res.StatusCode() == fasthttp.StatusFound || res.StatusCode() == fasthttp.StatusTemporaryRedirect)
+}
+
+// hasConditionals reports whether the client validates a response it holds on its own.
+func hasConditionals(req *fasthttp.RequestHeader) bool {
+	return len(req.Peek(fasthttp.HeaderIfNoneMatch)) > 0 || len(req.Peek(fasthttp.HeaderIfModifiedSince)) > 0
+}
+
+// varyNames returns the lower case header names listed by Vary.
+func varyNames(values []string) []string {
+	var names []string
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// variantKey extends key by the values of the request headers the response varies on (RFC 9111 4.1).
+func variantKey(key string, names []string, req *fasthttp.RequestHeader) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteString("\n" + name + ":")
+		b.WriteString(strings.Join(headerValues(req, name), ","))
+	}
+	return b.String()
+}
+
+// cacheEntry is a stored response along with the times that are needed to compute its age (RFC 9111 4.2.3). Entries
+// are never modified once they were stored, hence they can be served concurrently.
+type cacheEntry struct {
+	Key          string
+	Variant      string
+	Names        []string
+	Status       int
+	Header       [][2]string
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// newCacheEntry captures the header of the response to the request towards key, while the body is added once it
+// was received completely.
+func newCacheEntry(key string, req *fasthttp.RequestHeader, res *fasthttp.ResponseHeader, requestTime time.Time, responseTime time.Time) *cacheEntry {
+	e := &cacheEntry{Key: key, Status: res.StatusCode(), RequestTime: requestTime, ResponseTime: responseTime}
+	res.VisitAll(func(k, v []byte) {
+		switch string(k) {
+		case fasthttp.HeaderContentLength, fasthttp.HeaderConnection, fasthttp.HeaderTrailer:
+		default:
+			e.Header = append(e.Header, [2]string{string(k), string(v)})
+		}
+	})
+	e.Names = varyNames(e.values(fasthttp.HeaderVary))
+	e.Variant = variantKey(key, e.Names, req)
+	return e
+}
+
+func (e *cacheEntry) values(name string) []string {
+	var values []string
+	for _, kv := range e.Header {
+		if strings.EqualFold(kv[0], name) {
+			values = append(values, kv[1])
+		}
+	}
+	return values
+}
+
+func (e *cacheEntry) value(name string) string {
+	return strings.Join(e.values(name), ", ")
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Variant) + len(e.Body))
+	for _, kv := range e.Header {
+		size += int64(len(kv[0]) + len(kv[1]))
+	}
+	return size
+}
+
+// date returns the time the upstream generated the response, which is the time it was received without Date.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.value(fasthttp.HeaderDate)); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// lifetime returns how long the response is fresh after it was generated (RFC 9111 4.2.1 and 4.2.2).
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.values(fasthttp.HeaderCacheControl))
+	if d, found := cc.Seconds("s-maxage"); found {
+		return d
+	}
+	if d, found := cc.Seconds("max-age"); found {
+		return d
+	}
+	if expires := e.values(fasthttp.HeaderExpires); len(expires) > 0 {
+		// Invalid dates represent a time in the past
+		t, err := http.ParseTime(expires[0])
+		if err != nil || t.Before(e.date()) {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+
+	if _, found := heuristicStatus[e.Status]; found {
+		modified, err := http.ParseTime(e.value(fasthttp.HeaderLastModified))
+		if err == nil && e.date().After(modified) {
+			if d := e.date().Sub(modified) / 10; d < maxHeuristicLifetime {
+				return d
+			}
+			return maxHeuristicLifetime
+		}
+	}
+	return 0
+}
+
+// age returns the current age of the response (RFC 9111 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+
+	corrected := e.ResponseTime.Sub(e.RequestTime)
+	if age, err := strconv.ParseInt(e.value(fasthttp.HeaderAge), 10, 32); err == nil && age > 0 {
+		corrected += time.Duration(age) * time.Second
+	}
+
+	if corrected > apparent {
+		apparent = corrected
+	}
+	return apparent + now.Sub(e.ResponseTime)
+}
+
+// servable reports whether the response can be served without validating it with the upstream, considering the
+// directives of the request and the stored response (RFC 9111 4.2 and 5.2).
+func (e *cacheEntry) servable(req *fasthttp.RequestHeader, now time.Time) bool {
+	res := parseCacheControl(e.values(fasthttp.HeaderCacheControl))
+	if res.Has("no-cache") {
+		return false
+	}
+
+	cc := parseCacheControl(headerValues(req, fasthttp.HeaderCacheControl))
+	if cc.Has("no-cache") || (len(cc) == 0 && strings.Contains(strings.ToLower(string(req.Peek("Pragma"))), "no-cache")) {
+		return false
+	}
+
+	lifetime, age := e.lifetime(), e.age(now)
+	if maxAge, found := cc.Seconds("max-age"); found && age > maxAge {
+		return false
+	}
+	if minFresh, found := cc.Seconds("min-fresh"); found {
+		age += minFresh
+	}
+	if lifetime > age {
+		return true
+	}
+
+	// Stale responses are only served if the client accepts them and the upstream did not forbid it
+	if res.Has("must-revalidate") || res.Has("proxy-revalidate") || res.Has("s-maxage") || !cc.Has("max-stale") {
+		return false
+	}
+	if maxStale, found := cc.Seconds("max-stale"); found {
+		return age-lifetime <= maxStale
+	}
+	return len(cc["max-stale"]) == 0
+}
+
+// validate turns the request into a conditional one, so the upstream can confirm the stored response (RFC 9111 4.3.1).
+func (e *cacheEntry) validate(req *fasthttp.RequestHeader) {
+	if etag := e.value(fasthttp.HeaderETag); len(etag) > 0 {
+		req.Set(fasthttp.HeaderIfNoneMatch, etag)
+	}
+	if modified := e.value(fasthttp.HeaderLastModified); len(modified) > 0 {
+		req.Set(fasthttp.HeaderIfModifiedSince, modified)
+	}
+}
+
+// validatable reports whether the upstream can be asked to confirm the response.
+func (e *cacheEntry) validatable() bool {
+	return len(e.values(fasthttp.HeaderETag)) > 0 || len(e.values(fasthttp.HeaderLastModified)) > 0
+}
+
+// refresh returns a copy of the entry whose header is updated by the Not Modified response the upstream confirmed it
+// with (RFC 9111 4.3.4).
+func (e *cacheEntry) refresh(req *fasthttp.RequestHeader, res *fasthttp.ResponseHeader, requestTime time.Time, responseTime time.Time) *cacheEntry {
+	updated := newCacheEntry(e.Key, req, res, requestTime, responseTime)
+	replaced := make(map[string]struct{})
+	for _, kv := range updated.Header {
+		replaced[strings.ToLower(kv[0])] = struct{}{}
+	}
+
+	header := updated.Header
+	for _, kv := range e.Header {
+		if _, found := replaced[strings.ToLower(kv[0])]; !found {
+			header = append(header, kv)
+		}
+	}
+
+	refreshed := *e
+	refreshed.Header, refreshed.RequestTime, refreshed.ResponseTime = header, requestTime, responseTime
+	refreshed.Names = varyNames(refreshed.values(fasthttp.HeaderVary))
+	refreshed.Variant = variantKey(e.Key, refreshed.Names, req)
+	return &refreshed
+}
+
+// notModified reports whether the client already holds the response according to If-None-Match.
+func (e *cacheEntry) notModified(req *fasthttp.RequestHeader) bool {
+	etag := strings.TrimPrefix(e.value(fasthttp.HeaderETag), "W/")
+	if len(etag) == 0 || e.Status != fasthttp.StatusOK {
+		return false
+	}
+
+	for _, value := range headerValues(req, fasthttp.HeaderIfNoneMatch) {
+		for _, candidate := range strings.Split(value, ",") {
+			// Weak comparison suffices for If-None-Match (RFC 9110 13.1.2)
+			if candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/"); candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Write writes the stored response, where Age is set according to now.
+func (e *cacheEntry) Write(res *fasthttp.Response, now time.Time) {
+	res.Reset()
+	res.Header.SetNoDefaultContentType(true)
+	res.SetStatusCode(e.Status)
+	for _, kv := range e.Header {
+		res.Header.Add(kv[0], kv[1])
+	}
+	res.Header.Set(fasthttp.HeaderAge, strconv.Itoa(int(e.age(now).Seconds())))
+	res.SetBody(e.Body)
+}
+
+// entryRecorder collects the body of a streamed response until it exceeds the limit.
+type entryRecorder struct {
+	entry    *cacheEntry
+	limit    int64
+	overflow bool
+}
+
+func (r *entryRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if int64(len(r.entry.Body)+len(p)) > r.limit {
+			r.overflow, r.entry.Body = true, nil
+		} else {
+			r.entry.Body = append(r.entry.Body, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// recordingBody passes the upstream body on, while recording it.
+type recordingBody struct {
+	*upstreamBody
+	recorder *entryRecorder
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.upstreamBody.Read(p)
+	_, _ = b.recorder.Write(p[:n])
+	return n, err
+}
+
+// lru orders items by their last use and evicts the least recently used ones once their sizes exceed the limit.
+type lru struct {
+	limit int64
+	size  int64
+	items map[string]*list.Element
+	order *list.List
+}
+
+// lruItem is a stored variant, whose value is the entry itself in memory and the path of its file on disk.
+type lruItem struct {
+	key   string
+	entry *cacheEntry
+	path  string
+	size  int64
+}
+
+func newLRU(limit int64) *lru {
+	return &lru{limit: limit, items: make(map[string]*list.Element), order: list.New()}
+}
+
+// Get returns the item stored under key and marks it as recently used.
+func (l *lru) Get(key string) (*lruItem, bool) {
+	elem, found := l.items[key]
+	if !found {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruItem), true
+}
+
+// Has reports whether an item is stored under key without marking it as used.
+func (l *lru) Has(key string) bool {
+	_, found := l.items[key]
+	return found
+}
+
+// Add stores the item, replacing the one with the same key, and returns the items that were evicted to make room.
+// Items larger than the limit are evicted right away.
+func (l *lru) Add(item *lruItem) []*lruItem {
+	var evicted []*lruItem
+	l.Remove(item.key)
+
+	l.items[item.key] = l.order.PushFront(item)
+	l.size += item.size
+	for l.size > l.limit {
+		oldest, _ := l.Remove(l.order.Back().Value.(*lruItem).key)
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+// Remove deletes the item stored under key.
+func (l *lru) Remove(key string) (*lruItem, bool) {
+	elem, found := l.items[key]
+	if !found {
+		return nil, false
+	}
+	l.order.Remove(elem)
+	delete(l.items, key)
+	item := elem.Value.(*lruItem)
+	l.size -= item.size
+	return item, true
+}
+
+// responseCache stores responses in memory, from where the least recently used ones are moved to disk if a disk tier
+// is configured. A variant is either in memory or on disk, but never in both tiers at once. Files are read and
+// written without holding the lock, so lookups in memory are not held up by the disk.
+type responseCache struct {
+	maxEntrySize int64
+	dir          string
+
+	mu     sync.Mutex
+	vary   map[string]*varyIndex
+	memory *lru
+	disk   *lru
+}
+
+// varyIndex keeps track of the stored variants of a key along with the header names the latest response varies on.
+type varyIndex struct {
+	names    []string
+	variants map[string]struct{}
+}
+
+// newResponseCache returns nil if caching is disabled. The directory of the disk tier is emptied, as stored responses
+// do not survive restarts.
+func newResponseCache(conf config.Cache) *responseCache {
+	if !conf.Enabled() {
+		return nil
+	}
+
+	c := &responseCache{maxEntrySize: conf.MaxEntrySize, vary: make(map[string]*varyIndex), memory: newLRU(conf.MemorySize)}
+	if len(conf.DiskPath) > 0 && conf.DiskSize > 0 {
+		err := os.MkdirAll(conf.DiskPath, 0700)
+		if err != nil {
+			log.Warnf("Caching responses in memory only, as disk path %s is not usable due to %s", conf.DiskPath, err)
+		} else {
+			c.dir, c.disk = conf.DiskPath, newLRU(conf.DiskSize)
+			stale, _ := filepath.Glob(filepath.Join(conf.DiskPath, "*"+diskEntrySuffix))
+			for _, path := range stale {
+				_ = os.Remove(path)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.updateMetrics()
+	c.mu.Unlock()
+	return c
+}
+
+// Get returns the stored response for the request towards key or nil if there is none. Responses found on disk move
+// back into memory.
+func (c *responseCache) Get(key string, req *fasthttp.RequestHeader) *cacheEntry {
+	c.mu.Lock()
+	index, found := c.vary[key]
+	if !found {
+		c.mu.Unlock()
+		return nil
+	}
+
+	variant := variantKey(key, index.names, req)
+	if item, found := c.memory.Get(variant); found {
+		c.mu.Unlock()
+		return item.entry
+	}
+
+	var item *lruItem
+	if c.disk != nil {
+		item, found = c.disk.Remove(variant)
+		if found {
+			c.untrack(item)
+			c.updateMetrics()
+		}
+	}
+	c.mu.Unlock()
+	if item == nil {
+		return nil
+	}
+
+	entry, err := c.load(item.path)
+	_ = os.Remove(item.path)
+	if err != nil {
+		metrics.Errors.WithLabelValues(metrics.ErrorCache).Inc()
+		log.Warnf("Dropped cached response for %s due to %s", key, err)
+		return nil
+	}
+
+	c.Put(entry)
+	return entry
+}
+
+// Put stores the response, where responses larger than the maximum entry size are ignored.
+func (c *responseCache) Put(entry *cacheEntry) {
+	size := entry.size()
+	if size > c.maxEntrySize {
+		return
+	}
+
+	c.mu.Lock()
+	var removed []*lruItem
+	if c.disk != nil {
+		if old, found := c.disk.Remove(entry.Variant); found {
+			c.untrack(old)
+			removed = append(removed, old)
+		}
+	}
+
+	item := &lruItem{key: entry.Variant, entry: entry, size: size}
+	c.track(item)
+	c.vary[entry.Key].names = entry.Names
+
+	evicted := c.memory.Add(item)
+	for _, old := range evicted {
+		c.untrack(old)
+	}
+	c.updateMetrics()
+	c.mu.Unlock()
+
+	removeFiles(removed)
+	for _, old := range evicted {
+		c.demote(old)
+	}
+}
+
+// Invalidate removes all stored responses towards key (RFC 9111 4.4).
+func (c *responseCache) Invalidate(key string) {
+	c.mu.Lock()
+	var removed []*lruItem
+	if index, found := c.vary[key]; found {
+		for variant := range index.variants {
+			if item, found := c.memory.Remove(variant); found {
+				removed = append(removed, item)
+			}
+			if c.disk != nil {
+				if item, found := c.disk.Remove(variant); found {
+					removed = append(removed, item)
+				}
+			}
+		}
+		delete(c.vary, key)
+	}
+	c.updateMetrics()
+	c.mu.Unlock()
+
+	removeFiles(removed)
+}
+
+// demote moves a response that was evicted from memory to disk, unless it was stored again meanwhile.
+func (c *responseCache) demote(item *lruItem) {
+	if c.disk == nil {
+		return
+	}
+
+	path, err := c.save(item.entry)
+	if err != nil {
+		metrics.Errors.WithLabelValues(metrics.ErrorCache).Inc()
+		log.Warnf("Dropped cached response for %s as it could not be written to disk due to %s", item.entry.Key, err)
+		return
+	}
+
+	c.mu.Lock()
+	if c.memory.Has(item.key) || c.disk.Has(item.key) {
+		c.mu.Unlock()
+		_ = os.Remove(path)
+		return
+	}
+
+	stored := &lruItem{key: item.key, entry: &cacheEntry{Key: item.entry.Key, Names: item.entry.Names}, path: path, size: item.size}
+	c.track(stored)
+	evicted := c.disk.Add(stored)
+	for _, old := range evicted {
+		c.untrack(old)
+	}
+	c.updateMetrics()
+	c.mu.Unlock()
+
+	removeFiles(evicted)
+}
+
+// track registers the variant of the item unless it is already stored. Callers have to hold the lock.
+func (c *responseCache) track(item *lruItem) {
+	index, found := c.vary[item.entry.Key]
+	if !found {
+		index = &varyIndex{names: item.entry.Names, variants: make(map[string]struct{})}
+		c.vary[item.entry.Key] = index
+	}
+	index.variants[item.key] = struct{}{}
+}
+
+// untrack forgets the variant of an item that left the cache. Callers have to hold the lock.
+func (c *responseCache) untrack(item *lruItem) {
+	index, found := c.vary[item.entry.Key]
+	if !found {
+		return
+	}
+	delete(index.variants, item.key)
+	if len(index.variants) == 0 {
+		delete(c.vary, item.entry.Key)
+	}
+}
+
+// updateMetrics publishes the occupancy of both tiers. Callers have to hold the lock.
+func (c *responseCache) updateMetrics() {
+	metrics.CacheSize.WithLabelValues(metrics.TierMemory).Set(float64(c.memory.size))
+	metrics.CacheEntries.WithLabelValues(metrics.TierMemory).Set(float64(c.memory.order.Len()))
+	if c.disk != nil {
+		metrics.CacheSize.WithLabelValues(metrics.TierDisk).Set(float64(c.disk.size))
+		metrics.CacheEntries.WithLabelValues(metrics.TierDisk).Set(float64(c.disk.order.Len()))
+	}
+}
+
+// save writes the entry into a file of its own, so concurrent writes of the same variant never interfere.
+func (c *responseCache) save(entry *cacheEntry) (string, error) {
+	f, err := ioutil.TempFile(c.dir, "*"+diskEntrySuffix)
+	if err != nil {
+		return "", err
+	}
+
+	err = gob.NewEncoder(f).Encode(entry)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (c *responseCache) load(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entry cacheEntry
+	err = gob.NewDecoder(f).Decode(&entry)
+	return &entry, err
+}
+
+func removeFiles(items []*lruItem) {
+	for _, item := range items {
+		if len(item.path) > 0 {
+			_ = os.Remove(item.path)
+		}
+	}
+}
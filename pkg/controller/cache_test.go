@@ -0,0 +1,334 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// testEntry builds a stored response towards key that was received at responseTime with the given header.
+func testEntry(key string, status int, responseTime time.Time, header ...string) *cacheEntry {
+	res := &fasthttp.ResponseHeader{}
+	res.SetStatusCode(status)
+	res.SetNoDefaultContentType(true)
+	for i := 0; i+1 < len(header); i += 2 {
+		res.Add(header[i], header[i+1])
+	}
+	return newCacheEntry(key, &fasthttp.RequestHeader{}, res, responseTime, responseTime)
+}
+
+// storedEntries returns the number of responses stored in both tiers.
+func storedEntries(c *responseCache) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.memory.order.Len()
+	if c.disk != nil {
+		n += c.disk.order.Len()
+	}
+	return n
+}
+
+func TestCacheEntry_Servable(t *testing.T) {
+	now := time.Now()
+	received := now.Add(-time.Minute)
+	date := received.UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		entry   *cacheEntry
+		request []string
+
+		wantedServable bool
+	}{
+		{name: "fresh by max-age", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120"), wantedServable: true},
+		{name: "stale by max-age", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=30")},
+		{name: "s-maxage takes precedence", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120, s-maxage=30")},
+		{name: "fresh by expires", entry: testEntry("k", 200, received, "Date", date, "Expires", received.Add(time.Hour).UTC().Format(http.TimeFormat)), wantedServable: true},
+		{name: "invalid expires is stale", entry: testEntry("k", 200, received, "Date", date, "Expires", "0")},
+		{name: "age of upstream counts", entry: testEntry("k", 200, received, "Date", date, "Age", "100", "Cache-Control", "max-age=120")},
+		{name: "heuristic freshness", entry: testEntry("k", 200, received, "Date", date, "Last-Modified", received.Add(-100*time.Hour).UTC().Format(http.TimeFormat)), wantedServable: true},
+		{name: "no heuristic freshness for other status", entry: testEntry("k", 302, received, "Date", date, "Last-Modified", received.Add(-100*time.Hour).UTC().Format(http.TimeFormat))},
+		{name: "no-cache requires validation", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120, no-cache")},
+		{name: "request no-cache", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120"), request: []string{"Cache-Control", "no-cache"}},
+		{name: "request pragma no-cache", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120"), request: []string{"Pragma", "no-cache"}},
+		{name: "request max-age", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120"), request: []string{"Cache-Control", "max-age=30"}},
+		{name: "request min-fresh", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=120"), request: []string{"Cache-Control", "min-fresh=90"}},
+		{name: "request max-stale", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=30"), request: []string{"Cache-Control", "max-stale=60"}, wantedServable: true},
+		{name: "request max-stale exceeded", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=30"), request: []string{"Cache-Control", "max-stale=10"}},
+		{name: "must-revalidate ignores max-stale", entry: testEntry("k", 200, received, "Date", date, "Cache-Control", "max-age=30, must-revalidate"), request: []string{"Cache-Control", "max-stale"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &fasthttp.RequestHeader{}
+			for i := 0; i+1 < len(tt.request); i += 2 {
+				req.Add(tt.request[i], tt.request[i+1])
+			}
+			assert.Equal(t, tt.wantedServable, tt.entry.servable(req, now))
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		request  []string
+		response []string
+
+		wantedStorable bool
+	}{
+		{name: "explicit freshness", status: 200, response: []string{"Cache-Control", "max-age=60"}, wantedStorable: true},
+		{name: "validator only", status: 200, response: []string{"ETag", `"v1"`}, wantedStorable: true},
+		{name: "neither freshness nor validator", status: 200},
+		{name: "no-store response", status: 200, response: []string{"Cache-Control", "max-age=60, no-store"}},
+		{name: "no-store request", status: 200, request: []string{"Cache-Control", "no-store"}, response: []string{"Cache-Control", "max-age=60"}},
+		{name: "private response", status: 200, response: []string{"Cache-Control", "private, max-age=60"}},
+		{name: "cookies", status: 200, response: []string{"Cache-Control", "max-age=60", "Set-Cookie", "session=1"}},
+		{name: "authorized request", status: 200, request: []string{"Authorization", "Basic Zm9vOmJhcg=="}, response: []string{"Cache-Control", "max-age=60"}},
+		{name: "public authorized request", status: 200, request: []string{"Authorization", "Basic Zm9vOmJhcg=="}, response: []string{"Cache-Control", "public, max-age=60"}, wantedStorable: true},
+		{name: "vary on everything", status: 200, response: []string{"Cache-Control", "max-age=60", "Vary", "*"}},
+		{name: "redirect with explicit freshness", status: 307, response: []string{"Cache-Control", "max-age=60"}, wantedStorable: true},
+		{name: "server error", status: 500, response: []string{"Cache-Control", "max-age=60"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &fasthttp.RequestHeader{}
+			for i := 0; i+1 < len(tt.request); i += 2 {
+				req.Add(tt.request[i], tt.request[i+1])
+			}
+			res := &fasthttp.ResponseHeader{}
+			res.SetStatusCode(tt.status)
+			for i := 0; i+1 < len(tt.response); i += 2 {
+				res.Add(tt.response[i], tt.response[i+1])
+			}
+
+			assert.Equal(t, tt.wantedStorable, storable(req, res))
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	entryOf := func(key string, body string) *cacheEntry {
+		e := testEntry(key, 200, time.Now(), "Cache-Control", "max-age=60")
+		e.Body = []byte(body)
+		return e
+	}
+	size := entryOf("http://example.com/a", strings.Repeat("a", 100)).size()
+
+	t.Run("moves least recently used responses to disk", func(t *testing.T) {
+		c := newResponseCache(config.Cache{MemorySize: 2 * size, MaxEntrySize: size, DiskPath: dir, DiskSize: 10 * size})
+		for _, key := range []string{"http://example.com/a", "http://example.com/b", "http://example.com/c"} {
+			c.Put(entryOf(key, strings.Repeat("a", 100)))
+		}
+
+		assert.Equal(t, 2, c.memory.order.Len())
+		assert.Equal(t, 1, c.disk.order.Len(), "should demote the oldest response")
+
+		entry := c.Get("http://example.com/a", &fasthttp.RequestHeader{})
+		if assert.NotNil(t, entry, "should find responses on disk") {
+			assert.Equal(t, strings.Repeat("a", 100), string(entry.Body))
+		}
+		assert.Equal(t, 3, storedEntries(c))
+		assert.True(t, c.memory.Has(entry.Variant), "should promote responses found on disk")
+	})
+
+	t.Run("drops responses without disk tier", func(t *testing.T) {
+		c := newResponseCache(config.Cache{MemorySize: 2 * size, MaxEntrySize: size})
+		for _, key := range []string{"http://example.com/a", "http://example.com/b", "http://example.com/c"} {
+			c.Put(entryOf(key, strings.Repeat("a", 100)))
+		}
+
+		assert.Nil(t, c.Get("http://example.com/a", &fasthttp.RequestHeader{}))
+		assert.Equal(t, 2, storedEntries(c))
+		assert.Len(t, c.vary, 2, "should forget evicted keys")
+	})
+
+	t.Run("ignores large responses", func(t *testing.T) {
+		c := newResponseCache(config.Cache{MemorySize: 10 * size, MaxEntrySize: size})
+		c.Put(entryOf("http://example.com/a", strings.Repeat("a", 200)))
+
+		assert.Equal(t, 0, storedEntries(c))
+	})
+
+	t.Run("separates variants", func(t *testing.T) {
+		c := newResponseCache(config.Cache{MemorySize: 10 * size, MaxEntrySize: size})
+		english, german := &fasthttp.RequestHeader{}, &fasthttp.RequestHeader{}
+		english.Set("Accept-Language", "en")
+		german.Set("Accept-Language", "de")
+
+		res := &fasthttp.ResponseHeader{}
+		res.Set("Cache-Control", "max-age=60")
+		res.Set("Vary", "Accept-Language")
+		c.Put(newCacheEntry("http://example.com/a", english, res, time.Now(), time.Now()))
+
+		assert.NotNil(t, c.Get("http://example.com/a", english))
+		assert.Nil(t, c.Get("http://example.com/a", german))
+
+		c.Put(newCacheEntry("http://example.com/a", german, res, time.Now(), time.Now()))
+		assert.NotNil(t, c.Get("http://example.com/a", german))
+
+		c.Invalidate("http://example.com/a")
+		assert.Nil(t, c.Get("http://example.com/a", english), "should invalidate all variants")
+		assert.Equal(t, 0, storedEntries(c))
+	})
+}
+
+func TestForwardHandler_Cache(t *testing.T) {
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	fetches := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetched[path]
+	}
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/immutable":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("ETag", `W/"i1"`)
+		case "/validated":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+		}
+		_, _ = w.Write([]byte("<html><body>Hello " + r.URL.Path + "!</body></html>"))
+	}))
+	defer srv.Close()
+
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations: loopbackAllowed,
+		Headers:      config.Headers{Via: config.HeaderAdd, Pseudonym: "spediteur"},
+		Cache:        config.Cache{MemorySize: 1 << 20, MaxEntrySize: 1 << 10},
+	}
+
+	h := NewForwardHandler(&conf)
+	logger := make(recordingLogger, 10)
+	h.SetAccessLogger(logger)
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+	}()
+
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}}
+
+	fetch := func(t *testing.T, method string, path string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err, "should not throw error")
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		logger.next(t)
+		return resp, string(body)
+	}
+
+	stored := func(n int) func() bool {
+		return func() bool {
+			return storedEntries(h.cache) == n
+		}
+	}
+
+	t.Run("serves fresh responses from the cache", func(t *testing.T) {
+		hits := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheHit))
+
+		_, _ = fetch(t, http.MethodGet, "/immutable")
+		assert.Eventually(t, stored(1), time.Second, 10*time.Millisecond, "should store the response")
+
+		resp, body := fetch(t, http.MethodGet, "/immutable")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "<html><body>Hello /immutable!</body></html>", body)
+		assert.Equal(t, "1.1 spediteur", resp.Header.Get("Via"))
+		assert.NotEmpty(t, resp.Header.Get("Age"))
+		assert.Equal(t, 1, fetches("/immutable"), "should not ask the upstream again")
+		assert.Equal(t, hits+1, testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheHit)))
+	})
+
+	t.Run("answers conditional requests of clients", func(t *testing.T) {
+		resp, body := fetch(t, http.MethodGet, "/immutable", "If-None-Match", `"i1"`)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		assert.Empty(t, body)
+		assert.Equal(t, 1, fetches("/immutable"), "should not ask the upstream again")
+	})
+
+	t.Run("revalidates responses with the upstream", func(t *testing.T) {
+		revalidated := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheRevalidated))
+
+		_, _ = fetch(t, http.MethodGet, "/validated")
+		assert.Eventually(t, stored(2), time.Second, 10*time.Millisecond, "should store the response")
+
+		resp, body := fetch(t, http.MethodGet, "/validated")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "<html><body>Hello /validated!</body></html>", body, "should serve the confirmed response")
+		assert.Equal(t, 2, fetches("/validated"))
+		assert.Equal(t, revalidated+1, testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheRevalidated)))
+
+		resp, _ = fetch(t, http.MethodGet, "/validated", "If-None-Match", `"v1"`)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, "should pass the answer of the upstream on")
+	})
+
+	t.Run("does not store private responses", func(t *testing.T) {
+		misses := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheMiss))
+
+		_, _ = fetch(t, http.MethodGet, "/private")
+		_, _ = fetch(t, http.MethodGet, "/private")
+		assert.Equal(t, 2, fetches("/private"))
+		assert.Equal(t, misses+2, testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheMiss)))
+	})
+
+	t.Run("invalidates responses after unsafe requests", func(t *testing.T) {
+		_, _ = fetch(t, http.MethodPost, "/immutable")
+		assert.Equal(t, 1, storedEntries(h.cache))
+
+		_, _ = fetch(t, http.MethodGet, "/immutable")
+		assert.Equal(t, 3, fetches("/immutable"), "should fetch the response again")
+	})
+
+	t.Run("answers only-if-cached without upstream", func(t *testing.T) {
+		resp, _ := fetch(t, http.MethodGet, "/uncached", "Cache-Control", "only-if-cached")
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assert.Equal(t, 0, fetches("/uncached"))
+	})
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// coalescedHeaders are the request headers that responses commonly vary on, hence requests are only identical if
+// they agree on them.
+var coalescedHeaders = []string{
+	fasthttp.HeaderAccept,
+	fasthttp.HeaderAcceptEncoding,
+	fasthttp.HeaderAcceptLanguage,
+	fasthttp.HeaderAuthorization,
+	fasthttp.HeaderCookie,
+}
+
+// coalescer lets identical requests wait for the response to the one that is already forwarded.
+type coalescer struct {
+	maxWait     time.Duration
+	maxBodySize int64
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a forwarded request that identical requests wait for. Its entry is nil if the response is not shared.
+type flight struct {
+	key   string
+	done  chan struct{}
+	once  sync.Once
+	entry *cacheEntry
+}
+
+// newCoalescer returns nil if coalescing is disabled.
+func newCoalescer(conf config.Coalescing) *coalescer {
+	if !conf.Enabled {
+		return nil
+	}
+
+	// time.ParseDuration is already called during validation, hence an error is impossible at this location
+	maxWait, _ := time.ParseDuration(conf.MaxWait)
+	return &coalescer{maxWait: maxWait, maxBodySize: conf.MaxBodySize, flights: make(map[string]*flight)}
+}
+
+// coalescingKey identifies requests towards key that may share a response.
+func coalescingKey(key string, req *fasthttp.RequestHeader) string {
+	return variantKey(key, coalescedHeaders, req)
+}
+
+// Join returns the flight of an identical request that is underway along with false. Otherwise a new flight is
+// started, which the caller leads and has to land.
+func (c *coalescer) Join(key string) (*flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, found := c.flights[key]; found {
+		return f, false
+	}
+
+	f := &flight{key: key, done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// Land shares the response with the waiters of the flight, where nil lets them forward their requests on their own.
+// Responses whose body exceeds the limit are not shared. Only the first call takes effect.
+func (c *coalescer) Land(f *flight, entry *cacheEntry) {
+	f.once.Do(func() {
+		c.mu.Lock()
+		if c.flights[f.key] == f {
+			delete(c.flights, f.key)
+		}
+		c.mu.Unlock()
+
+		if entry != nil && int64(len(entry.Body)) > c.maxBodySize {
+			entry = nil
+		}
+		f.entry = entry
+		close(f.done)
+	})
+}
+
+// Wait blocks until the flight landed, but at most for the maximum wait or until the deadline. It returns the shared
+// response or nil if the request has to be forwarded on its own.
+func (c *coalescer) Wait(f *flight, req *fasthttp.RequestHeader, deadline time.Time) *cacheEntry {
+	timeout := c.maxWait
+	if remaining := time.Until(deadline); remaining < timeout {
+		timeout = remaining
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+	case <-timer.C:
+		metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedTimeout).Inc()
+		return nil
+	}
+
+	// The response may vary on headers that the requests do not agree on
+	if f.entry == nil || f.entry.Variant != variantKey(f.entry.Key, f.entry.Names, req) {
+		metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedUnshared).Inc()
+		return nil
+	}
+
+	metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedShared).Inc()
+	return f.entry
+}
+
+// recordLimit returns the size up to which response bodies are recorded to be stored or shared.
+func (h *ForwardHandler) recordLimit() int64 {
+	var limit int64
+	if h.cache != nil {
+		limit = h.cache.maxEntrySize
+	}
+	if h.coalescer != nil && h.coalescer.maxBodySize > limit {
+		limit = h.coalescer.maxBodySize
+	}
+	return limit
+}
@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer(config.Coalescing{Enabled: true, MaxWait: "1s", MaxBodySize: 100})
+	entry := testEntry("http://example.com/a", 200, time.Now(), "Cache-Control", "max-age=60")
+	entry.Body = []byte("<html><body>Hello World!</body></html>")
+
+	t.Run("shares the response of the leader", func(t *testing.T) {
+		lead, leader := c.Join("a")
+		assert.True(t, leader, "should lead the first request")
+
+		f, leader := c.Join("a")
+		assert.False(t, leader, "should let identical requests wait")
+		assert.Same(t, lead, f)
+
+		c.Land(lead, entry)
+		assert.Same(t, entry, c.Wait(f, &fasthttp.RequestHeader{}, time.Now().Add(time.Second)))
+
+		_, leader = c.Join("a")
+		assert.True(t, leader, "should start a new flight once landed")
+	})
+
+	t.Run("releases waiters without response", func(t *testing.T) {
+		lead, _ := c.Join("b")
+		f, _ := c.Join("b")
+		c.Land(lead, nil)
+		c.Land(lead, entry)
+
+		assert.Nil(t, c.Wait(f, &fasthttp.RequestHeader{}, time.Now().Add(time.Second)), "should only respect the first landing")
+	})
+
+	t.Run("does not share large responses", func(t *testing.T) {
+		large := testEntry("http://example.com/a", 200, time.Now(), "Cache-Control", "max-age=60")
+		large.Body = []byte(strings.Repeat("a", 101))
+
+		lead, _ := c.Join("c")
+		f, _ := c.Join("c")
+		c.Land(lead, large)
+
+		assert.Nil(t, c.Wait(f, &fasthttp.RequestHeader{}, time.Now().Add(time.Second)))
+	})
+
+	t.Run("does not share other variants", func(t *testing.T) {
+		english, german := &fasthttp.RequestHeader{}, &fasthttp.RequestHeader{}
+		english.Set("X-Locale", "en")
+		german.Set("X-Locale", "de")
+
+		res := &fasthttp.ResponseHeader{}
+		res.Set("Cache-Control", "max-age=60")
+		res.Set("Vary", "X-Locale")
+
+		lead, _ := c.Join("d")
+		f, _ := c.Join("d")
+		c.Land(lead, newCacheEntry("http://example.com/a", english, res, time.Now(), time.Now()))
+
+		assert.NotNil(t, c.Wait(f, english, time.Now().Add(time.Second)))
+		assert.Nil(t, c.Wait(f, german, time.Now().Add(time.Second)))
+	})
+
+	t.Run("gives up waiting", func(t *testing.T) {
+		timeouts := testutil.ToFloat64(metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedTimeout))
+
+		_, _ = c.Join("e")
+		f, _ := c.Join("e")
+
+		assert.Nil(t, c.Wait(f, &fasthttp.RequestHeader{}, time.Now().Add(20*time.Millisecond)), "should respect the deadline")
+		assert.Equal(t, timeouts+1, testutil.ToFloat64(metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedTimeout)))
+	})
+}
+
+func TestForwardHandler_Coalescing(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		_, _ = w.Write([]byte("<html><body>Hello " + r.URL.Path + "!</body></html>"))
+	}))
+	defer srv.Close()
+
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations: loopbackAllowed,
+		Coalescing:   config.Coalescing{Enabled: true, MaxWait: "5s", MaxBodySize: 1 << 10},
+	}
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+	}()
+
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}}
+
+	// fetchConcurrently sends identical requests at once and releases the upstream once all of them arrived at the proxy
+	fetchConcurrently := func(t *testing.T, path string, n int) []string {
+		bodies := make([]string, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := client.Get(srv.URL + path)
+				if assert.NoError(t, err, "should not throw error") {
+					body, _ := ioutil.ReadAll(resp.Body)
+					_ = resp.Body.Close()
+					bodies[i] = string(body)
+				}
+			}(i)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		release <- struct{}{}
+		wg.Wait()
+		return bodies
+	}
+
+	t.Run("shares the response among identical requests", func(t *testing.T) {
+		shared := testutil.ToFloat64(metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedShared))
+		atomic.StoreInt32(&fetches, 0)
+
+		bodies := fetchConcurrently(t, "/artifact.tar.gz", 5)
+		for _, body := range bodies {
+			assert.Equal(t, "<html><body>Hello /artifact.tar.gz!</body></html>", body)
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "should ask the upstream once")
+		assert.Equal(t, shared+4, testutil.ToFloat64(metrics.CoalescedRequests.WithLabelValues(metrics.CoalescedShared)))
+	})
+
+	t.Run("lets waiters forward unshareable responses on their own", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+
+		done := make(chan []string)
+		go func() {
+			done <- fetchConcurrently(t, "/private", 3)
+		}()
+
+		// Once the leader was answered, both waiters ask the upstream on their own
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&fetches) == 3 }, time.Second, 5*time.Millisecond)
+		release <- struct{}{}
+		release <- struct{}{}
+
+		for _, body := range <-done {
+			assert.Equal(t, "<html><body>Hello /private!</body></html>", body)
+		}
+		assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+	})
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	errQueueFull    = errors.New("all slots are in use and the wait queue is full")
+	errQueueTimeout = errors.New("no slot became available in time")
+)
+
+// slotLimiter bounds how many slots of each key are held at once, where a limit of 0 is unlimited. Beyond the limit
+// callers wait in order of arrival, but at most queueSize of them across all keys.
+type slotLimiter struct {
+	name      string
+	limit     int
+	queueSize int
+
+	mu     sync.Mutex
+	keys   map[string]*slotQueue
+	queued int
+}
+
+// slotQueue holds the slots of a single key, where the slot of the next release is handed to the first waiter.
+type slotQueue struct {
+	held    int
+	waiters []chan struct{}
+}
+
+func newSlotLimiter(name string, limit int, queueSize int) *slotLimiter {
+	return &slotLimiter{name: name, limit: limit, queueSize: queueSize, keys: make(map[string]*slotQueue)}
+}
+
+// Acquire takes a slot of key. If all of them are held, it waits until deadline for one to be released, unless
+// the queue is already full.
+func (l *slotLimiter) Acquire(key string, deadline time.Time) error {
+	l.mu.Lock()
+	q, found := l.keys[key]
+	if !found {
+		q = &slotQueue{}
+		l.keys[key] = q
+	}
+
+	if l.limit <= 0 || q.held < l.limit {
+		q.held++
+		metrics.ConcurrencyInUse.WithLabelValues(l.name).Inc()
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queued >= l.queueSize {
+		l.mu.Unlock()
+		return fmt.Errorf("%w for %s", errQueueFull, l.name)
+	}
+
+	ready := make(chan struct{})
+	q.waiters = append(q.waiters, ready)
+	l.queued++
+	metrics.ConcurrencyQueued.WithLabelValues(l.name).Inc()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot may have been handed over while the timer fired
+	select {
+	case <-ready:
+		return nil
+	default:
+	}
+
+	for i, w := range q.waiters {
+		if w == ready {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	l.queued--
+	metrics.ConcurrencyQueued.WithLabelValues(l.name).Dec()
+	return fmt.Errorf("%w for %s", errQueueTimeout, l.name)
+}
+
+// Release frees a slot of key, which is handed over to the first waiter if there is any.
+func (l *slotLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q := l.keys[key]
+	if len(q.waiters) > 0 {
+		close(q.waiters[0])
+		q.waiters = q.waiters[1:]
+		l.queued--
+		metrics.ConcurrencyQueued.WithLabelValues(l.name).Dec()
+		return
+	}
+
+	q.held--
+	metrics.ConcurrencyInUse.WithLabelValues(l.name).Dec()
+	if q.held == 0 {
+		delete(l.keys, key)
+	}
+}
+
+// concurrencyLimits bounds the tunnels that are open in total and per client as well as the requests that are
+// forwarded to each destination host at once.
+type concurrencyLimits struct {
+	tunnels       *slotLimiter
+	clientTunnels *slotLimiter
+	hostRequests  *slotLimiter
+	queueTimeout  time.Duration
+}
+
+func newConcurrencyLimits(conf config.Concurrency) *concurrencyLimits {
+	// time.ParseDuration is already called during validation, hence an error is impossible at this location
+	queueTimeout, _ := time.ParseDuration(conf.QueueTimeout)
+
+	return &concurrencyLimits{
+		tunnels:       newSlotLimiter(metrics.LimitTunnels, conf.Tunnels, conf.QueueSize),
+		clientTunnels: newSlotLimiter(metrics.LimitClientTunnels, conf.TunnelsPerClient, conf.QueueSize),
+		hostRequests:  newSlotLimiter(metrics.LimitHostRequests, conf.RequestsPerHost, conf.QueueSize),
+		queueTimeout:  queueTimeout,
+	}
+}
+
+// until returns when waiting for a slot is given up, which is after the queue timeout but no later than deadline.
+func (c *concurrencyLimits) until(deadline time.Time) time.Time {
+	if until := time.Now().Add(c.queueTimeout); until.Before(deadline) {
+		return until
+	}
+	return deadline
+}
+
+// AcquireTunnel takes a slot of the client along with one of all tunnels. The returned function frees both of them
+// once the tunnel terminated and may be called more than once.
+func (c *concurrencyLimits) AcquireTunnel(client string, deadline time.Time) (func(), error) {
+	until := c.until(deadline)
+	if err := c.clientTunnels.Acquire(client, until); err != nil {
+		return nil, err
+	}
+	if err := c.tunnels.Acquire("", until); err != nil {
+		c.clientTunnels.Release(client)
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.tunnels.Release("")
+			c.clientTunnels.Release(client)
+		})
+	}, nil
+}
+
+// AcquireRequest takes a slot of the destination host. The returned function frees it once the response was
+// transferred and may be called more than once.
+func (c *concurrencyLimits) AcquireRequest(host string, deadline time.Time) (func(), error) {
+	if err := c.hostRequests.Acquire(host, c.until(deadline)); err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.hostRequests.Release(host)
+		})
+	}, nil
+}
+
+// overloaded responds with 503 as the request did not obtain a slot.
+func (h *ForwardHandler) overloaded(ctx *fasthttp.RequestCtx, rl *requestLog, err error) {
+	metrics.Errors.WithLabelValues(metrics.ErrorOverloaded).Inc()
+	log.Warnf("Rejected %s request of %s towards %s as %s", ctx.Method(), ctx.RemoteIP(), ctx.Host(), err)
+	rl.reject(accesslog.ReasonOverloaded)
+	ctx.Error("proxy is overloaded", fasthttp.StatusServiceUnavailable)
+}
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestSlotLimiter(t *testing.T) {
+	l := newSlotLimiter("test", 1, 1)
+	held := testutil.ToFloat64(metrics.ConcurrencyInUse.WithLabelValues("test"))
+	inUse := func() float64 { return testutil.ToFloat64(metrics.ConcurrencyInUse.WithLabelValues("test")) - held }
+	queued := func() float64 { return testutil.ToFloat64(metrics.ConcurrencyQueued.WithLabelValues("test")) }
+
+	assert.NoError(t, l.Acquire("a", time.Now().Add(time.Second)))
+	assert.NoError(t, l.Acquire("b", time.Now().Add(time.Second)), "should track keys on their own")
+	assert.Equal(t, float64(2), inUse())
+
+	t.Run("hands released slots to waiters", func(t *testing.T) {
+		acquired := make(chan error)
+		go func() {
+			acquired <- l.Acquire("a", time.Now().Add(time.Second))
+		}()
+		assert.Eventually(t, func() bool { return queued() == 1 }, time.Second, 5*time.Millisecond)
+
+		assert.True(t, errors.Is(l.Acquire("a", time.Now().Add(time.Second)), errQueueFull), "should reject once the queue is full")
+
+		l.Release("a")
+		assert.NoError(t, <-acquired)
+		assert.Equal(t, float64(0), queued())
+		assert.Equal(t, float64(2), inUse(), "should keep the slot held")
+	})
+
+	t.Run("gives up waiting", func(t *testing.T) {
+		assert.True(t, errors.Is(l.Acquire("b", time.Now().Add(20*time.Millisecond)), errQueueTimeout))
+		assert.Equal(t, float64(0), queued())
+	})
+
+	l.Release("a")
+	l.Release("b")
+	assert.Equal(t, float64(0), inUse())
+	assert.Empty(t, l.keys, "should forget keys without slots")
+
+	t.Run("does not limit without limit", func(t *testing.T) {
+		unlimited := newSlotLimiter("test", 0, 0)
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, unlimited.Acquire("a", time.Now()))
+		}
+		for i := 0; i < 10; i++ {
+			unlimited.Release("a")
+		}
+		assert.Equal(t, float64(0), inUse())
+	})
+}
+
+func TestForwardHandler_Concurrency(t *testing.T) {
+	release := make(chan struct{})
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		_, _ = w.Write([]byte("<html><body>Hello World!</body></html>"))
+	}))
+	defer srv.Close()
+
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	// serve starts a handler with the concurrency limits
+	serve := func(concurrency config.Concurrency) (*fasthttputil.InmemoryListener, recordingLogger) {
+		conf := config.ForwardProxyConfig{
+			Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+			Destinations: loopbackAllowed,
+			Concurrency:  concurrency,
+		}
+
+		logger := make(recordingLogger, 10)
+		h := NewForwardHandler(&conf)
+		h.SetAccessLogger(logger)
+
+		ln := fasthttputil.NewInmemoryListener()
+		go func() {
+			_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+		}()
+		return ln, logger
+	}
+
+	t.Run("limits tunnels per client", func(t *testing.T) {
+		ln, logger := serve(config.Concurrency{TunnelsPerClient: 1, QueueSize: 1, QueueTimeout: "1s"})
+		defer ln.Close()
+
+		connect := func() (net.Conn, *bufio.Reader, int) {
+			conn, err := ln.Dial()
+			assert.NoError(t, err, "should not fail dialing")
+			_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			assert.NoError(t, err, "should not throw error")
+			return conn, reader, resp.StatusCode
+		}
+
+		first, reader, status := connect()
+		assert.Equal(t, http.StatusOK, status)
+
+		second, _, status := connect()
+		assert.Equal(t, http.StatusServiceUnavailable, status, "should reject tunnels that waited too long")
+		_ = second.Close()
+		assert.Equal(t, accesslog.ReasonOverloaded, logger.next(t).Reason)
+
+		// The tunnel terminates once the upstream closed the connection as well
+		_, _ = fmt.Fprintf(first, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+		resp, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err, "should not throw error")
+		_ = resp.Body.Close()
+		_ = first.Close()
+		assert.Equal(t, accesslog.ReasonCompleted, logger.next(t).Reason)
+
+		third, _, status := connect()
+		assert.Equal(t, http.StatusOK, status, "should accept tunnels once a slot was freed")
+		_ = third.Close()
+	})
+
+	t.Run("queues requests per host", func(t *testing.T) {
+		ln, logger := serve(config.Concurrency{RequestsPerHost: 1, QueueSize: 1, QueueTimeout: "5s"})
+		defer ln.Close()
+
+		proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+		}}
+
+		get := func(path string) int {
+			resp, err := client.Get(srv.URL + path)
+			if !assert.NoError(t, err, "should not throw error") {
+				return 0
+			}
+			_, _ = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		queued := testutil.ToFloat64(metrics.ConcurrencyQueued.WithLabelValues(metrics.LimitHostRequests))
+
+		var wg sync.WaitGroup
+		statuses := make([]int, 2)
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				statuses[i] = get("/slow")
+			}(i)
+		}
+
+		// One request is forwarded, while the other one waits for its slot
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(metrics.ConcurrencyQueued.WithLabelValues(metrics.LimitHostRequests)) == queued+1
+		}, time.Second, 5*time.Millisecond)
+
+		assert.Equal(t, http.StatusServiceUnavailable, get("/"), "should reject requests once the queue is full")
+		assert.Equal(t, accesslog.ReasonOverloaded, logger.next(t).Reason)
+
+		release <- struct{}{}
+		release <- struct{}{}
+		wg.Wait()
+		assert.Equal(t, []int{http.StatusOK, http.StatusOK}, statuses, "should forward the queued request")
+		assert.Equal(t, http.StatusOK, get("/"))
+	})
+}
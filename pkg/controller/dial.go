@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+)
+
+// defaultDeniedNetworks are always denied, as they would allow clients to reach the proxy host itself
+// or the metadata endpoints of cloud providers. They can be opened up with config.Destinations.Allow.
+var defaultDeniedNetworks = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16", // Link-local which includes the metadata endpoint 169.254.169.254
+	"100.100.100.200/32",
+	"::/128",
+	"::1/128",
+	"fe80::/10",
+	"fd00:ec2::254/128",
+}
+
+var errDestinationForbidden = errors.New("destination address is forbidden by proxy policy")
+
+// ipPolicy decides which resolved addresses may be dialed. Allow entries take precedence over deny entries.
+type ipPolicy struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIPPolicy(conf config.Destinations) *ipPolicy {
+	deny := append(append([]string{}, defaultDeniedNetworks...), conf.Deny...)
+	return &ipPolicy{allow: parseNetworks(conf.Allow), deny: parseNetworks(deny)}
+}
+
+// Permits reports whether the provided address may be dialed.
+func (p *ipPolicy) Permits(ip net.IP) bool {
+	if containsIP(p.allow, ip) {
+		return true
+	}
+
+	return !containsIP(p.deny, ip)
+}
+
+// dialer resolves the destination itself and checks every resolved address against the ipPolicy before
+// dialing exactly this address. This prevents DNS rebinding, as no second lookup happens during dialing.
+type dialer struct {
+	policy   *ipPolicy
+	timeout  time.Duration
+	resolver *net.Resolver
+}
+
+func newDialer(conf config.Destinations, timeout time.Duration) *dialer {
+	return &dialer{policy: newIPPolicy(conf), timeout: timeout, resolver: net.DefaultResolver}
+}
+
+// PermitsLiteral reports whether host may be reached, if it is an IP address. Names are always permitted, as they are
+// only resolved by whoever dials them, which includes parent proxies.
+func (d *dialer) PermitsLiteral(host string) bool {
+	ip := net.ParseIP(host)
+	return ip == nil || d.policy.Permits(ip)
+}
+
+// Dial connects to the provided host:port address while respecting the configured connect timeout.
+// It matches the signature of fasthttp.DialFunc, so it can be used for fasthttp.Client as well.
+func (d *dialer) Dial(addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dial(addr)
+
+	result := metrics.ResultSuccess
+	if errors.Is(err, errDestinationForbidden) {
+		result = metrics.ResultForbidden
+	} else if err != nil {
+		result = metrics.ResultFailure
+	}
+	metrics.DialDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+
+	return conn, err
+}
+
+func (d *dialer) dial(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var netDialer net.Dialer
+	dialErr := errDestinationForbidden
+	for _, ip := range ips {
+		if !d.policy.Permits(ip.IP) {
+			continue
+		}
+
+		conn, err := netDialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		// Errors of actual dial attempts are more helpful than the policy error
+		dialErr = err
+	}
+
+	return nil, dialErr
+}
+
+func parseNetworks(entries []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		// config.New already validated the networks, hence an error is impossible at this location
+		network, err := config.ParseNetwork(entry)
+		if err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPPolicy_Permits(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.Destinations
+		ip   string
+		want bool
+	}{
+		{name: "public address is permitted", conf: config.Destinations{}, ip: "93.184.216.34", want: true},
+		{name: "loopback is denied by default", conf: config.Destinations{}, ip: "127.0.0.1", want: false},
+		{name: "ipv6 loopback is denied by default", conf: config.Destinations{}, ip: "::1", want: false},
+		{name: "metadata endpoint is denied by default", conf: config.Destinations{}, ip: "169.254.169.254", want: false},
+		{name: "ipv4 mapped loopback is denied by default", conf: config.Destinations{}, ip: "::ffff:127.0.0.1", want: false},
+		{name: "private range is permitted by default", conf: config.Destinations{}, ip: "10.1.2.3", want: true},
+		{name: "configured deny blocks private range", conf: config.Destinations{Deny: []string{"10.0.0.0/8"}}, ip: "10.1.2.3", want: false},
+		{name: "configured allow overrides configured deny", conf: config.Destinations{Allow: []string{"10.1.2.3"}, Deny: []string{"10.0.0.0/8"}}, ip: "10.1.2.3", want: true},
+		{name: "configured allow overrides default deny", conf: config.Destinations{Allow: []string{"127.0.0.0/8"}}, ip: "127.0.0.1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newIPPolicy(tt.conf).Permits(net.ParseIP(tt.ip)))
+		})
+	}
+}
+
+func TestDialer_Dial(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+
+	t.Run("denied address is not dialed", func(t *testing.T) {
+		d := newDialer(config.Destinations{}, time.Second)
+
+		conn, err := d.Dial(addr)
+		assert.Nil(t, conn)
+		assert.Equal(t, errDestinationForbidden, err)
+	})
+
+	t.Run("allowed address is dialed", func(t *testing.T) {
+		d := newDialer(loopbackAllowed, time.Second)
+
+		conn, err := d.Dial(addr)
+		assert.NoError(t, err)
+		assert.NotNil(t, conn)
+		_ = conn.Close()
+	})
+
+	t.Run("address without port", func(t *testing.T) {
+		d := newDialer(loopbackAllowed, time.Second)
+
+		_, err := d.Dial("localhost")
+		assert.Error(t, err)
+	})
+}
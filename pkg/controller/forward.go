@@ -1,17 +1,27 @@
 package controller
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Templum/Spediteur/pkg/accesslog"
 	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 )
 
+// NewForwardHandler creates a handler for conf, which has to be validated by config.New. It panics if the files of
+// conf changed since they were validated and cannot be loaded anymore.
 func NewForwardHandler(conf *config.ForwardProxyConfig) *ForwardHandler {
 	var pool = sync.Pool{
 		New: func() interface{} {
@@ -19,79 +29,523 @@ func NewForwardHandler(conf *config.ForwardProxyConfig) *ForwardHandler {
 			return &buf
 		},
 	}
-	// time.ParseDuration is already called during validation, hence an error is impossible at this location
-	d, _ := time.ParseDuration(conf.Proxy.Timeouts.Write)
-	t, _ := time.ParseDuration(conf.Proxy.Timeouts.Connect)
 
-	return &ForwardHandler{pool: &pool, conf: conf, connectTimeout: t, deadlineDuration: d}
+	h := &ForwardHandler{pool: &pool, tunnels: newTunnelRegistry(), upstreams: newConnPool(conf.Upstream.Pool), shaper: newShaper(), limits: newRateLimiter()}
+	h.concurrency = newConcurrencyLimits(conf.Concurrency)
+	h.cache, h.coalescer = newResponseCache(conf.Cache), newCoalescer(conf.Coalescing)
+	h.interceptServer = newInterceptServer(conf, h)
+	if err := h.Reload(conf, nil); err != nil {
+		panic(err)
+	}
+	return h
 }
 
 type ForwardHandler struct {
-	pool *sync.Pool
-	conf *config.ForwardProxyConfig
+	pool      *sync.Pool
+	tunnels   *tunnelRegistry
+	upstreams *connPool
+	shaper    *shaper
+	limits    *rateLimiter
+	settings  atomic.Value
+
+	// cache stores responses of forwarded requests and coalescer lets identical requests share a response, where
+	// either is nil while disabled
+	cache     *responseCache
+	coalescer *coalescer
+
+	// concurrency bounds the tunnels and upstream requests that are handled at once
+	concurrency *concurrencyLimits
+
+	// interceptServer reads the decrypted requests of intercepted tunnels
+	interceptServer *fasthttp.Server
+	accessLogger    AccessLogger
+	listenerTLS     *ListenerTLS
+
+	mu        sync.Mutex
+	listeners []net.Listener
 
-	connectTimeout time.Duration
-	deadlineDuration time.Duration
+	rejectedClients uint64
 }
 
 func (h *ForwardHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
-	// TODO: Check against whitelist
-	domain, lookup := getDomainName(ctx)
-	log.Debugf("Domain Lookup yielded %s and %s", domain, lookup)
+	start := time.Now()
+	requestType := metrics.TypeProxy
+	if ctx.IsConnect() {
+		requestType = metrics.TypeConnect
+	}
+
+	// fasthttp assumes https for requests arriving through TLS, while the scheme of proxy requests refers to the destination
+	if !ctx.IsConnect() {
+		ctx.Request.URI().SetSchemeBytes(requestScheme(ctx))
+	}
+
+	rl := newRequestLog(ctx, start)
+	defer h.finish(ctx, rl, requestType)
+
+	s := h.current()
+
+	if !h.permitsClient(s, ctx.RemoteIP()) {
+		rl.reject(accesslog.ReasonClientRejected)
+		ctx.Error("client is not permitted to use this proxy", fasthttp.StatusForbidden)
+		return
+	}
+
+	if !s.authenticate(ctx, h.clientIdentity(ctx)) {
+		rl.reject(accesslog.ReasonAuthentication)
+		return
+	}
+
+	if !h.authorize(ctx, s, rl) {
+		return
+	}
 
-	deadline := time.Now().Add(h.deadlineDuration)
+	deadline := time.Now().Add(s.deadlineDuration)
 
 	if ctx.IsConnect() {
-		log.Debugf("received connect for %s", domain)
+		log.Debugf("received connect for %s", ctx.Host())
 		h.Tunnel(ctx, deadline)
 	} else {
-		log.Debugf("received proxy for %s", domain)
+		log.Debugf("received proxy for %s", ctx.Host())
 		h.Proxy(ctx, deadline)
 	}
 }
 
+// finish records the metrics of the request and logs it, unless it continues as tunnel or streamed response.
+func (h *ForwardHandler) finish(ctx *fasthttp.RequestCtx, rl *requestLog, requestType string) {
+	metrics.Requests.WithLabelValues(requestType, strconv.Itoa(ctx.Response.StatusCode())).Inc()
+	metrics.RequestDuration.WithLabelValues(requestType).Observe(time.Since(rl.start).Seconds())
+
+	rl.User = User(ctx)
+	rl.Status = ctx.Response.StatusCode()
+	// Established tunnels and streamed responses are logged once they are finished
+	if !ctx.Hijacked() && !rl.streaming {
+		h.logAccess(rl)
+	}
+}
+
+// permitsClient reports whether the client may use the proxy at all, where rejected clients are counted.
+func (h *ForwardHandler) permitsClient(s *settings, client net.IP) bool {
+	if s.clients.Permits(client) {
+		return true
+	}
+
+	metrics.Errors.WithLabelValues(metrics.ErrorClientRejected).Inc()
+	rejected := atomic.AddUint64(&h.rejectedClients, 1)
+	log.Warnf("Rejected client %s as it is not permitted to use the proxy (%d rejected so far)", client, rejected)
+	return false
+}
+
+// rejection describes why the destination checks refused a request, along with the status and message to respond
+// with. Retry is only set for requests that exceeded a rate limit.
+type rejection struct {
+	reason  string
+	status  int
+	message string
+	retry   time.Duration
+}
+
+// checkDestination takes a request token of the client, the user and the destination host, before it checks the
+// destination against the access list and the policies. It returns nil if the request is permitted. Requests of
+// HTTP and SOCKS5 clients share these checks, hence both are refused alike.
+func (h *ForwardHandler) checkDestination(s *settings, client string, user string, method string, host string, port int) *rejection {
+	domain := strings.ToLower(host)
+	if scope, retry := h.limits.Allow(client, user, domain); len(scope) > 0 {
+		metrics.Errors.WithLabelValues(metrics.ErrorRateLimited).Inc()
+		metrics.RateLimited.WithLabelValues(scope).Inc()
+		log.Warnf("Throttled %s request of %s (user %q) towards %s as it exceeds the %s rate limit", method, client, user, domain, scope)
+		return &rejection{reason: accesslog.ReasonRateLimited, status: fasthttp.StatusTooManyRequests, message: "rate limit exceeded", retry: retry}
+	}
+
+	host, lookup := lookupNames(host)
+	log.Debugf("Domain Lookup yielded %s and %s", host, lookup)
+
+	if !s.access.Permits(host, lookup) {
+		metrics.Errors.WithLabelValues(metrics.ErrorAccessDenied).Inc()
+		log.Warnf("Blocked request from %s towards %s as it is not permitted by the access list", client, host)
+		return &rejection{reason: accesslog.ReasonAccessDenied, status: fasthttp.StatusForbidden, message: fmt.Sprintf("access to %s is forbidden by proxy access list", host)}
+	}
+
+	allowed, rule := s.policy.Evaluate(policyRequest{user: user, host: host, lookup: lookup, port: port, method: method})
+	if !allowed {
+		metrics.Errors.WithLabelValues(metrics.ErrorPolicyDenied).Inc()
+		log.Warnf("Blocked %s request of %s (user %q) towards %s due to policy rule %s", method, client, user, host, rule)
+		return &rejection{reason: accesslog.ReasonPolicyDenied, status: fasthttp.StatusForbidden, message: fmt.Sprintf("access to %s is forbidden by proxy policy", host)}
+	}
+
+	return nil
+}
+
+// authorize passes the request through the destination checks and responds with 429 if it exceeded a rate limit or
+// with 403 if the access list or the policies do not permit it.
+func (h *ForwardHandler) authorize(ctx *fasthttp.RequestCtx, s *settings, rl *requestLog) bool {
+	r := h.checkDestination(s, ctx.RemoteIP().String(), User(ctx), string(ctx.Method()), hostOf(string(ctx.Request.Host())), getPort(ctx))
+	if r == nil {
+		return true
+	}
+
+	rl.reject(r.reason)
+	ctx.Error(r.message, r.status)
+	if r.status == fasthttp.StatusTooManyRequests {
+		// ctx.Error resets the response, hence Retry-After has to be set afterwards
+		ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(r.retry.Seconds()))))
+	}
+	return false
+}
+
+// RejectedClients returns the number of requests that were rejected as their client is not permitted to use the proxy.
+func (h *ForwardHandler) RejectedClients() uint64 {
+	return atomic.LoadUint64(&h.rejectedClients)
+}
+
+// Shutdown stops accepting new tunnels and SOCKS5 clients and waits up to the configured drain timeout for
+// live tunnels to finish, before the remaining ones are closed forcefully.
+func (h *ForwardHandler) Shutdown() {
+	timeout := h.current().drainTimeout
+	log.Infof("Draining %d live tunnels for up to %s", h.tunnels.Len(), timeout)
+
+	// Closing the registry first lets ServeSOCKS5 know that its listener is closed on purpose
+	h.tunnels.Close()
+	h.upstreams.Close()
+
+	h.mu.Lock()
+	for _, ln := range h.listeners {
+		_ = ln.Close()
+	}
+	h.listeners = nil
+	h.mu.Unlock()
+
+	drained, forced := h.tunnels.Drain(timeout)
+	if forced > 0 {
+		log.Warnf("Drained %d tunnels, while %d tunnels had to be closed forcefully after %s", drained, forced, timeout)
+		return
+	}
+
+	log.Infof("Drained all %d tunnels", drained)
+}
+
 func (h *ForwardHandler) Tunnel(ctx *fasthttp.RequestCtx, deadline time.Time) {
-	
-	dest, err := fasthttp.DialTimeout(string(ctx.Host()), h.connectTimeout)
+	rl := requestLogOf(ctx)
+
+	if h.tunnels.Closed() {
+		rl.reject(accesslog.ReasonServiceUnavailable)
+		ctx.Error("proxy is shutting down", fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	release, err := h.concurrency.AcquireTunnel(ctx.RemoteIP().String(), deadline)
 	if err != nil {
+		h.overloaded(ctx, rl, err)
+		return
+	}
+
+	target := string(ctx.Host())
+	s := h.current()
+	if s.interception.Matches(hostOf(target)) {
+		h.intercept(ctx, s.interception, target, deadline, release)
+		return
+	}
+
+	dest, err := s.dialTunnel(target)
+	if errors.Is(err, errDestinationForbidden) {
+		release()
+		metrics.Errors.WithLabelValues(metrics.ErrorDestinationForbidden).Inc()
+		log.Warnf("tunnel: blocked connection towards %s as its address is forbidden", ctx.Host())
+		rl.reject(accesslog.ReasonDestinationForbidden)
+		ctx.Error("access to destination address is forbidden by proxy policy", fasthttp.StatusForbidden)
+		return
+	}
+	if err != nil {
+		release()
+		metrics.Errors.WithLabelValues(metrics.ErrorUpstreamUnreachable).Inc()
 		log.Errorf("tunnel: failed to reach target host %s due to %s", ctx.Host(), err)
+		rl.reject(accesslog.ReasonUpstreamUnreachable)
 		ctx.Error("could not reach upstream server", fasthttp.StatusServiceUnavailable)
 		return
 	}
 
+	rl.ResolvedIP = remoteIP(dest.RemoteAddr())
+
 	ctx.Hijack(func(origin net.Conn) {
-		var wg sync.WaitGroup
-		wg.Add(2)
+		h.relay(&tunnel{target: target, origin: origin, dest: dest, release: release}, rl, metrics.TypeConnect, deadline)
+	})
+}
 
-		defer dest.Close()
-		defer origin.Close()
+// relay copies data between both ends of the tunnel until either end closes or the deadline is reached. The
+// tunnel is tracked by the registry meanwhile, so it can be drained during shutdown.
+func (h *ForwardHandler) relay(t *tunnel, rl *requestLog, requestType string, deadline time.Time) {
+	defer t.done()
 
-		_ = dest.SetDeadline(deadline)
-		_ = origin.SetDeadline(deadline)
+	if !h.tunnels.Register(t) {
+		log.Debugf("tunnel: closing tunnel towards %s as the proxy is shutting down", t.target)
+		t.close()
+		rl.reject(accesslog.ReasonShutdown)
+		h.logAccess(rl)
+		return
+	}
+	defer h.tunnels.Unregister(t)
 
-		go h.transfer(dest, origin, &wg)
-		go h.transfer(origin, dest, &wg)
+	opened := time.Now()
+	metrics.ActiveTunnels.Inc()
+	defer func() {
+		metrics.ActiveTunnels.Dec()
+		metrics.TunnelDuration.Observe(time.Since(opened).Seconds())
+	}()
 
-		wg.Wait()
-	})
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	defer t.close()
+
+	_ = t.dest.SetDeadline(deadline)
+	_ = t.origin.SetDeadline(deadline)
+
+	// Bytes read while peeking at the server name are relayed ahead of the remaining ones
+	var upstream io.Reader = t.origin
+	if s := h.current(); s.sni.Applies(t.target) {
+		peeked, ok := h.checkSNI(s.sni, t, rl, s.readTimeout, deadline)
+		if !ok {
+			rl.reject(accesslog.ReasonSNIMismatch)
+			h.logAccess(rl)
+			return
+		}
+		upstream = io.MultiReader(bytes.NewReader(peeked), t.origin)
+	}
+
+	// Both directions draw from the same rate limit buckets, hence those limits cover the sum of them
+	limited, release := h.limits.Bandwidth(rl.ClientIP, rl.User, strings.ToLower(hostOf(t.target)))
+	defer release()
+	shaped := h.shaper.Open()
+	defer h.shaper.Close(shaped)
+	up := append([]*tokenBucket{h.shaper.upload, shaped.upload}, limited...)
+	down := append([]*tokenBucket{h.shaper.download, shaped.download}, limited...)
+
+	var upErr, downErr error
+	go func() {
+		defer wg.Done()
+		rl.BytesUp, upErr = h.transfer(t.dest, upstream, up, requestType, metrics.DirectionUpload)
+	}()
+	go func() {
+		defer wg.Done()
+		rl.BytesDown, downErr = h.transfer(t.origin, t.dest, down, requestType, metrics.DirectionDownload)
+	}()
+
+	wg.Wait()
+
+	rl.Reason = tunnelReason(t, upErr, downErr)
+	h.logAccess(rl)
 }
 
+// Proxy forwards the request and passes the upstream response on. Headers are copied in both directions apart from
+// hop-by-hop headers, while the body is streamed to the client. Thus the request is logged once the body was transferred.
 func (h *ForwardHandler) Proxy(ctx *fasthttp.RequestCtx, deadline time.Time) {
-	// Eventually would make sense to have a pool of fasthttp clients, although the target upstream are unlikely always the same
-	c := fasthttp.Client{}
+	rl := requestLogOf(ctx)
+	s := h.current()
+
+	// The outbound request is a copy, hence the request of the client remains as it was received
+	out := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(out)
+
+	ctx.Request.CopyTo(out)
+	out.URI().SetSchemeBytes(requestScheme(ctx))
+	stripHopByHop(&out.Header)
+	s.headers.Request(&out.Header, ctx.RemoteIP(), string(out.URI().Scheme()), string(ctx.Host()))
+
+	target := net.JoinHostPort(hostOf(string(ctx.Host())), strconv.Itoa(getPort(ctx)))
+
+	// Stored responses are served right away while fresh, otherwise the upstream is asked to confirm them
+	var key string
+	var stored *cacheEntry
+	cacheable := cacheableRequest(&ctx.Request.Header)
+	if h.cache != nil || h.coalescer != nil {
+		key = string(out.URI().FullURI())
+	}
+	if h.cache != nil && cacheable {
+		stored = h.cache.Get(key, &ctx.Request.Header)
+		switch {
+		case stored != nil && stored.servable(&ctx.Request.Header, time.Now()):
+			h.serveCached(ctx, s, stored, metrics.CacheHit)
+			return
+		case stored != nil && stored.validatable() && !hasConditionals(&ctx.Request.Header):
+			stored.validate(&out.Header)
+		case parseCacheControl(headerValues(&ctx.Request.Header, fasthttp.HeaderCacheControl)).Has("only-if-cached"):
+			metrics.CacheLookups.WithLabelValues(metrics.CacheMiss).Inc()
+			rl.Cache = metrics.CacheMiss
+			ctx.Error("response is not cached", fasthttp.StatusGatewayTimeout)
+			return
+		default:
+			// Clients that validate on their own receive the answer of the upstream as is
+			stored = nil
+		}
+	}
 
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(resp)
+	// Identical requests wait for the one that is underway, while revalidations of stored responses proceed on their own
+	var lead *flight
+	if h.coalescer != nil && cacheable && stored == nil {
+		f, leader := h.coalescer.Join(coalescingKey(key, &ctx.Request.Header))
+		if !leader {
+			if shared := h.coalescer.Wait(f, &ctx.Request.Header, deadline); shared != nil {
+				h.serveEntry(ctx, s, shared)
+				return
+			}
+		} else {
+			lead = f
+			// Streamed responses land once their body was transferred
+			defer func() {
+				if !rl.streaming {
+					h.coalescer.Land(lead, nil)
+				}
+			}()
+		}
+	}
 
-	err := c.DoDeadline(&ctx.Request, resp, deadline)
+	release, err := h.concurrency.AcquireRequest(strings.ToLower(hostOf(target)), deadline)
 	if err != nil {
+		h.overloaded(ctx, rl, err)
+		return
+	}
+	// Streamed responses hold the slot until their body was transferred
+	defer func() {
+		if !rl.streaming {
+			release()
+		}
+	}()
+
+	requestTime := time.Now()
+	body, err := s.roundTrip(h.upstreams, target, out, &ctx.Response.Header, deadline)
+	if errors.Is(err, errDestinationForbidden) {
+		metrics.Errors.WithLabelValues(metrics.ErrorDestinationForbidden).Inc()
+		log.Warnf("Blocked forwarding towards %s as its address is forbidden", ctx.Host())
+		rl.reject(accesslog.ReasonDestinationForbidden)
+		ctx.Error("access to destination address is forbidden by proxy policy", fasthttp.StatusForbidden)
+		return
+	}
+	if err != nil {
+		metrics.Errors.WithLabelValues(metrics.ErrorUpstreamUnreachable).Inc()
 		log.Warnf("Received %s during forwarding", err)
+		rl.reject(accesslog.ReasonUpstreamUnreachable)
 		ctx.Error("could not reach upstream server", fasthttp.StatusServiceUnavailable)
 		return
 	}
 
-	ctx.SetStatusCode(resp.StatusCode())
-	ctx.SetBody(resp.Body())
+	responseTime := time.Now()
+
+	rl.ResolvedIP = remoteIP(body.conn.RemoteAddr())
+	rl.BytesUp = int64(len(ctx.Request.Body()))
+	metrics.TransferredBytes.WithLabelValues(metrics.TypeProxy, metrics.DirectionUpload).Add(float64(rl.BytesUp))
+
+	stripHopByHop(&ctx.Response.Header)
+	// Responses without Content-Type must not gain one, as that would change how clients treat them
+	ctx.Response.Header.SetNoDefaultContentType(true)
+
+	if stored != nil && ctx.Response.StatusCode() == fasthttp.StatusNotModified {
+		_ = body.Close()
+		refreshed := stored.refresh(&ctx.Request.Header, &ctx.Response.Header, requestTime, responseTime)
+		h.cache.Put(refreshed)
+		h.serveCached(ctx, s, refreshed, metrics.CacheRevalidated)
+		return
+	}
+
+	var recorder *entryRecorder
+	switch {
+	case h.cache != nil && !isSafe(&ctx.Request.Header) && ctx.Response.StatusCode() < fasthttp.StatusBadRequest:
+		// Unsafe requests that succeeded likely changed what is stored for their target (RFC 9111 4.4)
+		h.cache.Invalidate(key)
+	case cacheable && (h.cache != nil || lead != nil):
+		if h.cache != nil {
+			rl.Cache = metrics.CacheMiss
+			if stored != nil {
+				rl.Cache = metrics.CacheChanged
+			}
+			metrics.CacheLookups.WithLabelValues(rl.Cache).Inc()
+		}
+
+		// Responses that may be stored by a shared cache may be shared with waiting requests as well
+		if storable(&ctx.Request.Header, &ctx.Response.Header) {
+			entry := newCacheEntry(key, &ctx.Request.Header, &ctx.Response.Header, requestTime, responseTime)
+			recorder = &entryRecorder{entry: entry, limit: h.recordLimit()}
+		}
+	}
+	if lead != nil && recorder == nil {
+		h.coalescer.Land(lead, nil)
+	}
+
+	// publish stores the recorded response and shares it with the waiting requests
+	publish := func(complete bool) {
+		if recorder == nil {
+			return
+		}
+		if h.cache != nil && complete {
+			h.cache.Put(recorder.entry)
+		}
+		if lead != nil {
+			if complete {
+				h.coalescer.Land(lead, recorder.entry)
+			} else {
+				h.coalescer.Land(lead, nil)
+			}
+		}
+	}
+
+	s.headers.Response(&ctx.Response.Header)
+
+	if body.size == 0 {
+		_ = body.Close()
+		publish(true)
+		return
+	}
+
+	rl.streaming = true
+	body.onClose = func(n int64, err error) {
+		release()
+		rl.BytesDown = n
+		metrics.TransferredBytes.WithLabelValues(metrics.TypeProxy, metrics.DirectionDownload).Add(float64(n))
+		if err != nil {
+			metrics.Errors.WithLabelValues(metrics.ErrorTransfer).Inc()
+			log.Warnf("Received %s during proxying", err)
+		}
+
+		// Only complete bodies are stored, which excludes those that were cut short by the upstream
+		publish(recorder != nil && err == nil && body.done && !recorder.overflow && (body.size < 0 || n == int64(body.size)))
+
+		rl.Reason = transferReason(err)
+		h.logAccess(rl)
+	}
+
+	// Sending the header right away lets clients act on it while a slow body is still underway
+	ctx.Response.ImmediateHeaderFlush = true
+	var stream io.Reader = body
+	if recorder != nil {
+		stream = &recordingBody{upstreamBody: body, recorder: recorder}
+	}
+	// Intercepted tunnels are already shaped as a whole, hence their responses must not draw from the buckets twice
+	if _, intercepted := ctx.Conn().(*interceptedConn); !intercepted {
+		stream = &throttledReader{reader: stream, buckets: []*tokenBucket{h.shaper.download}}
+	}
+	ctx.Response.SetBodyStream(stream, body.size)
+}
+
+// serveCached answers the request with a stored response and records the result of the cache lookup.
+func (h *ForwardHandler) serveCached(ctx *fasthttp.RequestCtx, s *settings, entry *cacheEntry, result string) {
+	requestLogOf(ctx).Cache = result
+	metrics.CacheLookups.WithLabelValues(result).Inc()
+	h.serveEntry(ctx, s, entry)
+}
+
+// serveEntry answers the request with a recorded response, which passes through the same header handling as forwarded
+// responses. Clients that already hold the response according to If-None-Match receive Not Modified instead.
+func (h *ForwardHandler) serveEntry(ctx *fasthttp.RequestCtx, s *settings, entry *cacheEntry) {
+	rl := requestLogOf(ctx)
+	entry.Write(&ctx.Response, time.Now())
+	s.headers.Response(&ctx.Response.Header)
+
+	if entry.notModified(&ctx.Request.Header) {
+		ctx.Response.ResetBody()
+		ctx.Response.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+
+	rl.BytesDown = int64(len(entry.Body))
+	metrics.TransferredBytes.WithLabelValues(metrics.TypeProxy, metrics.DirectionDownload).Add(float64(rl.BytesDown))
 }
 
 func clearSlice(pool *sync.Pool, b *[]byte) {
@@ -101,27 +555,82 @@ func clearSlice(pool *sync.Pool, b *[]byte) {
 	pool.Put(b)
 }
 
-func (h *ForwardHandler) transfer(destination io.Writer, source io.Reader, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+// transfer copies source to destination while the bandwidth stays within the buckets.
+func (h *ForwardHandler) transfer(destination io.Writer, source io.Reader, buckets []*tokenBucket, requestType string, direction string) (int64, error) {
 	buf := h.pool.Get().(*[]byte)
 	defer clearSlice(h.pool, buf)
 
-	_, err := io.CopyBuffer(destination, source, *buf)
+	if len(buckets) > 0 {
+		source = &throttledReader{reader: source, buckets: buckets}
+	}
+
+	n, err := io.CopyBuffer(destination, source, *buf)
+	metrics.TransferredBytes.WithLabelValues(requestType, direction).Add(float64(n))
 	if err != nil {
+		metrics.Errors.WithLabelValues(metrics.ErrorTransfer).Inc()
 		log.Warnf("Received %s during proxying", err)
 	}
+	return n, err
 }
 
-func getDomainName(ctx *fasthttp.RequestCtx) (string, string) {
-	host := string(ctx.Request.Host())
+// tunnelReason describes why a tunnel terminated based on the errors of both transfer directions.
+func tunnelReason(t *tunnel, errs ...error) string {
+	if t.forced() {
+		return accesslog.ReasonShutdown
+	}
+
+	reason := accesslog.ReasonCompleted
+	for _, err := range errs {
+		switch transferReason(err) {
+		case accesslog.ReasonTimeout:
+			return accesslog.ReasonTimeout
+		case accesslog.ReasonError:
+			reason = accesslog.ReasonError
+		}
+	}
+	return reason
+}
 
-	// If present remove port
-	dotIdx := strings.IndexRune(host, ':')
-	if dotIdx > 0 {
-		host = host[:dotIdx]
+// transferReason describes how a transfer ended based on its error.
+func transferReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return accesslog.ReasonTimeout
 	}
+	if err != nil {
+		return accesslog.ReasonError
+	}
+	return accesslog.ReasonCompleted
+}
+
+// getPort returns the destination port of the request, falling back to the default port of the scheme.
+func getPort(ctx *fasthttp.RequestCtx) int {
+	_, rawPort, err := net.SplitHostPort(string(ctx.Request.Host()))
+	if err == nil {
+		port, err := strconv.Atoi(rawPort)
+		if err == nil {
+			return port
+		}
+	}
+
+	if ctx.IsConnect() || bytes.Equal(requestScheme(ctx), []byte("https")) {
+		return 443
+	}
+	return 80
+}
+
+// requestScheme returns the scheme of the absolute request URI. fasthttp assumes https for every request that arrives
+// through a TLS listener, which does not hold for proxies, as the scheme refers to the destination.
+func requestScheme(ctx *fasthttp.RequestCtx) []byte {
+	uri := ctx.Request.Header.RequestURI()
+	if idx := bytes.Index(uri, []byte("://")); idx > 0 {
+		return bytes.ToLower(uri[:idx])
+	}
+	return ctx.Request.URI().Scheme()
+}
 
+// lookupNames returns the host along with the name of a reverse lookup, if the host is an IP address.
+func lookupNames(host string) (string, string) {
 	// If ParseIP return nil it is very likely a domain. Or worstcase an malformed IP that anyways would fail during lookup
 	if net.ParseIP(host) == nil {
 		return host, ""
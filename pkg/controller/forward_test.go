@@ -1,10 +1,12 @@
 package controller
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -14,6 +16,8 @@ import (
 	"testing"
 
 	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/valyala/fasthttp"
@@ -42,6 +46,9 @@ func createUnreachableEndpoint(handler http.Handler) *httptest.Server {
 	return httptest.NewUnstartedServer(handler)
 }
 
+// Test endpoints are listening on loopback, which is denied by default
+var loopbackAllowed = config.Destinations{Allow: []string{"127.0.0.0/8", "::1"}}
+
 // Used to ensure compiler can not optimize loop
 var finalResponse *http.Response
 
@@ -50,7 +57,7 @@ func BenchmarkForwardHandler_Forward(b *testing.B) {
 
 	var localResponse *http.Response
 
-	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}, Destinations: loopbackAllowed}
 	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
 
 	h := NewForwardHandler(&conf)
@@ -94,7 +101,7 @@ func BenchmarkForwardHandler_Tunnel(b *testing.B) {
 
 	var localResponse *http.Response
 
-	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}, Destinations: loopbackAllowed}
 	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
 
 	h := NewForwardHandler(&conf)
@@ -137,7 +144,7 @@ func BenchmarkForwardHandler_Tunnel(b *testing.B) {
 func TestForwardHandler_HandleFastHTTP(t *testing.T) {
 	t.Parallel()
 
-	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}, Destinations: loopbackAllowed}
 	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
 
 	connectTests := []struct {
@@ -435,3 +442,212 @@ func TestForwardHandler_HandleFastHTTP(t *testing.T) {
 		assert.Contains(t, string(actualBody), "could not reach upstream server")
 	})
 }
+
+func TestForwardHandler_AccessList(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Access:       config.Access{Deny: []string{"127.0.0.1", "::1"}},
+		Destinations: loopbackAllowed,
+	}
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(http.NotFound))
+	defer srv.Close()
+
+	tlsSrv, certpool := startHTTPSTestEndpoint(http.HandlerFunc(http.NotFound))
+	defer tlsSrv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		TLSClientConfig: &tls.Config{RootCAs: certpool},
+	}}
+
+	t.Run("[forwarding] denied destination", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := client.Do(req)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 403, resp.StatusCode)
+		assert.Contains(t, string(actualBody), "access to 127.0.0.1 is forbidden")
+	})
+
+	t.Run("[connect request] denied destination", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, tlsSrv.URL, nil)
+		resp, err := client.Do(req)
+
+		assert.Nil(t, resp, "should not return a response")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "Forbidden")
+	})
+
+	t.Run("[connect request] denied ipv6 destination", func(t *testing.T) {
+		for _, target := range []string{"[::1]:443", "[::1]"} {
+			conn, err := ln.Dial()
+			assert.NoError(t, err, "should not fail dialing")
+
+			_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			assert.NoError(t, err, "should not throw error")
+			assert.EqualValues(t, 403, resp.StatusCode, "should deny %s", target)
+			_ = conn.Close()
+		}
+	})
+}
+
+func TestForwardHandler_Destinations(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(http.NotFound))
+	defer srv.Close()
+
+	tlsSrv, certpool := startHTTPSTestEndpoint(http.HandlerFunc(http.NotFound))
+	defer tlsSrv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		TLSClientConfig: &tls.Config{RootCAs: certpool},
+	}}
+
+	t.Run("[forwarding] loopback is denied by default", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := client.Do(req)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 403, resp.StatusCode)
+		assert.Contains(t, string(actualBody), "destination address is forbidden")
+	})
+
+	t.Run("[connect request] loopback is denied by default", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, tlsSrv.URL, nil)
+		resp, err := client.Do(req)
+
+		assert.Nil(t, resp, "should not return a response")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "Forbidden")
+	})
+}
+
+func TestForwardHandler_Clients(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ForwardProxyConfig{
+		Proxy:   config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Clients: config.Clients{Allow: []string{"10.10.0.0/16"}},
+	}
+
+	h := NewForwardHandler(&conf)
+
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/")
+
+	t.Run("rejects client outside of permitted ranges", func(t *testing.T) {
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 4711}, nil)
+
+		h.HandleFastHTTP(&ctx)
+
+		assert.EqualValues(t, 403, ctx.Response.StatusCode())
+		assert.Contains(t, string(ctx.Response.Body()), "client is not permitted")
+		assert.EqualValues(t, 1, h.RejectedClients())
+	})
+
+	t.Run("passes client within permitted ranges", func(t *testing.T) {
+		conf := conf
+		conf.Access = config.Access{Allow: []string{"example.org"}}
+		h := NewForwardHandler(&conf)
+
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("10.10.4.2"), Port: 4711}, nil)
+
+		h.HandleFastHTTP(&ctx)
+
+		// The access list is evaluated only after the client was permitted
+		assert.Contains(t, string(ctx.Response.Body()), "access to example.com is forbidden")
+		assert.EqualValues(t, 0, h.RejectedClients())
+	})
+}
+
+func TestForwardHandler_Metrics(t *testing.T) {
+	conf := config.ForwardProxyConfig{
+		Proxy:  config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Access: config.Access{Deny: []string{"example.com"}},
+	}
+	h := NewForwardHandler(&conf)
+
+	requests := metrics.Requests.WithLabelValues(metrics.TypeProxy, "403")
+	denied := metrics.Errors.WithLabelValues(metrics.ErrorAccessDenied)
+	requestsBefore, deniedBefore := testutil.ToFloat64(requests), testutil.ToFloat64(denied)
+
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/")
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+
+	h.HandleFastHTTP(&ctx)
+
+	assert.EqualValues(t, 403, ctx.Response.StatusCode())
+	assert.Equal(t, requestsBefore+1, testutil.ToFloat64(requests))
+	assert.Equal(t, deniedBefore+1, testutil.ToFloat64(denied))
+}
+
+func TestGetPort(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		want   int
+	}{
+		{name: "explicit port", method: "GET", uri: "http://example.com:8080/", want: 8080},
+		{name: "http default", method: "GET", uri: "http://example.com/", want: 80},
+		{name: "https default", method: "GET", uri: "https://example.com/", want: 443},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req fasthttp.Request
+			req.Header.SetMethod(tt.method)
+			req.SetRequestURI(tt.uri)
+
+			var ctx fasthttp.RequestCtx
+			ctx.Init(&req, nil, nil)
+
+			assert.Equal(t, tt.want, getPort(&ctx))
+		})
+	}
+}
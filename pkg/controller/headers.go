@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/valyala/fasthttp"
+)
+
+// hopByHopHeaders only apply to a single connection and must not be forwarded by proxies (RFC 7230 6.1).
+var hopByHopHeaders = []string{
+	fasthttp.HeaderConnection,
+	"Keep-Alive",
+	fasthttp.HeaderProxyAuthenticate,
+	fasthttp.HeaderProxyAuthorization,
+	"Proxy-Connection",
+	fasthttp.HeaderTE,
+	fasthttp.HeaderTransferEncoding,
+	fasthttp.HeaderUpgrade,
+}
+
+// header is implemented by both fasthttp.RequestHeader and fasthttp.ResponseHeader.
+type header interface {
+	VisitAll(f func(key, value []byte))
+	Set(key string, value string)
+	Del(key string)
+}
+
+// stripHopByHop removes the hop-by-hop headers along with any header that is listed by the Connection header.
+func stripHopByHop(h header) {
+	var listed []string
+	h.VisitAll(func(key, value []byte) {
+		if string(key) != fasthttp.HeaderConnection {
+			return
+		}
+		for _, name := range bytes.Split(value, []byte(",")) {
+			if name = bytes.TrimSpace(name); len(name) > 0 {
+				listed = append(listed, string(name))
+			}
+		}
+	})
+
+	for _, name := range listed {
+		h.Del(name)
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// hopHeaders announces the proxy hop within forwarded messages using Via, X-Forwarded-For and Forwarded (RFC 7239).
+type hopHeaders struct {
+	via           string
+	xForwardedFor string
+	forwarded     string
+	pseudonym     string
+}
+
+func newHopHeaders(conf config.Headers) *hopHeaders {
+	return &hopHeaders{via: conf.Via, xForwardedFor: conf.XForwardedFor, forwarded: conf.Forwarded, pseudonym: conf.Pseudonym}
+}
+
+// Request prepares the header of a request that is forwarded on behalf of client, which already had its hop-by-hop
+// headers stripped.
+func (hh *hopHeaders) Request(h *fasthttp.RequestHeader, client net.IP, proto string, host string) {
+	switch hh.via {
+	case config.HeaderAdd:
+		appendHeader(h, fasthttp.HeaderVia, viaVersion(h.Protocol())+" "+hh.pseudonym)
+	case config.HeaderSuppress:
+		h.Del(fasthttp.HeaderVia)
+	}
+
+	node := "unknown"
+	if client != nil {
+		node = client.String()
+	}
+
+	switch hh.xForwardedFor {
+	case config.HeaderAdd:
+		appendHeader(h, fasthttp.HeaderXForwardedFor, node)
+	case config.HeaderAnonymize:
+		appendHeader(h, fasthttp.HeaderXForwardedFor, "unknown")
+	case config.HeaderSuppress:
+		h.Del(fasthttp.HeaderXForwardedFor)
+	}
+
+	// IPv6 addresses have to be enclosed in brackets, which requires quoting (RFC 7239 6)
+	if client != nil && client.To4() == nil {
+		node = "[" + node + "]"
+	}
+
+	switch hh.forwarded {
+	case config.HeaderAdd:
+		appendHeader(h, fasthttp.HeaderForwarded, forwardedElement(node, proto, host))
+	case config.HeaderAnonymize:
+		appendHeader(h, fasthttp.HeaderForwarded, forwardedElement("unknown", proto, host))
+	case config.HeaderSuppress:
+		h.Del(fasthttp.HeaderForwarded)
+	}
+}
+
+// Response prepares the header of a response that is passed on to the client, which already had its hop-by-hop
+// headers stripped.
+func (hh *hopHeaders) Response(h *fasthttp.ResponseHeader) {
+	switch hh.via {
+	case config.HeaderAdd:
+		// fasthttp only reads HTTP/1.x responses, which are passed on as HTTP/1.1
+		appendHeader(h, fasthttp.HeaderVia, "1.1 "+hh.pseudonym)
+	case config.HeaderSuppress:
+		h.Del(fasthttp.HeaderVia)
+	}
+}
+
+// appendHeader adds value to the comma separated list of the header, where repeated fields are combined into one.
+func appendHeader(h header, key string, value string) {
+	var values []string
+	h.VisitAll(func(k, v []byte) {
+		if string(k) == key {
+			values = append(values, string(v))
+		}
+	})
+	h.Set(key, strings.Join(append(values, value), ", "))
+}
+
+// viaVersion returns the received protocol as expected by Via, where the name is omitted for HTTP.
+func viaVersion(protocol []byte) string {
+	return strings.TrimPrefix(string(protocol), "HTTP/")
+}
+
+// forwardedElement builds a forwarded-element, where values are quoted unless they are a token.
+func forwardedElement(node string, proto string, host string) string {
+	element := "for=" + forwardedValue(node)
+	if len(host) > 0 {
+		element += ";host=" + forwardedValue(host)
+	}
+	return element + ";proto=" + forwardedValue(proto)
+}
+
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// isTokenChar reports whether c is a tchar (RFC 7230 3.2.6).
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestStripHopByHop(t *testing.T) {
+	t.Run("response", func(t *testing.T) {
+		var header fasthttp.ResponseHeader
+		header.Set("Connection", "keep-alive, X-Session")
+		header.Set("Keep-Alive", "timeout=5")
+		header.Set("Proxy-Authenticate", "Basic")
+		header.Set("Upgrade", "h2c")
+		header.Set("X-Session", "abc")
+		header.Set("Cache-Control", "no-cache")
+
+		stripHopByHop(&header)
+
+		for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Upgrade", "X-Session"} {
+			assert.Empty(t, header.Peek(name), "should strip %s", name)
+		}
+		assert.Equal(t, "no-cache", string(header.Peek("Cache-Control")), "should keep end-to-end headers")
+	})
+
+	t.Run("request", func(t *testing.T) {
+		var header fasthttp.RequestHeader
+		header.Set("Connection", "X-Trace")
+		header.Set("Proxy-Authorization", "Basic Y2k6c2VjcmV0")
+		header.Set("Proxy-Connection", "keep-alive")
+		header.Set("TE", "trailers")
+		header.Set("X-Trace", "1")
+		header.Set("Accept", "text/html")
+
+		stripHopByHop(&header)
+
+		for _, name := range []string{"Connection", "Proxy-Authorization", "Proxy-Connection", "TE", "X-Trace"} {
+			assert.Empty(t, header.Peek(name), "should strip %s", name)
+		}
+		assert.Equal(t, "text/html", string(header.Peek("Accept")), "should keep end-to-end headers")
+	})
+}
+
+func TestHopHeaders_Request(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     config.Headers
+		client   net.IP
+		existing map[string]string
+
+		wanted map[string]string
+	}{
+		{
+			name:   "adds all headers",
+			conf:   config.Headers{Via: config.HeaderAdd, XForwardedFor: config.HeaderAdd, Forwarded: config.HeaderAdd, Pseudonym: "spediteur"},
+			client: net.ParseIP("192.168.10.4"),
+			wanted: map[string]string{"Via": "1.1 spediteur", "X-Forwarded-For": "192.168.10.4", "Forwarded": `for=192.168.10.4;host="example.com:8080";proto=http`},
+		},
+		{
+			name:     "appends to previous hops",
+			conf:     config.Headers{Via: config.HeaderAdd, XForwardedFor: config.HeaderAdd, Forwarded: config.HeaderAdd, Pseudonym: "spediteur"},
+			client:   net.ParseIP("2001:db8::1"),
+			existing: map[string]string{"Via": "1.0 edge", "X-Forwarded-For": "10.0.0.1", "Forwarded": "for=10.0.0.1"},
+			wanted:   map[string]string{"Via": "1.0 edge, 1.1 spediteur", "X-Forwarded-For": "10.0.0.1, 2001:db8::1", "Forwarded": `for=10.0.0.1, for="[2001:db8::1]";host="example.com:8080";proto=http`},
+		},
+		{
+			name:     "anonymizes the client",
+			conf:     config.Headers{Via: config.HeaderAdd, XForwardedFor: config.HeaderAnonymize, Forwarded: config.HeaderAnonymize, Pseudonym: "spediteur"},
+			client:   net.ParseIP("192.168.10.4"),
+			existing: map[string]string{"X-Forwarded-For": "10.0.0.1"},
+			wanted:   map[string]string{"Via": "1.1 spediteur", "X-Forwarded-For": "10.0.0.1, unknown", "Forwarded": `for=unknown;host="example.com:8080";proto=http`},
+		},
+		{
+			name:     "suppresses all headers",
+			conf:     config.Headers{Via: config.HeaderSuppress, XForwardedFor: config.HeaderSuppress, Forwarded: config.HeaderSuppress, Pseudonym: "spediteur"},
+			client:   net.ParseIP("192.168.10.4"),
+			existing: map[string]string{"Via": "1.0 edge", "X-Forwarded-For": "10.0.0.1", "Forwarded": "for=10.0.0.1"},
+			wanted:   map[string]string{"Via": "", "X-Forwarded-For": "", "Forwarded": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header fasthttp.RequestHeader
+			for key, value := range tt.existing {
+				header.Set(key, value)
+			}
+
+			newHopHeaders(tt.conf).Request(&header, tt.client, "http", "example.com:8080")
+
+			for key, value := range tt.wanted {
+				assert.Equal(t, value, string(header.Peek(key)), "unexpected %s", key)
+			}
+		})
+	}
+}
+
+func TestForwardHandler_HopHeaders(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations: loopbackAllowed,
+		Headers:      config.Headers{Via: config.HeaderAdd, XForwardedFor: config.HeaderSuppress, Forwarded: config.HeaderAnonymize, Pseudonym: "spediteur"},
+	}
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	received := make(chan http.Header, 1)
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Via", "1.1 origin-cache")
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "X-Trace")
+	req.Header.Set("X-Trace", "1")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err, "should not throw error")
+	defer resp.Body.Close()
+
+	header := <-received
+	assert.Empty(t, header.Get("X-Trace"), "should strip headers listed by Connection")
+	assert.Empty(t, header.Get("Proxy-Connection"), "should strip hop-by-hop headers")
+	assert.Empty(t, header.Get("X-Forwarded-For"), "should suppress X-Forwarded-For")
+	assert.Equal(t, "1.1 spediteur", header.Get("Via"))
+	assert.Equal(t, `for=unknown;host="`+srv.Listener.Addr().String()+`";proto=http`, header.Get("Forwarded"))
+
+	assert.Equal(t, "1.1 origin-cache, 1.1 spediteur", resp.Header.Get("Via"), "should announce the hop towards the client")
+}
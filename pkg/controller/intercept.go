@@ -0,0 +1,350 @@
+package controller
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// mintedValidity is how long minted certificates are valid, unless the CA expires earlier.
+const mintedValidity = 7 * 24 * time.Hour
+
+// certMinter signs certificates for server names on the fly, where the most recently used ones are kept in memory.
+type certMinter struct {
+	ca   tls.Certificate
+	size int
+
+	mu    sync.Mutex
+	certs map[string]*list.Element
+	order *list.List
+}
+
+type mintedCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertMinter(conf config.Interception) *certMinter {
+	// config.LoadCA is already called during validation, hence an error is impossible at this location
+	ca, _ := config.LoadCA(conf.CACertFile, conf.CAKeyFile)
+
+	return &certMinter{ca: ca, size: conf.CacheSize, certs: make(map[string]*list.Element), order: list.New()}
+}
+
+// Certificate returns a certificate for host, which is minted if none is cached or the cached one is about to expire.
+// Clients only check the certificate during the handshake, hence it merely has to outlast the handshake.
+func (m *certMinter) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	m.mu.Lock()
+	if elem, found := m.certs[host]; found {
+		cert := elem.Value.(*mintedCert).cert
+		if time.Now().Add(time.Minute).Before(cert.Leaf.NotAfter) {
+			m.order.MoveToFront(elem)
+			m.mu.Unlock()
+			metrics.InterceptionCertificates.WithLabelValues(metrics.CertificateCached).Inc()
+			return cert, nil
+		}
+	}
+	m.mu.Unlock()
+
+	cert, err := m.mint(host)
+	if err != nil {
+		return nil, err
+	}
+	metrics.InterceptionCertificates.WithLabelValues(metrics.CertificateMinted).Inc()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, found := m.certs[host]; found {
+		elem.Value.(*mintedCert).cert = cert
+		m.order.MoveToFront(elem)
+		return cert, nil
+	}
+
+	m.certs[host] = m.order.PushFront(&mintedCert{host: host, cert: cert})
+	m.evict()
+	return cert, nil
+}
+
+// Resize changes how many certificates are kept, where the least recently used ones are evicted beyond the size.
+func (m *certMinter) Resize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.size = size
+	m.evict()
+}
+
+// evict drops the least recently used certificates beyond the size, where the caller has to hold the lock.
+func (m *certMinter) evict() {
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.certs, oldest.Value.(*mintedCert).host)
+	}
+}
+
+// Len returns the number of cached certificates.
+func (m *certMinter) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+func (m *certMinter) mint(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating key for %s: %w", host, err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed generating serial for %s: %w", host, err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		// Tolerates clients whose clock is slightly behind
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(mintedValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(m.ca.Leaf.NotAfter) {
+		template.NotAfter = m.ca.Leaf.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca.Leaf, &key.PublicKey, m.ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed signing certificate for %s: %w", host, err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing certificate for %s: %w", host, err)
+	}
+
+	// The chain of the CA is sent along, so clients only need to trust its root
+	return &tls.Certificate{Certificate: append([][]byte{der}, m.ca.Certificate...), PrivateKey: key, Leaf: leaf}, nil
+}
+
+// interception decides which tunnels are intercepted and provides the certificates to do so.
+type interception struct {
+	domains *domainList
+	minter  *certMinter
+}
+
+func newInterception(conf config.Interception) *interception {
+	i := &interception{domains: newDomainList(conf.Domains)}
+	if !i.domains.Empty() {
+		i.minter = newCertMinter(conf)
+	}
+	return i
+}
+
+// Inherit takes over the minter of previous if it signs with the same CA, so the certificates that were minted so far
+// survive reloads.
+func (i *interception) Inherit(previous *interception) {
+	if i.minter == nil || previous == nil || previous.minter == nil || !sameChain(i.minter.ca, previous.minter.ca) {
+		return
+	}
+
+	previous.minter.Resize(i.minter.size)
+	i.minter = previous.minter
+}
+
+func sameChain(a tls.Certificate, b tls.Certificate) bool {
+	if len(a.Certificate) != len(b.Certificate) {
+		return false
+	}
+	for i := range a.Certificate {
+		if !bytes.Equal(a.Certificate[i], b.Certificate[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether tunnels towards host are intercepted.
+func (i *interception) Matches(host string) bool {
+	return i.minter != nil && i.domains.Matches(host)
+}
+
+// interceptedConn is the decrypted connection of an intercepted tunnel, which carries what is known about the
+// tunnel towards the requests that are read from it.
+type interceptedConn struct {
+	*tls.Conn
+	target string
+	user   string
+}
+
+// countingConn counts the bytes that pass through the connection. It must only be used by a single goroutine.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+func newInterceptServer(conf *config.ForwardProxyConfig, h *ForwardHandler) *fasthttp.Server {
+	// time.ParseDuration is already called during validation, hence an error is impossible at this location
+	readTimeout, _ := time.ParseDuration(conf.Proxy.Timeouts.Read)
+	writeTimeout, _ := time.ParseDuration(conf.Proxy.Timeouts.Write)
+
+	return &fasthttp.Server{
+		Handler:            h.handleIntercepted,
+		ReadBufferSize:     conf.Proxy.BufferSizes.Read,
+		WriteBufferSize:    conf.Proxy.BufferSizes.Write,
+		ReadTimeout:        readTimeout,
+		WriteTimeout:       writeTimeout,
+		IdleTimeout:        readTimeout,
+		MaxRequestBodySize: conf.Proxy.Limits.MaxBodySize,
+		Logger:             log.StandardLogger(),
+	}
+}
+
+// intercept terminates TLS of the tunnel towards target using a minted certificate and serves the decrypted
+// requests. The tunnel is logged once the client closes it, while each request is logged on its own. Release frees
+// the concurrency slots of the tunnel once it terminated.
+func (h *ForwardHandler) intercept(ctx *fasthttp.RequestCtx, in *interception, target string, deadline time.Time, release func()) {
+	rl := requestLogOf(ctx)
+	user := User(ctx)
+	metrics.InterceptedTunnels.Inc()
+
+	ctx.Hijack(func(origin net.Conn) {
+		shaped := h.shaper.Open()
+		defer h.shaper.Close(shaped)
+
+		// The encrypted bytes are shaped and rate limited, just like those of relayed tunnels
+		limited, releaseLimits := h.limits.Bandwidth(rl.ClientIP, user, strings.ToLower(hostOf(target)))
+		defer releaseLimits()
+		counted := &countingConn{Conn: &throttledConn{
+			Conn:     origin,
+			upload:   append([]*tokenBucket{h.shaper.upload, shaped.upload}, limited...),
+			download: append([]*tokenBucket{h.shaper.download, shaped.download}, limited...),
+		}}
+		conn := tls.Server(counted, &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				// Certificates are only minted for the destination of the tunnel, which clients connecting to an IP
+				// address do not indicate as server name
+				if len(hello.ServerName) > 0 && !strings.EqualFold(hello.ServerName, hostOf(target)) {
+					return nil, fmt.Errorf("server name %s does not match tunnel towards %s", hello.ServerName, target)
+				}
+				return in.minter.Certificate(hostOf(target))
+			},
+		})
+
+		t := &tunnel{target: target, origin: conn, release: release}
+		defer t.done()
+
+		if !h.tunnels.Register(t) {
+			log.Debugf("intercept: closing tunnel towards %s as the proxy is shutting down", target)
+			t.close()
+			rl.reject(accesslog.ReasonShutdown)
+			h.logAccess(rl)
+			return
+		}
+		defer h.tunnels.Unregister(t)
+
+		opened := time.Now()
+		metrics.ActiveTunnels.Inc()
+		defer func() {
+			metrics.ActiveTunnels.Dec()
+			metrics.TunnelDuration.Observe(time.Since(opened).Seconds())
+		}()
+
+		defer t.close()
+		_ = conn.SetDeadline(deadline)
+
+		err := conn.Handshake()
+		if err != nil {
+			metrics.Errors.WithLabelValues(metrics.ErrorInterception).Inc()
+			log.Warnf("intercept: tls handshake with %s for %s failed due to %s", rl.ClientIP, target, err)
+		} else {
+			err = h.interceptServer.ServeConn(&interceptedConn{Conn: conn, target: target, user: user})
+		}
+
+		rl.BytesUp, rl.BytesDown = counted.read, counted.written
+		rl.Reason = tunnelReason(t, err)
+		h.logAccess(rl)
+	})
+}
+
+// handleIntercepted handles the decrypted requests of an intercepted tunnel. They pass through the same checks as
+// forwarded requests, apart from the client and its authentication, which were already checked for the tunnel.
+func (h *ForwardHandler) handleIntercepted(ctx *fasthttp.RequestCtx) {
+	conn := ctx.Conn().(*interceptedConn)
+	ctx.SetUserValue(UserKey, conn.user)
+
+	// Requests must not leave the tunnel towards another destination than the one the client connected to, where
+	// clients omit the port within Host if it is the default one, hence the port of the tunnel applies
+	host, port, _ := net.SplitHostPort(conn.target)
+	requestPort := port
+	_, explicitPort, err := net.SplitHostPort(string(ctx.Host()))
+	if err == nil {
+		requestPort = explicitPort
+	}
+	misdirected := !strings.EqualFold(hostOf(string(ctx.Host())), host) || requestPort != port
+
+	// The tunnel may lead to another port than the default one, which the forwarded request has to name
+	if err != nil && !misdirected && port != "443" {
+		ctx.Request.SetHost(conn.target)
+		ctx.Request.Header.SetHost(conn.target)
+	}
+
+	rl := newRequestLog(ctx, time.Now())
+	defer h.finish(ctx, rl, metrics.TypeProxy)
+
+	if misdirected {
+		metrics.Errors.WithLabelValues(metrics.ErrorInterception).Inc()
+		log.Warnf("intercept: rejected request of %s towards %s within tunnel towards %s", ctx.RemoteIP(), ctx.Host(), conn.target)
+		rl.reject(accesslog.ReasonPolicyDenied)
+		ctx.Error(fmt.Sprintf("request towards %s does not belong to tunnel towards %s", ctx.Host(), conn.target), fasthttp.StatusMisdirectedRequest)
+		return
+	}
+
+	s := h.current()
+	if !h.authorize(ctx, s, rl) {
+		return
+	}
+
+	h.Proxy(ctx, time.Now().Add(s.deadlineDuration))
+}
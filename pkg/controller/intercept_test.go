@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestCertMinter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	ca := issueCertificate(t, dir, "interception.test", true, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	minter := newCertMinter(config.Interception{CACertFile: ca.certFile, CAKeyFile: ca.keyFile, CacheSize: 2})
+
+	t.Run("mints certificates signed by the ca", func(t *testing.T) {
+		for _, host := range []string{"www.example.com", "10.0.0.1"} {
+			cert, err := minter.Certificate(host)
+			assert.NoError(t, err, "should not fail minting")
+
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+			assert.NoError(t, err, "should be valid for %s", host)
+			assert.False(t, cert.Leaf.NotAfter.After(ca.cert.NotAfter), "should not outlive the ca")
+		}
+	})
+
+	t.Run("caches certificates", func(t *testing.T) {
+		first, _ := minter.Certificate("cached.example.com")
+		second, _ := minter.Certificate("CACHED.example.com")
+
+		assert.Same(t, first, second)
+	})
+
+	t.Run("evicts least recently used certificates", func(t *testing.T) {
+		first, _ := minter.Certificate("a.example.com")
+		_, _ = minter.Certificate("b.example.com")
+		_, _ = minter.Certificate("a.example.com")
+		_, _ = minter.Certificate("c.example.com")
+		assert.Equal(t, 2, minter.Len())
+
+		again, _ := minter.Certificate("a.example.com")
+		assert.Same(t, first, again, "should keep recently used certificates")
+
+		_, _ = minter.Certificate("b.example.com")
+		assert.Equal(t, 2, minter.Len())
+	})
+
+	t.Run("keeps certificates across reloads", func(t *testing.T) {
+		conf := config.Interception{Domains: []string{"*.example.com"}, CACertFile: ca.certFile, CAKeyFile: ca.keyFile, CacheSize: 2}
+		previous := newInterception(conf)
+		minted, _ := previous.minter.Certificate("www.example.com")
+
+		conf.CacheSize = 1
+		reloaded := newInterception(conf)
+		reloaded.Inherit(previous)
+		cached, _ := reloaded.minter.Certificate("www.example.com")
+		assert.Same(t, minted, cached, "should keep the minted certificates")
+		assert.Equal(t, 1, reloaded.minter.size, "should apply the new cache size")
+
+		other := issueCertificate(t, dir, "other.test", true, nil)
+		rotated := newInterception(config.Interception{Domains: conf.Domains, CACertFile: other.certFile, CAKeyFile: other.keyFile, CacheSize: 2})
+		rotated.Inherit(reloaded)
+		assert.Equal(t, 0, rotated.minter.Len(), "should drop certificates of another ca")
+	})
+}
+
+func TestForwardHandler_Intercept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	received := make(chan http.Header, 10)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		_, _ = io.WriteString(w, "<html><body>Hello "+r.Method+"!</body></html>")
+	}))
+	defer srv.Close()
+
+	upstreamCA := filepath.Join(dir, "upstream.pem")
+	_ = ioutil.WriteFile(upstreamCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	upstreamRoots := x509.NewCertPool()
+	upstreamRoots.AddCert(srv.Certificate())
+
+	ca := issueCertificate(t, dir, "interception.test", true, nil)
+	interceptionRoots := x509.NewCertPool()
+	interceptionRoots.AddCert(ca.cert)
+
+	start := func(t *testing.T, domains []string, limits config.RateLimits) *fasthttputil.InmemoryListener {
+		conf := config.ForwardProxyConfig{
+			Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+			Destinations: loopbackAllowed,
+			Headers:      config.Headers{Via: config.HeaderAdd, Pseudonym: "spediteur"},
+			Policy:       config.Policy{Default: config.ActionAllow, Rules: []config.Rule{{Name: "read only", Action: config.ActionDeny, Methods: []string{http.MethodPost}}}},
+			UpstreamTLS:  config.UpstreamTLS{TLSSettings: config.TLSSettings{CAFile: upstreamCA}},
+			Interception: config.Interception{Domains: domains, CACertFile: ca.certFile, CAKeyFile: ca.keyFile, CacheSize: 10},
+			RateLimits:   limits,
+		}
+
+		h := NewForwardHandler(&conf)
+		ln := fasthttputil.NewInmemoryListener()
+		go func() {
+			_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+		}()
+		return ln
+	}
+
+	clientOf := func(ln *fasthttputil.InmemoryListener, roots *x509.CertPool) *http.Client {
+		proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+		return &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	t.Run("forwards decrypted requests through the proxy pipeline", func(t *testing.T) {
+		ln := start(t, []string{"127.0.0.1"}, config.RateLimits{})
+		defer ln.Close()
+		client := clientOf(ln, interceptionRoots)
+
+		intercepted := testutil.ToFloat64(metrics.InterceptedTunnels)
+
+		resp, err := client.Get(srv.URL + "/inspect")
+		assert.NoError(t, err, "should trust the minted certificate")
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "<html><body>Hello GET!</body></html>", string(body))
+		assert.Equal(t, "1.1 spediteur", resp.Header.Get("Via"), "should pass the response through the pipeline")
+		assert.Equal(t, "1.1 spediteur", (<-received).Get("Via"), "should pass the request through the pipeline")
+		assert.Equal(t, intercepted+1, testutil.ToFloat64(metrics.InterceptedTunnels))
+
+		resp, err = client.Post(srv.URL+"/inspect", "text/plain", strings.NewReader("payload"))
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should apply policies to decrypted requests")
+	})
+
+	t.Run("throttles the bandwidth of intercepted tunnels", func(t *testing.T) {
+		ln := start(t, []string{"127.0.0.1"}, config.RateLimits{Clients: config.RateLimit{BytesPerSecond: 1024, ByteBurst: 1024}})
+		defer ln.Close()
+
+		start := time.Now()
+		resp, err := clientOf(ln, interceptionRoots).Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		<-received
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		// The handshake alone exceeds the burst of the client
+		assert.True(t, time.Since(start) >= 500*time.Millisecond, "should take longer than the burst allows")
+	})
+
+	t.Run("relays other tunnels blindly", func(t *testing.T) {
+		ln := start(t, []string{"*.example.com"}, config.RateLimits{})
+		defer ln.Close()
+
+		resp, err := clientOf(ln, upstreamRoots).Get(srv.URL)
+		assert.NoError(t, err, "should present the certificate of the upstream")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Via"), "should not look into the tunnel")
+		<-received
+	})
+
+	t.Run("rejects requests towards other hosts", func(t *testing.T) {
+		ln := start(t, []string{"127.0.0.1"}, config.RateLimits{})
+		defer ln.Close()
+
+		raw, err := ln.Dial()
+		assert.NoError(t, err, "should not fail dialing")
+		defer raw.Close()
+
+		target := srv.Listener.Addr().String()
+		_, _ = fmt.Fprintf(raw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		established, err := http.ReadResponse(bufio.NewReader(raw), nil)
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, http.StatusOK, established.StatusCode)
+
+		conn := tls.Client(raw, &tls.Config{ServerName: "127.0.0.1", RootCAs: interceptionRoots})
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: other.example.com\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	})
+
+	t.Run("rejects requests towards other ports", func(t *testing.T) {
+		ln := start(t, []string{"127.0.0.1"}, config.RateLimits{})
+		defer ln.Close()
+
+		raw, err := ln.Dial()
+		assert.NoError(t, err, "should not fail dialing")
+		defer raw.Close()
+
+		target := srv.Listener.Addr().String()
+		_, _ = fmt.Fprintf(raw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		established, err := http.ReadResponse(bufio.NewReader(raw), nil)
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, http.StatusOK, established.StatusCode)
+
+		conn := tls.Client(raw, &tls.Config{ServerName: "127.0.0.1", RootCAs: interceptionRoots})
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: 127.0.0.1:9999\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	})
+
+	t.Run("rejects other server names", func(t *testing.T) {
+		ln := start(t, []string{"127.0.0.1"}, config.RateLimits{})
+		defer ln.Close()
+
+		raw, err := ln.Dial()
+		assert.NoError(t, err, "should not fail dialing")
+		defer raw.Close()
+
+		target := srv.Listener.Addr().String()
+		_, _ = fmt.Fprintf(raw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		established, err := http.ReadResponse(bufio.NewReader(raw), nil)
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, http.StatusOK, established.StatusCode)
+
+		conn := tls.Client(raw, &tls.Config{ServerName: "www.example.com", RootCAs: interceptionRoots})
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		assert.Error(t, conn.Handshake(), "should not mint certificates for other names")
+	})
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/valyala/fasthttp"
+)
+
+// ListenerTLS terminates TLS on the proxy listener. Reload swaps certificates and client CAs for subsequent
+// handshakes, while established connections keep the ones they were accepted with.
+type ListenerTLS struct {
+	conf    config.ListenerTLS
+	current atomic.Value
+
+	// conns holds the TCP connections of the listener by their addresses. fasthttp hides connections that it counts
+	// towards MaxConnsPerIP behind a wrapper of its own, which only passes the addresses on.
+	conns sync.Map
+}
+
+// NewListenerTLS loads the certificates of conf, which has to be enabled.
+func NewListenerTLS(conf config.ListenerTLS) (*ListenerTLS, error) {
+	l := &ListenerTLS{conf: conf}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the certificate files again. The current certificates are kept if any of them is invalid.
+func (l *ListenerTLS) Reload() error {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	for _, files := range l.conf.Certificates {
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed loading certificate %s: %w", files.CertFile, err)
+		}
+
+		// Parsing the leaf once spares doing it during every handshake that selects a certificate by its names
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed parsing certificate %s: %w", files.CertFile, err)
+		}
+		conf.Certificates = append(conf.Certificates, cert)
+	}
+
+	if len(l.conf.ClientCAFile) > 0 {
+		pool, err := config.LoadCertPool(l.conf.ClientCAFile, false)
+		if err != nil {
+			return fmt.Errorf("failed loading client ca file %s: %w", l.conf.ClientCAFile, err)
+		}
+		conf.ClientCAs = pool
+	}
+
+	switch l.conf.ClientAuth {
+	case config.ClientAuthOptional:
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case config.ClientAuthRequire:
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if version, found := config.TLSVersions[l.conf.MinVersion]; found {
+		conf.MinVersion = version
+	}
+
+	l.current.Store(conf)
+	return nil
+}
+
+// Files returns the paths of all files that are loaded by Reload.
+func (l *ListenerTLS) Files() []string {
+	var files []string
+	for _, pair := range l.conf.Certificates {
+		files = append(files, pair.CertFile, pair.KeyFile)
+	}
+	if len(l.conf.ClientCAFile) > 0 {
+		files = append(files, l.conf.ClientCAFile)
+	}
+	return files
+}
+
+// Listener wraps inner, so accepted connections are served through TLS. Among multiple certificates the first one
+// that supports the server name indicated by the client is presented.
+func (l *ListenerTLS) Listener(inner net.Listener) net.Listener {
+	return &tlsListener{owner: l, Listener: tls.NewListener(inner, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.current.Load().(*tls.Config), nil
+		},
+	})}
+}
+
+// tlsListener hands out its connections as tlsConn, so the TLS state of each of them can be found for every request.
+type tlsListener struct {
+	net.Listener
+	owner *ListenerTLS
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &tlsConn{Conn: c.(*tls.Conn), owner: l.owner}
+	// Only TCP connections are unique by their addresses, while fasthttp wraps no others
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		conn.key = connKey(conn.LocalAddr(), conn.RemoteAddr())
+		l.owner.conns.Store(conn.key, conn)
+	}
+	return conn, nil
+}
+
+// tlsConn is a connection accepted by a tlsListener, which is forgotten by its owner once it is closed.
+type tlsConn struct {
+	*tls.Conn
+	owner *ListenerTLS
+	key   string
+	once  sync.Once
+}
+
+func (c *tlsConn) Close() error {
+	c.once.Do(func() {
+		if len(c.key) > 0 {
+			c.owner.conns.Delete(c.key)
+		}
+	})
+	return c.Conn.Close()
+}
+
+func connKey(local net.Addr, remote net.Addr) string {
+	return local.String() + "-" + remote.String()
+}
+
+// SetListenerTLS tells the handler about the listener its requests arrive through, so clients can be identified by
+// their certificates. It must be called before the handler starts serving requests.
+func (h *ForwardHandler) SetListenerTLS(l *ListenerTLS) {
+	h.listenerTLS = l
+}
+
+// clientIdentity returns the common name of the verified client certificate or an empty string if the client did
+// not present one.
+func (h *ForwardHandler) clientIdentity(ctx *fasthttp.RequestCtx) string {
+	var state tls.ConnectionState
+	if conn, ok := ctx.Conn().(*tlsConn); ok {
+		state = conn.ConnectionState()
+	} else if s := ctx.TLSConnectionState(); s != nil {
+		state = *s
+	} else if h.listenerTLS != nil {
+		if conn, found := h.listenerTLS.conns.Load(connKey(ctx.LocalAddr(), ctx.RemoteAddr())); found {
+			state = conn.(*tlsConn).ConnectionState()
+		}
+	}
+
+	// Only certificates that were verified against the client CAs have verified chains
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,289 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// issueCertificate writes a certificate for name into dir, which is signed by issuer or self-signed if issuer is nil.
+func issueCertificate(t *testing.T, dir string, name string, isCA bool, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "should not fail generating key")
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	parent, parentKey := template, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err, "should not fail creating certificate")
+	cert, _ := x509.ParseCertificate(der)
+	rawKey, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+
+	return &testCertificate{cert: cert, key: key, certFile: certFile, keyFile: keyFile}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func (c *testCertificate) files() config.CertificateFiles {
+	return config.CertificateFiles{CertFile: c.certFile, KeyFile: c.keyFile}
+}
+
+// presentedName returns the common name of the certificate the listener presents for serverName.
+func presentedName(t *testing.T, l *ListenerTLS, serverName string) string {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	tlsLn := l.Listener(ln)
+
+	go func() {
+		conn, err := tlsLn.Accept()
+		if err == nil {
+			_ = conn.(*tlsConn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	raw, err := ln.Dial()
+	assert.NoError(t, err, "should not fail dialing")
+	conn := tls.Client(raw, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	defer conn.Close()
+
+	err = conn.Handshake()
+	assert.NoError(t, err, "should not fail handshake")
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestListenerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	alpha := issueCertificate(t, dir, "alpha.test", false, nil)
+	beta := issueCertificate(t, dir, "beta.test", false, nil)
+
+	l, err := NewListenerTLS(config.ListenerTLS{Certificates: []config.CertificateFiles{alpha.files(), beta.files()}})
+	assert.NoError(t, err, "should not fail loading certificates")
+
+	t.Run("selects certificate by server name", func(t *testing.T) {
+		assert.Equal(t, "alpha.test", presentedName(t, l, "alpha.test"))
+		assert.Equal(t, "beta.test", presentedName(t, l, "beta.test"))
+	})
+
+	t.Run("falls back to first certificate", func(t *testing.T) {
+		assert.Equal(t, "alpha.test", presentedName(t, l, "unknown.test"))
+	})
+
+	t.Run("keeps certificates if reloading fails", func(t *testing.T) {
+		_ = ioutil.WriteFile(beta.keyFile, []byte("broken"), 0600)
+
+		err := l.Reload()
+		assert.Error(t, err, "should fail reloading")
+		assert.Equal(t, "beta.test", presentedName(t, l, "beta.test"))
+	})
+
+	t.Run("presents replaced certificates after reload", func(t *testing.T) {
+		gamma := issueCertificate(t, dir, "gamma.test", false, nil)
+		_ = os.Rename(gamma.certFile, beta.certFile)
+		_ = os.Rename(gamma.keyFile, beta.keyFile)
+
+		err := l.Reload()
+		assert.NoError(t, err, "should not fail reloading")
+		assert.Equal(t, "gamma.test", presentedName(t, l, "gamma.test"))
+	})
+
+	t.Run("lists all files", func(t *testing.T) {
+		withCA, _ := NewListenerTLS(config.ListenerTLS{Certificates: []config.CertificateFiles{alpha.files()}, ClientCAFile: alpha.certFile})
+		assert.Equal(t, []string{alpha.certFile, alpha.keyFile, alpha.certFile}, withCA.Files())
+	})
+}
+
+func TestForwardHandler_ClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	ca := issueCertificate(t, dir, "clients.test", true, nil)
+	agent := issueCertificate(t, dir, "agent-1", false, ca)
+	stranger := issueCertificate(t, dir, "agent-2", false, nil)
+	proxy := issueCertificate(t, dir, "proxy.test", false, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(proxy.cert)
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Authorization", r.Header.Get("Proxy-Authorization"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		cert       *testCertificate
+
+		wantedStatus    int
+		wantedHandshake bool
+	}{
+		{name: "identifies client by certificate", clientAuth: config.ClientAuthOptional, cert: agent, wantedStatus: fasthttp.StatusOK, wantedHandshake: true},
+		{name: "falls back to anonymous clients", clientAuth: config.ClientAuthOptional, wantedStatus: fasthttp.StatusForbidden, wantedHandshake: true},
+		{name: "rejects unknown certificates", clientAuth: config.ClientAuthOptional, cert: stranger},
+		{name: "requires certificate", clientAuth: config.ClientAuthRequire},
+		{name: "accepts required certificate", clientAuth: config.ClientAuthRequire, cert: agent, wantedStatus: fasthttp.StatusOK, wantedHandshake: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.ForwardProxyConfig{
+				Proxy: config.Proxy{
+					Timeouts:    config.Timeouts{Connect: "30s", Write: "30s"},
+					BufferSizes: config.BufferSizes{Read: 1024, Write: 1024},
+					TLS:         config.ListenerTLS{Certificates: []config.CertificateFiles{proxy.files()}, ClientCAFile: ca.certFile, ClientAuth: tt.clientAuth},
+				},
+				Destinations: loopbackAllowed,
+				Policy: config.Policy{Default: config.ActionDeny, Rules: []config.Rule{
+					{Name: "agents", Action: config.ActionAllow, Users: []string{"agent-1"}},
+				}},
+			}
+
+			l, err := NewListenerTLS(conf.Proxy.TLS)
+			assert.NoError(t, err, "should not fail loading certificates")
+
+			h := NewForwardHandler(&conf)
+			h.SetListenerTLS(l)
+			ln := fasthttputil.NewInmemoryListener()
+			defer ln.Close()
+
+			go func() {
+				_ = fasthttp.Serve(l.Listener(ln), h.HandleFastHTTP)
+			}()
+
+			clientConf := &tls.Config{ServerName: "proxy.test", RootCAs: roots}
+			if tt.cert != nil {
+				// Otherwise certificates of foreign issuers are not even presented
+				cert := tt.cert.tlsCertificate()
+				clientConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+
+			raw, err := ln.Dial()
+			assert.NoError(t, err, "should not fail dialing")
+			conn := tls.Client(raw, clientConf)
+			defer conn.Close()
+
+			host := srv.Listener.Addr().String()
+			_, _ = fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n\r\n", host, host)
+
+			// TLS 1.3 clients only learn about a rejected certificate once they read
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if !tt.wantedHandshake {
+				assert.Error(t, err, "should fail handshake")
+				return
+			}
+			assert.NoError(t, err, "should not throw error")
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantedStatus, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("X-Proxy-Authorization"), "should not forward credentials")
+		})
+	}
+
+	t.Run("identifies clients of connections limited per ip", func(t *testing.T) {
+		conf := config.ForwardProxyConfig{
+			Proxy: config.Proxy{
+				Timeouts:    config.Timeouts{Connect: "30s", Write: "30s"},
+				BufferSizes: config.BufferSizes{Read: 1024, Write: 1024},
+				Limits:      config.Limits{MaxConnsPerIP: 10},
+				TLS:         config.ListenerTLS{Certificates: []config.CertificateFiles{proxy.files()}, ClientCAFile: ca.certFile, ClientAuth: config.ClientAuthRequire},
+			},
+			Destinations: loopbackAllowed,
+			Policy: config.Policy{Default: config.ActionDeny, Rules: []config.Rule{
+				{Name: "agents", Action: config.ActionAllow, Users: []string{"agent-1"}},
+			}},
+		}
+
+		l, _ := NewListenerTLS(conf.Proxy.TLS)
+		h := NewForwardHandler(&conf)
+		h.SetListenerTLS(l)
+
+		// fasthttp only wraps connections with a TCP address to count them per ip
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.NoError(t, err, "should not fail listening")
+		defer ln.Close()
+
+		go func() {
+			server := &fasthttp.Server{Handler: h.HandleFastHTTP, MaxConnsPerIP: conf.Proxy.Limits.MaxConnsPerIP}
+			_ = server.Serve(l.Listener(ln))
+		}()
+
+		conn, err := tls.Dial("tcp4", ln.Addr().String(), &tls.Config{ServerName: "proxy.test", RootCAs: roots, Certificates: []tls.Certificate{agent.tlsCertificate()}})
+		assert.NoError(t, err, "should not fail dialing")
+		defer conn.Close()
+
+		host := srv.Listener.Addr().String()
+		_, _ = fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+
+		_ = conn.Close()
+		assert.Eventually(t, func() bool {
+			remaining := 0
+			l.conns.Range(func(key, value interface{}) bool {
+				remaining++
+				return true
+			})
+			return remaining == 0
+		}, time.Second, 5*time.Millisecond, "should forget closed connections")
+	})
+}
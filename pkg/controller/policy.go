@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/Templum/Spediteur/pkg/config"
+)
+
+// policyRequest contains everything the policy engine needs to know about a request.
+type policyRequest struct {
+	user string
+	host string
+	// lookup is the name of a reverse lookup if host is an IP address. As whoever owns an address controls its PTR
+	// record, it is only matched by deny rules.
+	lookup string
+	port   int
+	method string
+}
+
+// policyRule is the compiled form of a config.Rule, where groups are already resolved into their members.
+type policyRule struct {
+	name  string
+	allow bool
+	// scoped is set for rules that name users or groups, which only match their members even if there are none
+	scoped  bool
+	members map[string]struct{}
+	domains *domainList
+	ports   map[int]struct{}
+	methods map[string]struct{}
+}
+
+// policyEngine evaluates its rules in order, where the first matching rule decides about the request.
+type policyEngine struct {
+	rules        []policyRule
+	defaultAllow bool
+}
+
+func newPolicyEngine(conf config.Policy) *policyEngine {
+	engine := &policyEngine{defaultAllow: conf.Default != config.ActionDeny}
+
+	for _, rule := range conf.Rules {
+		compiled := policyRule{
+			name:    rule.Name,
+			allow:   rule.Action == config.ActionAllow,
+			scoped:  len(rule.Users) > 0 || len(rule.Groups) > 0,
+			members: make(map[string]struct{}),
+			domains: newDomainList(rule.Domains),
+			ports:   make(map[int]struct{}),
+			methods: make(map[string]struct{}),
+		}
+
+		for _, user := range rule.Users {
+			compiled.members[user] = struct{}{}
+		}
+
+		for _, group := range rule.Groups {
+			for _, user := range conf.Groups[group] {
+				compiled.members[user] = struct{}{}
+			}
+		}
+
+		for _, port := range rule.Ports {
+			compiled.ports[int(port)] = struct{}{}
+		}
+
+		for _, method := range rule.Methods {
+			compiled.methods[strings.ToUpper(method)] = struct{}{}
+		}
+
+		engine.rules = append(engine.rules, compiled)
+	}
+
+	return engine
+}
+
+// Evaluate reports whether the request is allowed and the name of the rule that decided it.
+// Requests that no rule matches are decided by the default action, which is reported as "default".
+func (p *policyEngine) Evaluate(req policyRequest) (bool, string) {
+	for _, rule := range p.rules {
+		if rule.matches(req) {
+			return rule.allow, rule.name
+		}
+	}
+
+	return p.defaultAllow, "default"
+}
+
+// matchesIdentity is true for rules without users and groups, which also covers anonymous requests. Rules naming
+// only empty groups match no one.
+func (r *policyRule) matchesIdentity(user string) bool {
+	if !r.scoped {
+		return true
+	}
+
+	_, found := r.members[user]
+	return len(user) > 0 && found
+}
+
+func (r *policyRule) matchesDestination(host string, lookup string) bool {
+	if r.domains.Empty() {
+		return true
+	}
+
+	return r.domains.Matches(host) || (!r.allow && len(lookup) > 0 && r.domains.Matches(lookup))
+}
+
+func (r *policyRule) matches(req policyRequest) bool {
+	if !r.matchesIdentity(req.user) || !r.matchesDestination(req.host, req.lookup) {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		if _, found := r.ports[req.port]; !found {
+			return false
+		}
+	}
+
+	if len(r.methods) > 0 {
+		if _, found := r.methods[strings.ToUpper(req.method)]; !found {
+			return false
+		}
+	}
+
+	return true
+}
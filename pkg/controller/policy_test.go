@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestPolicyEngine_Evaluate(t *testing.T) {
+	engine := newPolicyEngine(config.Policy{
+		Default: config.ActionDeny,
+		Groups:  map[string][]string{"ci": {"agent-1", "agent-2"}, "dev": {"alice", "bob"}, "ops": {}},
+		Rules: []config.Rule{
+			{Name: "ops everywhere", Action: config.ActionAllow, Groups: []string{"ops"}},
+			{Name: "ci registries", Action: config.ActionAllow, Groups: []string{"ci"}, Domains: []string{"*.github.com", "registry.npmjs.org"}},
+			{Name: "dev internal", Action: config.ActionDeny, Groups: []string{"dev"}, Domains: []string{"*.internal"}},
+			{Name: "dev", Action: config.ActionAllow, Groups: []string{"dev"}},
+			{Name: "ops ssh", Action: config.ActionAllow, Users: []string{"carol"}, Ports: []uint16{22}, Methods: []string{"connect"}},
+			{Name: "public docs", Action: config.ActionAllow, Domains: []string{"docs.example.com"}, Methods: []string{"GET"}},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		req      policyRequest
+		want     bool
+		wantRule string
+	}{
+		{name: "ci reaches github", req: policyRequest{user: "agent-1", host: "api.github.com", port: 443, method: "CONNECT"}, want: true, wantRule: "ci registries"},
+		{name: "ci reaches npm", req: policyRequest{user: "agent-2", host: "registry.npmjs.org", port: 443, method: "CONNECT"}, want: true, wantRule: "ci registries"},
+		{name: "ci is denied elsewhere", req: policyRequest{user: "agent-1", host: "example.com", port: 443, method: "CONNECT"}, want: false, wantRule: "default"},
+		{name: "dev is denied internal", req: policyRequest{user: "alice", host: "db.internal", port: 5432, method: "CONNECT"}, want: false, wantRule: "dev internal"},
+		{name: "dev reaches everything else", req: policyRequest{user: "bob", host: "example.com", port: 80, method: "GET"}, want: true, wantRule: "dev"},
+		{name: "reverse lookup name is matched", req: policyRequest{user: "alice", host: "10.0.0.5", lookup: "db.internal", port: 5432, method: "CONNECT"}, want: false, wantRule: "dev internal"},
+		{name: "reverse lookup name does not grant access", req: policyRequest{user: "agent-1", host: "203.0.113.7", lookup: "x.github.com", port: 443, method: "CONNECT"}, want: false, wantRule: "default"},
+		{name: "user with matching port and method", req: policyRequest{user: "carol", host: "git.example.com", port: 22, method: "CONNECT"}, want: true, wantRule: "ops ssh"},
+		{name: "user with other port", req: policyRequest{user: "carol", host: "git.example.com", port: 443, method: "CONNECT"}, want: false, wantRule: "default"},
+		{name: "anonymous matches rules without identity", req: policyRequest{host: "docs.example.com", port: 443, method: "GET"}, want: true, wantRule: "public docs"},
+		{name: "empty group matches no one", req: policyRequest{user: "mallory", host: "example.com", port: 443, method: "CONNECT"}, want: false, wantRule: "default"},
+		{name: "empty group does not match anonymous", req: policyRequest{host: "example.com", port: 443, method: "CONNECT"}, want: false, wantRule: "default"},
+		{name: "anonymous with other method", req: policyRequest{host: "docs.example.com", port: 443, method: "POST"}, want: false, wantRule: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rule := engine.Evaluate(tt.req)
+
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantRule, rule)
+		})
+	}
+
+	t.Run("default allow without rules", func(t *testing.T) {
+		got, rule := newPolicyEngine(config.Policy{Default: config.ActionAllow}).Evaluate(policyRequest{host: "example.com"})
+
+		assert.True(t, got)
+		assert.Equal(t, "default", rule)
+	})
+}
+
+func TestForwardHandler_Policy(t *testing.T) {
+	conf := config.ForwardProxyConfig{
+		Proxy:  config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Policy: config.Policy{Default: config.ActionDeny, Rules: []config.Rule{{Name: "ci", Action: config.ActionAllow, Users: []string{"ci"}, Domains: []string{"10.0.0.1"}}}},
+	}
+	h := NewForwardHandler(&conf)
+
+	var req fasthttp.Request
+	req.SetRequestURI("http://10.0.0.1:8080/")
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 4711}, nil)
+
+	h.HandleFastHTTP(&ctx)
+
+	assert.EqualValues(t, 403, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "access to 10.0.0.1 is forbidden by proxy policy")
+}
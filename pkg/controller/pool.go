@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+)
+
+// pooledConn is a connection towards an upstream, which can be reused for further requests once a response was
+// read completely.
+type pooledConn struct {
+	net.Conn
+	br     *bufio.Reader
+	key    string
+	reused bool
+
+	pool    *connPool
+	timer   *time.Timer
+	release sync.Once
+}
+
+// discard closes the connection and frees its slot.
+func (pc *pooledConn) discard() {
+	_ = pc.Close()
+	pc.release.Do(func() {
+		pc.pool.release(pc.key)
+	})
+}
+
+// hostConns holds the connections of a single key, where slots limits the number of open connections
+// including those in use. Slots is nil without a limit.
+type hostConns struct {
+	idle    []*pooledConn
+	slots   chan struct{}
+	waiting int
+	open    int
+}
+
+// connPool keeps connections towards upstreams open for reuse, where connections are grouped by a key that
+// identifies the destination or the parent proxy they lead to.
+type connPool struct {
+	maxConnsPerHost int
+	maxIdleConns    int
+	idleTimeout     time.Duration
+
+	mu     sync.Mutex
+	hosts  map[string]*hostConns
+	idle   int
+	closed bool
+}
+
+func newConnPool(conf config.Pool) *connPool {
+	// time.ParseDuration is already called during validation, hence an error is impossible at this location
+	idleTimeout, _ := time.ParseDuration(conf.IdleTimeout)
+
+	return &connPool{
+		maxConnsPerHost: conf.MaxConnsPerHost,
+		maxIdleConns:    conf.MaxIdleConns,
+		idleTimeout:     idleTimeout,
+		hosts:           make(map[string]*hostConns),
+	}
+}
+
+// Get returns an idle connection of key or dials a new one. If key reached its connection limit, it waits until
+// deadline for a slot to become free.
+func (p *connPool) Get(key string, deadline time.Time, dial func() (net.Conn, error)) (*pooledConn, error) {
+	p.mu.Lock()
+	host := p.host(key)
+	for len(host.idle) > 0 {
+		pc := host.idle[len(host.idle)-1]
+		host.idle = host.idle[:len(host.idle)-1]
+		p.idle--
+		metrics.IdleConnections.Dec()
+
+		// Otherwise the idle timeout elapsed meanwhile, where expire takes care of closing the connection
+		if pc.timer.Stop() {
+			p.mu.Unlock()
+			metrics.PooledConnections.WithLabelValues(metrics.PoolHit).Inc()
+			pc.reused = true
+			return pc, nil
+		}
+	}
+	host.waiting++
+	p.mu.Unlock()
+
+	metrics.PooledConnections.WithLabelValues(metrics.PoolMiss).Inc()
+
+	acquired := true
+	if host.slots != nil {
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case host.slots <- struct{}{}:
+		case <-timer.C:
+			acquired = false
+		}
+		timer.Stop()
+	}
+
+	p.mu.Lock()
+	host.waiting--
+	if acquired {
+		host.open++
+	}
+	p.cleanup(key, host)
+	p.mu.Unlock()
+
+	if !acquired {
+		return nil, fmt.Errorf("no connection towards %s became available as all %d are in use", key, p.maxConnsPerHost)
+	}
+
+	conn, err := dial()
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+	return &pooledConn{Conn: conn, br: bufio.NewReader(conn), key: key, pool: p}, nil
+}
+
+// Put keeps the connection for reuse. It is closed instead if the pool is full or someone waits for a slot of
+// its key, as a new connection can be dialed in its place.
+func (p *connPool) Put(pc *pooledConn) {
+	p.mu.Lock()
+	host := p.host(pc.key)
+	if p.closed || p.idle >= p.maxIdleConns || host.waiting > 0 {
+		p.mu.Unlock()
+		pc.discard()
+		return
+	}
+
+	_ = pc.SetDeadline(time.Time{})
+	host.idle = append(host.idle, pc)
+	p.idle++
+	metrics.IdleConnections.Inc()
+	pc.timer = time.AfterFunc(p.idleTimeout, func() {
+		p.expire(pc)
+	})
+	p.mu.Unlock()
+}
+
+// CloseIdle closes all idle connections.
+func (p *connPool) CloseIdle() {
+	p.mu.Lock()
+	var idle []*pooledConn
+	for _, host := range p.hosts {
+		idle = append(idle, host.idle...)
+		host.idle = nil
+	}
+	metrics.IdleConnections.Sub(float64(p.idle))
+	p.idle = 0
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		if pc.timer.Stop() {
+			pc.discard()
+		}
+	}
+}
+
+// Close closes all idle connections and stops keeping connections afterwards.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	p.CloseIdle()
+}
+
+// Idle returns the number of idle connections.
+func (p *connPool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.idle
+}
+
+// expire closes the connection once its idle timeout elapsed. The connection may have been taken from the idle
+// connections in the meantime, in which case its timer could not be stopped anymore.
+func (p *connPool) expire(pc *pooledConn) {
+	p.mu.Lock()
+	if host, found := p.hosts[pc.key]; found {
+		for idx, idle := range host.idle {
+			if idle == pc {
+				host.idle = append(host.idle[:idx], host.idle[idx+1:]...)
+				p.idle--
+				metrics.IdleConnections.Dec()
+				break
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	pc.discard()
+}
+
+func (p *connPool) release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	host := p.host(key)
+	host.open--
+	if host.slots != nil {
+		<-host.slots
+	}
+	p.cleanup(key, host)
+}
+
+// host returns the connections of key, which are created if missing. It has to be called while holding mu.
+func (p *connPool) host(key string) *hostConns {
+	host, found := p.hosts[key]
+	if !found {
+		host = &hostConns{}
+		if p.maxConnsPerHost > 0 {
+			host.slots = make(chan struct{}, p.maxConnsPerHost)
+		}
+		p.hosts[key] = host
+	}
+	return host
+}
+
+// cleanup forgets key once it has no connections left. It has to be called while holding mu.
+func (p *connPool) cleanup(key string, host *hostConns) {
+	if host.open == 0 && host.waiting == 0 && len(host.idle) == 0 {
+		delete(p.hosts, key)
+	}
+}
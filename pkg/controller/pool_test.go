@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func pipeDialer(dialed *int32) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		atomic.AddInt32(dialed, 1)
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+
+	t.Run("reuses idle connections", func(t *testing.T) {
+		var dialed int32
+		p := newConnPool(config.Pool{MaxIdleConns: 10, IdleTimeout: "1m"})
+
+		first, err := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		assert.NoError(t, err, "should not fail dialing")
+		assert.False(t, first.reused)
+		p.Put(first)
+		assert.Equal(t, 1, p.Idle())
+
+		second, err := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		assert.NoError(t, err, "should not fail reusing")
+		assert.True(t, second.reused)
+		assert.Same(t, first, second)
+		assert.EqualValues(t, 1, dialed)
+		assert.Equal(t, 0, p.Idle())
+
+		other, _ := p.Get("example.org:80", deadline, pipeDialer(&dialed))
+		assert.False(t, other.reused, "should not share connections between keys")
+		assert.EqualValues(t, 2, dialed)
+	})
+
+	t.Run("closes connections exceeding max idle", func(t *testing.T) {
+		var dialed int32
+		p := newConnPool(config.Pool{MaxIdleConns: 1, IdleTimeout: "1m"})
+
+		first, _ := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		second, _ := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		p.Put(first)
+		p.Put(second)
+
+		assert.Equal(t, 1, p.Idle())
+	})
+
+	t.Run("closes connections after idle timeout", func(t *testing.T) {
+		var dialed int32
+		p := newConnPool(config.Pool{MaxIdleConns: 10, IdleTimeout: "10ms"})
+
+		conn, _ := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		p.Put(conn)
+
+		assert.Eventually(t, func() bool { return p.Idle() == 0 }, time.Second, 5*time.Millisecond)
+
+		conn, _ = p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		assert.False(t, conn.reused)
+		assert.EqualValues(t, 2, dialed)
+	})
+
+	t.Run("limits connections per host", func(t *testing.T) {
+		var dialed int32
+		p := newConnPool(config.Pool{MaxConnsPerHost: 1, MaxIdleConns: 10, IdleTimeout: "1m"})
+
+		conn, err := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		assert.NoError(t, err, "should not fail dialing")
+
+		_, err = p.Get("example.com:80", time.Now().Add(20*time.Millisecond), pipeDialer(&dialed))
+		assert.Error(t, err, "should fail once the limit is reached")
+		assert.Contains(t, err.Error(), "all 1 are in use")
+
+		// The waiting request obtains the slot as soon as the connection is closed
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			conn.discard()
+		}()
+		_, err = p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		assert.NoError(t, err, "should obtain the freed slot")
+		assert.EqualValues(t, 2, dialed)
+	})
+
+	t.Run("stops keeping connections once closed", func(t *testing.T) {
+		var dialed int32
+		p := newConnPool(config.Pool{MaxIdleConns: 10, IdleTimeout: "1m"})
+
+		first, _ := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		second, _ := p.Get("example.com:80", deadline, pipeDialer(&dialed))
+		p.Put(first)
+		p.Close()
+		p.Put(second)
+
+		assert.Equal(t, 0, p.Idle())
+	})
+}
+
+func TestForwardHandler_Pool(t *testing.T) {
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations: loopbackAllowed,
+		Upstream:     config.Upstream{Pool: config.Pool{MaxIdleConns: 10, IdleTimeout: "1m"}},
+	}
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	var connections int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<html><body>Hello World!</body></html>")
+	}))
+	// Has to be set before starting, so the server still tracks connections for CloseClientConnections
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		DisableKeepAlives: true,
+	}}
+
+	get := func() {
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "<html><body>Hello World!</body></html>", string(body))
+	}
+
+	hits := metrics.PooledConnections.WithLabelValues(metrics.PoolHit)
+	hitsBefore := testutil.ToFloat64(hits)
+
+	t.Run("reuses upstream connections across clients", func(t *testing.T) {
+		get()
+		assert.Eventually(t, func() bool { return h.upstreams.Idle() == 1 }, time.Second, 5*time.Millisecond)
+		get()
+
+		assert.EqualValues(t, 1, atomic.LoadInt32(&connections))
+		assert.Equal(t, hitsBefore+1, testutil.ToFloat64(hits))
+	})
+
+	t.Run("retries connections closed by the upstream", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return h.upstreams.Idle() == 1 }, time.Second, 5*time.Millisecond)
+		srv.CloseClientConnections()
+
+		get()
+		assert.EqualValues(t, 2, atomic.LoadInt32(&connections))
+	})
+
+	t.Run("closes idle connections on reload", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return h.upstreams.Idle() == 1 }, time.Second, 5*time.Millisecond)
+		h.Reload(&conf, nil)
+
+		assert.Equal(t, 0, h.upstreams.Idle())
+	})
+}
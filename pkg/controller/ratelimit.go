@@ -0,0 +1,334 @@
+package controller
+
+import (
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+)
+
+// sweepInterval is how often idle buckets are dropped from a bucketGroup.
+const sweepInterval = time.Minute
+
+// tokenBucket holds up to burst tokens, which are refilled by rate per second. Tokens can also be taken on credit,
+// in which case the bucket is empty until the debt is paid off. Buckets without rate are unlimited.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// holders counts the tunnels that draw from the bucket, which is guarded by the bucketGroup that handed it out
+	holders int
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// Allow takes a token if one is available. Otherwise it returns false along with how long it takes until one is.
+func (b *tokenBucket) Allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return true, 0
+	}
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, seconds((1 - b.tokens) / b.rate)
+}
+
+// Take takes n tokens regardless of how many are available and returns how long it takes until the debt is paid off.
+func (b *tokenBucket) Take(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return seconds(-b.tokens / b.rate)
+}
+
+// Adjust changes the rate and burst of the bucket, where tokens beyond the new burst are dropped.
+func (b *tokenBucket) Adjust(rate float64, burst float64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.rate <= 0 || b.tokens > burst {
+		b.tokens = burst
+	}
+	b.rate, b.burst = rate, burst
+}
+
+// Burst returns the most tokens the bucket holds, where 0 means unlimited.
+func (b *tokenBucket) Burst() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	return b.burst
+}
+
+// idle reports whether the bucket is full, hence replacing it by a new one makes no difference.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// bucketGroup hands out a bucket per key, which all share the same rate and burst. Idle buckets that no tunnel holds
+// are dropped from time to time, so keys that are no longer seen do not accumulate. Groups without rate hand out
+// unlimited buckets.
+type bucketGroup struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newBucketGroup() *bucketGroup {
+	return &bucketGroup{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// Adjust changes the rate and burst of the group along with those of the buckets that were already handed out.
+func (g *bucketGroup) Adjust(rate float64, burst float64, now time.Time) {
+	if rate > 0 {
+		burst = math.Max(burst, 1)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rate, g.burst = rate, burst
+	for _, b := range g.buckets {
+		b.Adjust(rate, burst, now)
+	}
+}
+
+// Limited reports whether the group has a rate.
+func (g *bucketGroup) Limited() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rate > 0
+}
+
+// Get returns the bucket of key, which is created on first use.
+func (g *bucketGroup) Get(key string, now time.Time) *tokenBucket {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.get(key, now)
+}
+
+// Hold returns the bucket of key just like Get, but keeps it until Release is called. Thus every tunnel of the key
+// shares the same bucket, no matter how long it lasts.
+func (g *bucketGroup) Hold(key string, now time.Time) *tokenBucket {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	b := g.get(key, now)
+	b.holders++
+	return b
+}
+
+// Release lets go of a bucket that was returned by Hold.
+func (g *bucketGroup) Release(b *tokenBucket) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b.holders--
+}
+
+func (g *bucketGroup) get(key string, now time.Time) *tokenBucket {
+	if now.Sub(g.swept) >= sweepInterval {
+		for k, b := range g.buckets {
+			// A full bucket may still be held by a tunnel that is idle for now
+			if b.holders == 0 && b.idle(now) {
+				delete(g.buckets, k)
+			}
+		}
+		g.swept = now
+	}
+
+	b, found := g.buckets[key]
+	if !found {
+		b = newTokenBucket(g.rate, g.burst, now)
+		g.buckets[key] = b
+	}
+	return b
+}
+
+// rateLimitScopes are the scopes of a rateLimiter in the order of its groups.
+var rateLimitScopes = []string{metrics.ScopeClient, metrics.ScopeUser, metrics.ScopeDestination}
+
+// rateLimiter enforces the rate limits of requests and tunnel bandwidth per client IP, authenticated user and
+// destination domain. Its limits are adjusted on reload, so buckets keep their tokens and established tunnels
+// follow the new limits.
+type rateLimiter struct {
+	requests  []*bucketGroup
+	bandwidth []*bucketGroup
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{}
+	for range rateLimitScopes {
+		l.requests = append(l.requests, newBucketGroup())
+		l.bandwidth = append(l.bandwidth, newBucketGroup())
+	}
+	return l
+}
+
+// Adjust applies the limits to all scopes.
+func (l *rateLimiter) Adjust(conf config.RateLimits) {
+	now := time.Now()
+	for i, limit := range []config.RateLimit{conf.Clients, conf.Users, conf.Destinations} {
+		l.requests[i].Adjust(limit.RequestsPerSecond, float64(limit.Burst), now)
+		l.bandwidth[i].Adjust(float64(limit.BytesPerSecond), float64(limit.ByteBurst), now)
+	}
+}
+
+// Allow takes a request token of the client, the user and the destination, where an empty user is skipped. If any
+// of them is exhausted, it returns the scope along with how long it takes until the request would be allowed.
+func (l *rateLimiter) Allow(client, user, destination string) (string, time.Duration) {
+	now := time.Now()
+	for i, key := range []string{client, user, destination} {
+		if len(key) == 0 || !l.requests[i].Limited() {
+			continue
+		}
+		if ok, retry := l.requests[i].Get(key, now).Allow(now); !ok {
+			return rateLimitScopes[i], retry
+		}
+	}
+	return "", 0
+}
+
+// Bandwidth returns the byte buckets that a tunnel of the client and the user towards the destination draws from.
+// Buckets of unlimited scopes are included as well, as they are limited once a reload sets a rate. The returned
+// function releases the buckets once the tunnel terminated.
+func (l *rateLimiter) Bandwidth(client, user, destination string) ([]*tokenBucket, func()) {
+	now := time.Now()
+	var buckets []*tokenBucket
+	var groups []*bucketGroup
+	for i, key := range []string{client, user, destination} {
+		if len(key) == 0 {
+			continue
+		}
+		buckets = append(buckets, l.bandwidth[i].Hold(key, now))
+		groups = append(groups, l.bandwidth[i])
+	}
+
+	return buckets, func() {
+		for i, g := range groups {
+			g.Release(buckets[i])
+		}
+	}
+}
+
+// throttledReader delays reads until the buckets paid off the bytes read. Reads are capped at the smallest burst,
+// hence the transfer proceeds evenly instead of in bursts of the whole buffer. As buckets may be adjusted, the burst
+// is looked up on every read.
+type throttledReader struct {
+	reader  io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(capBurst(p, t.buckets))
+	throttle(n, t.buckets)
+	return n, err
+}
+
+// Close closes the underlying reader if it is an io.Closer, so streams keep being released once they are throttled.
+func (t *throttledReader) Close() error {
+	if c, ok := t.reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// throttledConn delays reads until the upload buckets and writes until the download buckets paid off the bytes
+// transferred, just like throttledReader.
+type throttledConn struct {
+	net.Conn
+	upload   []*tokenBucket
+	download []*tokenBucket
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(capBurst(p, c.upload))
+	throttle(n, c.upload)
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := capBurst(p, c.download)
+		n, err := c.Conn.Write(chunk)
+		throttle(n, c.download)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// capBurst cuts p down to the smallest burst of the buckets.
+func capBurst(p []byte, buckets []*tokenBucket) []byte {
+	for _, b := range buckets {
+		if burst := int(b.Burst()); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	return p
+}
+
+// throttle takes n tokens of every bucket and sleeps until all of them paid off their debt.
+func throttle(n int, buckets []*tokenBucket) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.Take(float64(n), now); w > wait {
+			wait = w
+		}
+	}
+	time.Sleep(wait)
+}
@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+
+	t.Run("allows bursts and refills over time", func(t *testing.T) {
+		b := newTokenBucket(2, 2, now)
+
+		for i := 0; i < 2; i++ {
+			ok, _ := b.Allow(now)
+			assert.True(t, ok, "should allow the burst")
+		}
+
+		ok, retry := b.Allow(now)
+		assert.False(t, ok, "should reject once exhausted")
+		assert.Equal(t, 500*time.Millisecond, retry)
+
+		ok, _ = b.Allow(now.Add(500 * time.Millisecond))
+		assert.True(t, ok, "should allow once refilled")
+	})
+
+	t.Run("takes tokens on credit", func(t *testing.T) {
+		b := newTokenBucket(100, 100, now)
+
+		assert.Equal(t, time.Duration(0), b.Take(100, now))
+		assert.Equal(t, 500*time.Millisecond, b.Take(50, now), "should wait until the debt is paid off")
+		assert.False(t, b.idle(now.Add(time.Second)))
+		assert.True(t, b.idle(now.Add(2*time.Second)), "should be idle once full")
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	conf := config.RateLimits{
+		Clients:      config.RateLimit{RequestsPerSecond: 1, Burst: 2},
+		Users:        config.RateLimit{RequestsPerSecond: 1, Burst: 1, BytesPerSecond: 1024, ByteBurst: 512},
+		Destinations: config.RateLimit{BytesPerSecond: 2048, ByteBurst: 2048},
+	}
+	l := newRateLimiter()
+	l.Adjust(conf)
+
+	scope, _ := l.Allow("10.0.0.1", "alice", "example.com")
+	assert.Empty(t, scope, "should allow the first request")
+
+	scope, retry := l.Allow("10.0.0.1", "alice", "example.com")
+	assert.Equal(t, metrics.ScopeUser, scope, "should exceed the limit of the user")
+	assert.True(t, retry > 0 && retry <= time.Second)
+
+	scope, _ = l.Allow("10.0.0.1", "", "example.com")
+	assert.Equal(t, metrics.ScopeClient, scope, "should exceed the limit of the client")
+
+	scope, _ = l.Allow("10.0.0.2", "", "example.com")
+	assert.Empty(t, scope, "should track clients on their own")
+
+	l.Adjust(conf)
+	scope, _ = l.Allow("10.0.0.1", "", "example.com")
+	assert.Equal(t, metrics.ScopeClient, scope, "should not refill buckets on reload")
+
+	buckets, release := l.Bandwidth("10.0.0.1", "alice", "example.com")
+	assert.Len(t, buckets, 3, "should include unlimited scopes")
+	assert.Equal(t, float64(0), buckets[0].Burst(), "should leave the client unlimited")
+
+	anonymous, releaseAnonymous := l.Bandwidth("10.0.0.2", "", "example.com")
+	assert.Len(t, anonymous, 2, "should skip anonymous users")
+	assert.Same(t, buckets[2], anonymous[1], "should share the bucket of the destination")
+	releaseAnonymous()
+
+	limited := conf
+	limited.Clients.BytesPerSecond, limited.Clients.ByteBurst = 4096, 4096
+	l.Adjust(limited)
+	assert.Equal(t, float64(4096), buckets[0].Burst(), "should adjust buckets that were handed out")
+
+	t.Run("keeps held buckets", func(t *testing.T) {
+		later := time.Now().Add(2 * sweepInterval)
+		assert.Same(t, buckets[0], l.bandwidth[0].Get("10.0.0.1", later), "should not drop full buckets held by tunnels")
+
+		release()
+		assert.False(t, buckets[0] == l.bandwidth[0].Get("10.0.0.1", later.Add(2*sweepInterval)), "should drop released buckets")
+	})
+}
+
+func TestForwardHandler_RateLimits(t *testing.T) {
+	body := strings.Repeat("a", 4096)
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations: loopbackAllowed,
+		RateLimits: config.RateLimits{
+			Clients: config.RateLimit{RequestsPerSecond: 0.5, Burst: 2, BytesPerSecond: 8192, ByteBurst: 1024},
+		},
+	}
+
+	logger := make(recordingLogger, 10)
+	h := NewForwardHandler(&conf)
+	h.SetAccessLogger(logger)
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+	}()
+
+	t.Run("throttles the bandwidth of tunnels", func(t *testing.T) {
+		conn, err := ln.Dial()
+		assert.NoError(t, err, "should not fail dialing")
+
+		start := time.Now()
+		_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		reader := bufio.NewReader(conn)
+		established, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, http.StatusOK, established.StatusCode)
+
+		_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+		resp, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err, "should not throw error")
+		got, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		_ = conn.Close()
+
+		assert.Equal(t, body, string(got))
+		assert.True(t, time.Since(start) >= 300*time.Millisecond, "should take longer than the burst allows")
+		assert.Equal(t, accesslog.ReasonCompleted, logger.next(t).Reason)
+	})
+
+	t.Run("rejects requests exceeding the rate", func(t *testing.T) {
+		limited := testutil.ToFloat64(metrics.RateLimited.WithLabelValues(metrics.ScopeClient))
+
+		proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+		}}
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "should allow the remaining burst")
+		logger.next(t)
+
+		resp, err = client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		assert.True(t, retry >= 1 && retry <= 2, "should tell when to retry")
+		assert.Equal(t, accesslog.ReasonRateLimited, logger.next(t).Reason)
+		assert.Equal(t, limited+1, testutil.ToFloat64(metrics.RateLimited.WithLabelValues(metrics.ScopeClient)))
+	})
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+)
+
+// settings bundles everything of the ForwardHandler that can be swapped at runtime using Reload.
+type settings struct {
+	conf          *config.ForwardProxyConfig
+	clients       *clientList
+	access        *accessList
+	policy        *policyEngine
+	dialer        *dialer
+	upstream      *upstreamRouter
+	headers       *hopHeaders
+	tls           *upstreamTLS
+	interception  *interception
+	sni           *sniCheck
+	authenticator Authenticator
+
+	deadlineDuration time.Duration
+	drainTimeout     time.Duration
+	readTimeout      time.Duration
+}
+
+// newSettings compiles conf, which fails if files that were loaded during validation changed since then.
+func newSettings(conf *config.ForwardProxyConfig, authenticator Authenticator) (*settings, error) {
+	// time.ParseDuration is already called during validation, hence an error is impossible at this location
+	d, _ := time.ParseDuration(conf.Proxy.Timeouts.Write)
+	t, _ := time.ParseDuration(conf.Proxy.Timeouts.Connect)
+	drain, _ := time.ParseDuration(conf.Proxy.Timeouts.Drain)
+	r, _ := time.ParseDuration(conf.Proxy.Timeouts.Read)
+
+	upstreamTLS, err := newUpstreamTLS(conf.UpstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings{
+		conf:             conf,
+		clients:          newClientList(conf.Clients),
+		access:           newAccessList(conf.Access),
+		policy:           newPolicyEngine(conf.Policy),
+		dialer:           newDialer(conf.Destinations, t),
+		upstream:         newUpstreamRouter(conf.Upstream, t),
+		headers:          newHopHeaders(conf.Headers),
+		tls:              upstreamTLS,
+		interception:     newInterception(conf.Interception),
+		sni:              newSNICheck(conf.SNI),
+		authenticator:    authenticator,
+		deadlineDuration: d,
+		drainTimeout:     drain,
+		readTimeout:      r,
+	}, nil
+}
+
+// Reload atomically swaps the runtime settings of the handler. This covers clients, access lists, policies,
+// destinations, upstreams, headers, upstream TLS, interception, SNI checks, rate limits, timeouts and the authenticator. Requests
+// that are already in flight keep their settings, while ports, buffer sizes, the connection pool and concurrency limits are only applied during startup.
+// Rate and bandwidth limits are the exception, as they are adjusted in place, so established tunnels follow them as
+// well and clients do not gain a fresh burst. If conf cannot be applied, the current settings are kept and the error
+// is returned.
+func (h *ForwardHandler) Reload(conf *config.ForwardProxyConfig, authenticator Authenticator) error {
+	s, err := newSettings(conf, authenticator)
+	if err != nil {
+		return err
+	}
+	if previous, ok := h.settings.Load().(*settings); ok {
+		s.interception.Inherit(previous.interception)
+	}
+	h.settings.Store(s)
+	h.shaper.Adjust(conf.Bandwidth)
+	h.limits.Adjust(conf.RateLimits)
+
+	// Idle connections were dialed according to the previous destinations and upstreams, which may not apply anymore
+	h.upstreams.CloseIdle()
+	return nil
+}
+
+func (h *ForwardHandler) current() *settings {
+	return h.settings.Load().(*settings)
+}
+
+// dialTunnel connects to target, which is in host:port form, either directly or through the parent proxy
+// selected by the upstream rules. IP addresses are checked against the destinations policy either way.
+func (s *settings) dialTunnel(target string) (net.Conn, error) {
+	if parent := s.upstream.Route(hostOf(target)); parent != nil {
+		if !s.dialer.PermitsLiteral(hostOf(target)) {
+			return nil, errDestinationForbidden
+		}
+		return parent.Connect(target)
+	}
+	return s.dialer.Dial(target)
+}
+
+// hostOf returns the host of an address, where the port is optional. IPv6 literals are returned without brackets.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return addr[1 : len(addr)-1]
+	}
+	return addr
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestForwardHandler_Reload(t *testing.T) {
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	h := NewForwardHandler(&conf)
+	h.SetAuthenticator(staticAuthenticator{"ci": "secret"})
+
+	reloaded := conf
+	reloaded.Access = config.Access{Deny: []string{"example.com"}}
+	reloaded.Proxy.Timeouts = config.Timeouts{Connect: "5s", Write: "10s", Drain: "1m"}
+
+	h.Reload(&reloaded, nil)
+
+	s := h.current()
+	assert.Equal(t, &reloaded, s.conf)
+	assert.Nil(t, s.authenticator, "authenticator should be swapped as well")
+	assert.Equal(t, "10s", s.deadlineDuration.String())
+	assert.Equal(t, "1m0s", s.drainTimeout.String())
+	assert.Equal(t, "5s", s.dialer.timeout.String())
+
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/")
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+
+	h.HandleFastHTTP(&ctx)
+
+	assert.EqualValues(t, 403, ctx.Response.StatusCode(), "reloaded access list should be applied")
+}
+
+func TestForwardHandler_ReloadKeepsSettingsOnError(t *testing.T) {
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	h := NewForwardHandler(&conf)
+	h.SetAuthenticator(staticAuthenticator{"ci": "secret"})
+
+	reloaded := conf
+	reloaded.UpstreamTLS = config.UpstreamTLS{TLSSettings: config.TLSSettings{CAFile: filepath.Join(t.TempDir(), "vanished.pem")}}
+
+	err := h.Reload(&reloaded, nil)
+
+	assert.Error(t, err, "missing ca file should fail the reload")
+	s := h.current()
+	assert.Equal(t, &conf, s.conf, "previous config should be kept")
+	assert.NotNil(t, s.authenticator, "previous authenticator should be kept")
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+)
+
+// shaper caps the bandwidth of all tunnels together and of every tunnel on its own, separately for upload and
+// download. Its limits are adjusted on reload, which also applies to tunnels that are already established.
+type shaper struct {
+	upload   *tokenBucket
+	download *tokenBucket
+
+	mu      sync.Mutex
+	limits  config.BandwidthLimit
+	tunnels map[*shapedTunnel]struct{}
+}
+
+// shapedTunnel holds the buckets of a single tunnel.
+type shapedTunnel struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+func newShaper() *shaper {
+	now := time.Now()
+	return &shaper{upload: newTokenBucket(0, 0, now), download: newTokenBucket(0, 0, now), tunnels: make(map[*shapedTunnel]struct{})}
+}
+
+// Adjust applies the limits to the total bandwidth and to every established tunnel. Bursts amount to a second
+// worth of the rates.
+func (s *shaper) Adjust(conf config.Bandwidth) {
+	now := time.Now()
+	s.upload.Adjust(float64(conf.Total.Upload), float64(conf.Total.Upload), now)
+	s.download.Adjust(float64(conf.Total.Download), float64(conf.Total.Download), now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = conf.Tunnel
+	for t := range s.tunnels {
+		t.upload.Adjust(float64(s.limits.Upload), float64(s.limits.Upload), now)
+		t.download.Adjust(float64(s.limits.Download), float64(s.limits.Download), now)
+	}
+}
+
+// Open returns the buckets of a new tunnel, which have to be released by Close once it terminated.
+func (s *shaper) Open() *shapedTunnel {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := &shapedTunnel{
+		upload:   newTokenBucket(float64(s.limits.Upload), float64(s.limits.Upload), now),
+		download: newTokenBucket(float64(s.limits.Download), float64(s.limits.Download), now),
+	}
+	s.tunnels[t] = struct{}{}
+	return t
+}
+
+func (s *shaper) Close(t *shapedTunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tunnels, t)
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestShaper(t *testing.T) {
+	s := newShaper()
+	s.Adjust(config.Bandwidth{Total: config.BandwidthLimit{Download: 4096}, Tunnel: config.BandwidthLimit{Upload: 1024}})
+
+	tunnel := s.Open()
+	assert.Equal(t, float64(4096), s.download.Burst())
+	assert.Equal(t, float64(0), s.upload.Burst(), "should leave the total upload unlimited")
+	assert.Equal(t, float64(1024), tunnel.upload.Burst())
+	assert.Equal(t, float64(0), tunnel.download.Burst(), "should leave the tunnel download unlimited")
+
+	s.Adjust(config.Bandwidth{Tunnel: config.BandwidthLimit{Upload: 512, Download: 2048}})
+	assert.Equal(t, float64(0), s.download.Burst(), "should lift the total limit")
+	assert.Equal(t, float64(512), tunnel.upload.Burst(), "should adjust established tunnels")
+	assert.Equal(t, float64(2048), tunnel.download.Burst(), "should adjust established tunnels")
+
+	s.Close(tunnel)
+	s.Adjust(config.Bandwidth{})
+	assert.Equal(t, float64(512), tunnel.upload.Burst(), "should not adjust closed tunnels")
+}
+
+func TestForwardHandler_Bandwidth(t *testing.T) {
+	body := strings.Repeat("a", 4096)
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	target := strings.TrimPrefix(srv.URL, "http://")
+	conf := config.ForwardProxyConfig{
+		Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations: loopbackAllowed,
+	}
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+	}()
+
+	// download fetches the body through a tunnel and returns how long it took, where adjust is called once the
+	// tunnel was established
+	download := func(t *testing.T, adjust func()) time.Duration {
+		conn, err := ln.Dial()
+		assert.NoError(t, err, "should not fail dialing")
+		defer conn.Close()
+
+		start := time.Now()
+		_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		reader := bufio.NewReader(conn)
+		established, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, http.StatusOK, established.StatusCode)
+
+		_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+		adjust()
+
+		resp, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err, "should not throw error")
+		got, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, body, string(got))
+		return time.Since(start)
+	}
+
+	t.Run("caps the download of tunnels", func(t *testing.T) {
+		limited := conf
+		limited.Bandwidth = config.Bandwidth{Tunnel: config.BandwidthLimit{Download: 2048}}
+		h.Reload(&limited, nil)
+
+		assert.True(t, download(t, func() {}) >= 500*time.Millisecond, "should take longer than the burst allows")
+	})
+
+	t.Run("caps the download of forwarded responses", func(t *testing.T) {
+		limited := conf
+		limited.Bandwidth = config.Bandwidth{Total: config.BandwidthLimit{Download: 2048}}
+		h.Reload(&limited, nil)
+		defer h.Reload(&conf, nil)
+
+		proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+		}}
+
+		start := time.Now()
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		got, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, body, string(got))
+		assert.True(t, time.Since(start) >= 500*time.Millisecond, "should take longer than the burst allows")
+	})
+
+	t.Run("adjusts established tunnels", func(t *testing.T) {
+		limited := conf
+		limited.Bandwidth = config.Bandwidth{Total: config.BandwidthLimit{Download: 1024}}
+		h.Reload(&limited, nil)
+
+		took := download(t, func() {
+			time.Sleep(100 * time.Millisecond)
+			h.Reload(&conf, nil)
+		})
+		assert.True(t, took < 2*time.Second, "should lift the limit of the running transfer")
+	})
+}
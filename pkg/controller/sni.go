@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// errHelloPeeked aborts the handshake once the ClientHello was read, as the tunnel is not meant to be terminated.
+var errHelloPeeked = errors.New("client hello peeked")
+
+// sniCheck verifies the server name that clients indicate within tunnels against the host they requested.
+type sniCheck struct {
+	mode    string
+	ports   map[string]struct{}
+	allow   *domainList
+	require bool
+}
+
+func newSNICheck(conf config.SNI) *sniCheck {
+	c := &sniCheck{mode: conf.Mode, ports: make(map[string]struct{}), allow: newDomainList(conf.Allow), require: conf.RequireSNI}
+	for _, port := range conf.Ports {
+		c.ports[strconv.Itoa(int(port))] = struct{}{}
+	}
+	return c
+}
+
+// Applies reports whether the server name of tunnels towards target is checked.
+func (c *sniCheck) Applies(target string) bool {
+	if c.mode != config.SNILog && c.mode != config.SNIEnforce {
+		return false
+	}
+
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	_, found := c.ports[port]
+	return found
+}
+
+// Verify classifies serverName with regard to target using the result labels of metrics.SNIChecks and reports
+// whether the tunnel may stay open.
+func (c *sniCheck) Verify(target string, serverName string) (string, bool) {
+	switch {
+	case len(serverName) == 0:
+		return metrics.SNIMissing, !(c.require && c.mode == config.SNIEnforce)
+	case strings.EqualFold(serverName, hostOf(target)):
+		return metrics.SNIMatched, true
+	case c.allow.Matches(serverName):
+		return metrics.SNIAllowed, true
+	default:
+		return metrics.SNIMismatched, c.mode != config.SNIEnforce
+	}
+}
+
+// peekedConn feeds the handshake with what the client sent, while nothing is written back towards the client.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *peekedConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// peekServerName reads the ClientHello from conn without answering it and returns the indicated server name along
+// with all bytes that were read, which still have to be relayed. Connections that do not start with a ClientHello
+// or stay silent until timeout yield an empty server name.
+func peekServerName(conn net.Conn, timeout time.Time) (string, []byte) {
+	var buf bytes.Buffer
+	var serverName string
+
+	_ = conn.SetReadDeadline(timeout)
+	_ = tls.Server(&peekedConn{Conn: conn, reader: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+
+	return serverName, buf.Bytes()
+}
+
+// checkSNI peeks at the server name the client of the tunnel indicates and records it. It returns the bytes that
+// were read from the client along with whether the tunnel may stay open.
+func (h *ForwardHandler) checkSNI(c *sniCheck, t *tunnel, rl *requestLog, readTimeout time.Duration, deadline time.Time) ([]byte, bool) {
+	timeout := deadline
+	if readTimeout > 0 && time.Now().Add(readTimeout).Before(deadline) {
+		timeout = time.Now().Add(readTimeout)
+	}
+
+	serverName, peeked := peekServerName(t.origin, timeout)
+	_ = t.origin.SetReadDeadline(deadline)
+	rl.SNI = serverName
+
+	result, ok := c.Verify(t.target, serverName)
+	metrics.SNIChecks.WithLabelValues(result).Inc()
+
+	switch {
+	case !ok:
+		metrics.Errors.WithLabelValues(metrics.ErrorSNIMismatch).Inc()
+		log.Warnf("tunnel: closing tunnel of %s towards %s as its server name %q is not permitted", rl.ClientIP, t.target, serverName)
+	case result == metrics.SNIMismatched:
+		log.Warnf("tunnel: tunnel of %s towards %s indicated the foreign server name %s", rl.ClientIP, t.target, serverName)
+	}
+	return peeked, ok
+}
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestSNICheck_Verify(t *testing.T) {
+	enforce := newSNICheck(config.SNI{Mode: config.SNIEnforce, Ports: []uint16{443}, Allow: []string{"*.cdn.example.com"}})
+	require := newSNICheck(config.SNI{Mode: config.SNIEnforce, Ports: []uint16{443}, RequireSNI: true})
+	logOnly := newSNICheck(config.SNI{Mode: config.SNILog, Ports: []uint16{443}, RequireSNI: true})
+
+	tests := []struct {
+		name       string
+		check      *sniCheck
+		target     string
+		serverName string
+
+		wantedResult string
+		wantedOpen   bool
+	}{
+		{name: "matches requested host", check: enforce, target: "www.example.com:443", serverName: "WWW.example.com", wantedResult: metrics.SNIMatched, wantedOpen: true},
+		{name: "permits allowed server names", check: enforce, target: "10.0.0.1:443", serverName: "img.cdn.example.com", wantedResult: metrics.SNIAllowed, wantedOpen: true},
+		{name: "closes foreign server names", check: enforce, target: "www.example.com:443", serverName: "www.evil.com", wantedResult: metrics.SNIMismatched},
+		{name: "keeps tunnels without server name", check: enforce, target: "10.0.0.1:443", wantedResult: metrics.SNIMissing, wantedOpen: true},
+		{name: "closes tunnels without required server name", check: require, target: "10.0.0.1:443", wantedResult: metrics.SNIMissing},
+		{name: "only records in log mode", check: logOnly, target: "www.example.com:443", serverName: "www.evil.com", wantedResult: metrics.SNIMismatched, wantedOpen: true},
+		{name: "only records missing server names in log mode", check: logOnly, target: "10.0.0.1:443", wantedResult: metrics.SNIMissing, wantedOpen: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, open := tt.check.Verify(tt.target, tt.serverName)
+			assert.Equal(t, tt.wantedResult, result)
+			assert.Equal(t, tt.wantedOpen, open)
+		})
+	}
+
+	t.Run("applies to configured ports", func(t *testing.T) {
+		assert.True(t, enforce.Applies("www.example.com:443"))
+		assert.False(t, enforce.Applies("www.example.com:8443"))
+		assert.False(t, newSNICheck(config.SNI{Mode: config.SNIOff, Ports: []uint16{443}}).Applies("www.example.com:443"))
+	})
+}
+
+func TestForwardHandler_SNI(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<html><body>Hello World!</body></html>")
+	}))
+	defer srv.Close()
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	numeric, _ := strconv.Atoi(port)
+	target := net.JoinHostPort("localhost", port)
+
+	tests := []struct {
+		name       string
+		sni        config.SNI
+		serverName string
+
+		wantedOpen   bool
+		wantedReason string
+		wantedResult string
+	}{
+		{name: "relays matching server names", sni: config.SNI{Mode: config.SNIEnforce, Ports: []uint16{uint16(numeric)}}, serverName: "localhost", wantedOpen: true, wantedReason: accesslog.ReasonCompleted, wantedResult: metrics.SNIMatched},
+		{name: "relays allowed server names", sni: config.SNI{Mode: config.SNIEnforce, Ports: []uint16{uint16(numeric)}, Allow: []string{"*.example.com"}}, serverName: "www.example.com", wantedOpen: true, wantedReason: accesslog.ReasonCompleted, wantedResult: metrics.SNIAllowed},
+		{name: "closes tunnels with foreign server names", sni: config.SNI{Mode: config.SNIEnforce, Ports: []uint16{uint16(numeric)}}, serverName: "www.example.com", wantedReason: accesslog.ReasonSNIMismatch, wantedResult: metrics.SNIMismatched},
+		{name: "records foreign server names in log mode", sni: config.SNI{Mode: config.SNILog, Ports: []uint16{uint16(numeric)}}, serverName: "www.example.com", wantedOpen: true, wantedReason: accesslog.ReasonCompleted, wantedResult: metrics.SNIMismatched},
+		{name: "ignores other ports", sni: config.SNI{Mode: config.SNIEnforce, Ports: []uint16{443}}, serverName: "www.example.com", wantedOpen: true, wantedReason: accesslog.ReasonCompleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.ForwardProxyConfig{
+				Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+				Destinations: loopbackAllowed,
+				SNI:          tt.sni,
+			}
+
+			logger := make(recordingLogger, 10)
+			h := NewForwardHandler(&conf)
+			h.SetAccessLogger(logger)
+
+			ln := fasthttputil.NewInmemoryListener()
+			defer ln.Close()
+
+			go func() {
+				_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+			}()
+
+			var checked float64
+			if len(tt.wantedResult) > 0 {
+				checked = testutil.ToFloat64(metrics.SNIChecks.WithLabelValues(tt.wantedResult))
+			}
+
+			raw, err := ln.Dial()
+			assert.NoError(t, err, "should not fail dialing")
+
+			_, _ = fmt.Fprintf(raw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+			established, err := http.ReadResponse(bufio.NewReader(raw), nil)
+			assert.NoError(t, err, "should not throw error")
+			assert.Equal(t, http.StatusOK, established.StatusCode)
+
+			conn := tls.Client(raw, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			err = conn.Handshake()
+			if !tt.wantedOpen {
+				assert.Error(t, err, "should close the tunnel")
+			} else {
+				assert.NoError(t, err, "should relay the handshake")
+
+				_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				assert.NoError(t, err, "should not throw error")
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				_ = resp.Body.Close()
+			}
+			_ = conn.Close()
+
+			entry := logger.next(t)
+			assert.Equal(t, tt.wantedReason, entry.Reason)
+			if len(tt.wantedResult) > 0 {
+				assert.Equal(t, tt.serverName, entry.SNI, "should record the server name")
+				assert.Equal(t, checked+1, testutil.ToFloat64(metrics.SNIChecks.WithLabelValues(tt.wantedResult)))
+			} else {
+				assert.Empty(t, entry.SNI, "should not peek at other ports")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/accesslog"
+	"github.com/Templum/Spediteur/pkg/metrics"
+	"github.com/Templum/Spediteur/pkg/socks5"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// ServeSOCKS5 accepts SOCKS5 clients on ln until it is closed. Clients pass through the same checks as CONNECT
+// requests, before their connection is relayed like a tunnel. The listener is closed during Shutdown.
+func (h *ForwardHandler) ServeSOCKS5(ln net.Listener) error {
+	h.mu.Lock()
+	h.listeners = append(h.listeners, ln)
+	h.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if h.tunnels.Closed() {
+				return nil
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				log.Warnf("socks5: temporary error while accepting: %s", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+
+		go h.HandleSOCKS5(conn)
+	}
+}
+
+// HandleSOCKS5 serves a single SOCKS5 client connection.
+func (h *ForwardHandler) HandleSOCKS5(conn net.Conn) {
+	start := time.Now()
+	s := h.current()
+
+	rl := &requestLog{start: start, Entry: accesslog.Entry{
+		Time:     start,
+		ClientIP: remoteIP(conn.RemoteAddr()),
+		Method:   fasthttp.MethodConnect,
+		Protocol: "SOCKS5",
+	}}
+
+	// The status codes of HTTP are used for the SOCKS5 replies as well, so both protocols are reported alike
+	established := false
+	defer func() {
+		metrics.Requests.WithLabelValues(metrics.TypeSOCKS5, strconv.Itoa(rl.Status)).Inc()
+		metrics.RequestDuration.WithLabelValues(metrics.TypeSOCKS5).Observe(time.Since(start).Seconds())
+
+		// Established tunnels are logged once they are closed
+		if !established {
+			_ = conn.Close()
+			h.logAccess(rl)
+		}
+	}()
+
+	fail := func(reply byte, status int, reason string) {
+		_ = socks5.WriteReply(conn, reply, nil)
+		rl.Status = status
+		rl.reject(reason)
+	}
+
+	clientIP := net.ParseIP(rl.ClientIP)
+	if !h.permitsClient(s, clientIP) {
+		rl.Status = fasthttp.StatusForbidden
+		rl.reject(accesslog.ReasonClientRejected)
+		return
+	}
+
+	if s.readTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.readTimeout))
+	}
+
+	var authenticate func(string, string) bool
+	if s.authenticator != nil {
+		authenticate = s.authenticator.Authenticate
+	}
+
+	user, err := socks5.Negotiate(conn, authenticate)
+	if errors.Is(err, socks5.ErrAuthenticationFailed) || (authenticate != nil && errors.Is(err, socks5.ErrNoAcceptableMethod)) {
+		metrics.Errors.WithLabelValues(metrics.ErrorAuthentication).Inc()
+		log.Warnf("Client %s failed to authenticate as %s", clientIP, user)
+		rl.Status = fasthttp.StatusProxyAuthRequired
+		rl.reject(accesslog.ReasonAuthentication)
+		return
+	}
+	if err != nil {
+		log.Debugf("socks5: negotiation with %s failed due to %s", clientIP, err)
+		rl.Status = fasthttp.StatusBadRequest
+		rl.reject(accesslog.ReasonError)
+		return
+	}
+	rl.User = user
+
+	command, target, err := socks5.ReadRequest(conn)
+	if err != nil {
+		log.Debugf("socks5: reading request of %s failed due to %s", clientIP, err)
+		fail(socks5.ReplyGeneralFailure, fasthttp.StatusBadRequest, accesslog.ReasonError)
+		return
+	}
+	rl.Target = target
+
+	if command != socks5.CommandConnect {
+		fail(socks5.ReplyCommandNotSupported, fasthttp.StatusMethodNotAllowed, accesslog.ReasonError)
+		return
+	}
+
+	_, rawPort, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(rawPort)
+	if r := h.checkDestination(s, rl.ClientIP, user, fasthttp.MethodConnect, hostOf(target), port); r != nil {
+		fail(socks5.ReplyNotAllowed, r.status, r.reason)
+		return
+	}
+
+	if h.tunnels.Closed() {
+		fail(socks5.ReplyGeneralFailure, fasthttp.StatusServiceUnavailable, accesslog.ReasonServiceUnavailable)
+		return
+	}
+
+	release, err := h.concurrency.AcquireTunnel(rl.ClientIP, time.Now().Add(s.deadlineDuration))
+	if err != nil {
+		metrics.Errors.WithLabelValues(metrics.ErrorOverloaded).Inc()
+		log.Warnf("socks5: rejected connection of %s towards %s as %s", clientIP, target, err)
+		fail(socks5.ReplyGeneralFailure, fasthttp.StatusServiceUnavailable, accesslog.ReasonOverloaded)
+		return
+	}
+
+	dest, err := s.dialTunnel(target)
+	if errors.Is(err, errDestinationForbidden) {
+		release()
+		metrics.Errors.WithLabelValues(metrics.ErrorDestinationForbidden).Inc()
+		log.Warnf("socks5: blocked connection towards %s as its address is forbidden", target)
+		fail(socks5.ReplyNotAllowed, fasthttp.StatusForbidden, accesslog.ReasonDestinationForbidden)
+		return
+	}
+	if err != nil {
+		release()
+		metrics.Errors.WithLabelValues(metrics.ErrorUpstreamUnreachable).Inc()
+		log.Errorf("socks5: failed to reach target host %s due to %s", target, err)
+		fail(socks5.ReplyHostUnreachable, fasthttp.StatusServiceUnavailable, accesslog.ReasonUpstreamUnreachable)
+		return
+	}
+
+	if err := socks5.WriteReply(conn, socks5.ReplySucceeded, dest.LocalAddr()); err != nil {
+		release()
+		_ = dest.Close()
+		rl.Status = fasthttp.StatusBadRequest
+		rl.reject(accesslog.ReasonError)
+		return
+	}
+
+	rl.Status = fasthttp.StatusOK
+	rl.ResolvedIP = remoteIP(dest.RemoteAddr())
+	established = true
+
+	go h.relay(&tunnel{target: target, origin: conn, dest: dest, release: release}, rl, metrics.TypeSOCKS5, time.Now().Add(s.deadlineDuration))
+}
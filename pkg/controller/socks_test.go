@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/socks5"
+	"github.com/stretchr/testify/assert"
+)
+
+func startSOCKS5Listener(t *testing.T, h *ForwardHandler) (net.Listener, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "should not throw error")
+
+	served := make(chan error, 1)
+	go func() {
+		served <- h.ServeSOCKS5(ln)
+	}()
+
+	return ln, served
+}
+
+// getViaSOCKS5 requests the root of target through the SOCKS5 listener and returns the body of the response.
+func getViaSOCKS5(ln net.Listener, target string, username string, password string) (string, error) {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	err = socks5.Connect(conn, target, username, password)
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return "", err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestForwardHandler_SOCKS5(t *testing.T) {
+	t.Parallel()
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte("<html><body>Hello World!</body></html>"))
+	}))
+	defer srv.Close()
+	target := srv.Listener.Addr().String()
+
+	base := config.Proxy{Timeouts: config.Timeouts{Read: "5s", Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}
+
+	t.Run("relays permitted connection", func(t *testing.T) {
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		body, err := getViaSOCKS5(ln, target, "", "")
+
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, "<html><body>Hello World!</body></html>", body)
+	})
+
+	t.Run("requires credentials if authentication is enabled", func(t *testing.T) {
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed})
+		h.SetAuthenticator(staticAuthenticator{"ci": "secret"})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		_, err := getViaSOCKS5(ln, target, "", "")
+		assert.Equal(t, socks5.ErrNoAcceptableMethod, err)
+
+		_, err = getViaSOCKS5(ln, target, "ci", "wrong")
+		assert.Equal(t, socks5.ErrAuthenticationFailed, err)
+
+		body, err := getViaSOCKS5(ln, target, "ci", "secret")
+		assert.NoError(t, err, "should not throw error")
+		assert.Equal(t, "<html><body>Hello World!</body></html>", body)
+	})
+
+	t.Run("applies access list", func(t *testing.T) {
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed, Access: config.Access{Deny: []string{"127.0.0.1"}}})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		_, err := getViaSOCKS5(ln, target, "", "")
+		assert.Equal(t, socks5.ReplyError(socks5.ReplyNotAllowed), err)
+	})
+
+	t.Run("applies policy", func(t *testing.T) {
+		policy := config.Policy{Default: config.ActionAllow, Rules: []config.Rule{{Name: "no ssh", Action: config.ActionDeny, Ports: []uint16{22}}}}
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed, Policy: policy})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		_, err := getViaSOCKS5(ln, "127.0.0.1:22", "", "")
+		assert.Equal(t, socks5.ReplyError(socks5.ReplyNotAllowed), err)
+	})
+
+	t.Run("applies destinations", func(t *testing.T) {
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		_, err := getViaSOCKS5(ln, target, "", "")
+		assert.Equal(t, socks5.ReplyError(socks5.ReplyNotAllowed), err)
+	})
+
+	t.Run("rejects clients that are not permitted", func(t *testing.T) {
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed, Clients: config.Clients{Allow: []string{"10.0.0.0/8"}}})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		_, err := getViaSOCKS5(ln, target, "", "")
+		assert.Error(t, err, "should throw error")
+		assert.EqualValues(t, 1, h.RejectedClients())
+	})
+
+	t.Run("reports unreachable upstream", func(t *testing.T) {
+		// Nothing is listening anymore on the address of a closed listener
+		closed, _ := net.Listen("tcp", "127.0.0.1:0")
+		_ = closed.Close()
+
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed})
+		ln, _ := startSOCKS5Listener(t, h)
+		defer ln.Close()
+
+		_, err := getViaSOCKS5(ln, closed.Addr().String(), "", "")
+		assert.Equal(t, socks5.ReplyError(socks5.ReplyHostUnreachable), err)
+	})
+
+	t.Run("stops serving during shutdown", func(t *testing.T) {
+		h := NewForwardHandler(&config.ForwardProxyConfig{Proxy: base, Destinations: loopbackAllowed})
+		ln, served := startSOCKS5Listener(t, h)
+
+		// Waiting for the listener to be registered by ServeSOCKS5
+		_, err := getViaSOCKS5(ln, target, "", "")
+		assert.NoError(t, err, "should not throw error")
+
+		h.Shutdown()
+
+		select {
+		case err := <-served:
+			assert.NoError(t, err, "should not throw error")
+		case <-time.After(5 * time.Second):
+			t.Fatal("ServeSOCKS5 should return once shutdown")
+		}
+
+		_, err = net.Dial("tcp", ln.Addr().String())
+		assert.Error(t, err, "should throw error")
+		assert.True(t, strings.Contains(err.Error(), "refused"), "listener should be closed")
+	})
+}
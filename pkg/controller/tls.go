@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+)
+
+// tlsHost is the compiled form of a per-host override of the upstream TLS settings.
+type tlsHost struct {
+	domains *domainList
+	conf    *tls.Config
+}
+
+// upstreamTLS selects the TLS configuration for connections towards upstreams of forwarded https:// requests.
+type upstreamTLS struct {
+	hosts    []tlsHost
+	fallback *tls.Config
+}
+
+// newUpstreamTLS loads the files of conf, which fails if they changed since they were validated.
+func newUpstreamTLS(conf config.UpstreamTLS) (*upstreamTLS, error) {
+	fallback, err := newTLSConfig(conf.TLSSettings)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstreamTLS{fallback: fallback}
+
+	for _, host := range conf.Hosts {
+		hostConf, err := newTLSConfig(mergeTLSSettings(conf.TLSSettings, host.TLSSettings))
+		if err != nil {
+			return nil, err
+		}
+		u.hosts = append(u.hosts, tlsHost{domains: newDomainList(host.Domains), conf: hostConf})
+	}
+
+	return u, nil
+}
+
+// Config returns the TLS configuration for host, where the first matching override wins.
+func (u *upstreamTLS) Config(host string) *tls.Config {
+	for _, h := range u.hosts {
+		if h.domains.Matches(host) {
+			return h.conf
+		}
+	}
+	return u.fallback
+}
+
+// Client performs the TLS handshake with host on top of conn, which is closed if the handshake fails.
+func (u *upstreamTLS) Client(conn net.Conn, host string, deadline time.Time) (net.Conn, error) {
+	conf := u.Config(host).Clone()
+	conf.ServerName = host
+
+	tlsConn := tls.Client(conn, conf)
+	_ = tlsConn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s failed: %w", host, err)
+	}
+	return tlsConn, nil
+}
+
+// mergeTLSSettings returns the settings of host, where empty fields fall back to base.
+func mergeTLSSettings(base config.TLSSettings, host config.TLSSettings) config.TLSSettings {
+	merged := base
+	if len(host.CAFile) > 0 {
+		merged.CAFile = host.CAFile
+	}
+	if len(host.CertFile) > 0 {
+		merged.CertFile, merged.KeyFile = host.CertFile, host.KeyFile
+	}
+	if len(host.MinVersion) > 0 {
+		merged.MinVersion = host.MinVersion
+	}
+	if len(host.CipherSuites) > 0 {
+		merged.CipherSuites = host.CipherSuites
+	}
+	if len(host.Pins) > 0 {
+		merged.Pins = host.Pins
+	}
+	return merged
+}
+
+func newTLSConfig(settings config.TLSSettings) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// The files were already loaded during validation, but they may have changed since then
+	if len(settings.CAFile) > 0 {
+		pool, err := config.LoadCertPool(settings.CAFile, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading upstream ca file %s: %w", settings.CAFile, err)
+		}
+		conf.RootCAs = pool
+	}
+	if len(settings.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading upstream client certificate %s: %w", settings.CertFile, err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if version, found := config.TLSVersions[settings.MinVersion]; found {
+		conf.MinVersion = version
+	}
+	for _, name := range settings.CipherSuites {
+		suite, _ := config.CipherSuite(name)
+		conf.CipherSuites = append(conf.CipherSuites, suite)
+	}
+
+	if len(settings.Pins) > 0 {
+		pins := make([][]byte, 0, len(settings.Pins))
+		for _, pin := range settings.Pins {
+			hash, _ := base64.StdEncoding.DecodeString(pin)
+			pins = append(pins, hash)
+		}
+		conf.VerifyConnection = verifyPins(pins)
+	}
+
+	return conf, nil
+}
+
+// errPinMismatch is returned by the handshake if none of the certificates of the upstream matches a pin.
+var errPinMismatch = errors.New("no certificate of the upstream matches the configured pins")
+
+// verifyPins checks the certificates of the upstream against the pins, which happens after the regular verification.
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, cert := range state.PeerCertificates {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errPinMismatch
+	}
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestForwardHandler_UpstreamTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<html><body>Hello TLS!</body></html>")
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "spediteur")
+	assert.NoError(t, err, "should not fail creating temp dir")
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	_ = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	hash := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name     string
+		settings config.UpstreamTLS
+
+		wantedStatus int
+	}{
+		{name: "trusts configured ca", settings: config.UpstreamTLS{TLSSettings: config.TLSSettings{CAFile: caFile}}, wantedStatus: fasthttp.StatusOK},
+		{name: "rejects unknown ca", settings: config.UpstreamTLS{}, wantedStatus: fasthttp.StatusServiceUnavailable},
+		{name: "accepts matching pin", settings: config.UpstreamTLS{TLSSettings: config.TLSSettings{CAFile: caFile, Pins: []string{otherPin, pin}}}, wantedStatus: fasthttp.StatusOK},
+		{name: "rejects mismatching pin", settings: config.UpstreamTLS{TLSSettings: config.TLSSettings{CAFile: caFile, Pins: []string{otherPin}}}, wantedStatus: fasthttp.StatusServiceUnavailable},
+		{
+			name: "applies host overrides",
+			settings: config.UpstreamTLS{
+				TLSSettings: config.TLSSettings{CAFile: caFile},
+				Hosts:       []config.TLSHost{{Domains: []string{"127.0.0.1"}, TLSSettings: config.TLSSettings{MinVersion: "1.3"}}},
+			},
+			wantedStatus: fasthttp.StatusServiceUnavailable,
+		},
+		{
+			name: "ignores overrides of other hosts",
+			settings: config.UpstreamTLS{
+				TLSSettings: config.TLSSettings{CAFile: caFile},
+				Hosts:       []config.TLSHost{{Domains: []string{"*.corp"}, TLSSettings: config.TLSSettings{MinVersion: "1.3"}}},
+			},
+			wantedStatus: fasthttp.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.ForwardProxyConfig{
+				Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+				Destinations: loopbackAllowed,
+				Upstream:     config.Upstream{Pool: config.Pool{MaxIdleConns: 10, IdleTimeout: "1m"}},
+				UpstreamTLS:  tt.settings,
+			}
+
+			h := NewForwardHandler(&conf)
+			defer h.Shutdown()
+			ln := fasthttputil.NewInmemoryListener()
+			defer ln.Close()
+
+			go func() {
+				err := fasthttp.Serve(ln, h.HandleFastHTTP)
+				assert.NoError(t, err, "should not throw err")
+			}()
+
+			conn, err := ln.Dial()
+			assert.NoError(t, err, "should not fail dialing proxy")
+			defer conn.Close()
+
+			host := srv.Listener.Addr().String()
+			_, _ = fmt.Fprintf(conn, "GET https://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			assert.NoError(t, err, "should not throw error")
+			defer resp.Body.Close()
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, tt.wantedStatus, resp.StatusCode)
+			if tt.wantedStatus == fasthttp.StatusOK {
+				assert.Equal(t, "<html><body>Hello TLS!</body></html>", string(body))
+			}
+		})
+	}
+}
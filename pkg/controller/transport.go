@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// upstreamBody streams the body of an upstream response. Once the body was read completely, the connection is
+// returned to the pool if the upstream permits to reuse it, otherwise it is closed along with the body. Trailers of
+// chunked bodies are read into the response header once the body is exhausted.
+type upstreamBody struct {
+	r        io.Reader
+	conn     *pooledConn
+	size     int
+	trailers *fasthttp.ResponseHeader
+	onClose  func(n int64, err error)
+
+	reusable bool
+	done     bool
+
+	n    int64
+	err  error
+	once sync.Once
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+
+	if err == io.EOF {
+		b.done = true
+		if b.trailers != nil {
+			if trailerErr := b.trailers.ReadTrailer(b.conn.br); trailerErr != nil {
+				b.done = false
+				if trailerErr != io.EOF {
+					err = trailerErr
+				}
+			}
+			b.trailers = nil
+		}
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Close releases the upstream connection and reports the number of bytes that were read, along with the error
+// that interrupted reading, if any.
+func (b *upstreamBody) Close() error {
+	b.once.Do(func() {
+		if b.reusable && b.done && b.conn.br.Buffered() == 0 {
+			b.conn.pool.Put(b.conn)
+		} else {
+			b.conn.discard()
+		}
+
+		if b.onClose != nil {
+			b.onClose(b.n, b.err)
+		}
+	})
+	return nil
+}
+
+// errStaleConnection is returned by exchange if the connection was closed before any part of the response arrived.
+var errStaleConnection = errors.New("connection was closed before the response arrived")
+
+// errSwitchedProtocols is returned by exchange if the upstream switched protocols. Upgrade is hop-by-hop, hence it is
+// never forwarded and the client could not speak the new protocol anyway.
+var errSwitchedProtocols = errors.New("upstream switched protocols without being asked to")
+
+// roundTrip sends the outbound request towards target (host:port), either directly or through the parent proxy
+// selected by the upstream rules, where out is adjusted to the route. Requests with an https:// URI are sent through
+// TLS according to the upstream TLS settings. Connections are taken from the pool, which groups them by destination
+// or by parent proxy. The response header is read into header, while the body is returned as stream along with its
+// size, which is -1 if it is unknown upfront. The returned body has to be closed by the caller.
+func (s *settings) roundTrip(pool *connPool, target string, out *fasthttp.Request, header *fasthttp.ResponseHeader, deadline time.Time) (*upstreamBody, error) {
+	secure := bytes.Equal(out.URI().Scheme(), []byte("https"))
+
+	key := target
+	dial := func() (net.Conn, error) {
+		return s.dialer.Dial(target)
+	}
+
+	parent := s.upstream.Route(hostOf(target))
+	// Parents resolve names on their own, while IP addresses are checked right away, as they would otherwise lead
+	// towards forbidden addresses such as the metadata endpoint through the parent
+	if parent != nil && !s.dialer.PermitsLiteral(hostOf(target)) {
+		return nil, errDestinationForbidden
+	}
+
+	switch {
+	case parent == nil:
+	case parent.socks || secure:
+		// SOCKS5 parents only relay connections, as do HTTP parents for https:// requests, which are tunneled through
+		// CONNECT to keep them encrypted. Hence the request is sent in origin form through them
+		key = parent.name + "/" + target
+		dial = func() (net.Conn, error) {
+			return parent.Connect(target)
+		}
+	default:
+		// Connections towards HTTP parents can be reused for every destination
+		key = parent.name
+		dial = parent.dial
+
+		// Setting the URI on the request itself ensures it is written as is, rather than reduced to its path
+		out.SetRequestURI(out.URI().String())
+		out.Header.SetHostBytes(out.URI().Host())
+		if len(parent.authorization) > 0 {
+			out.Header.Set(fasthttp.HeaderProxyAuthorization, parent.authorization)
+		}
+	}
+
+	if secure {
+		// Plain and encrypted connections towards the same destination must never be mixed up
+		key = "https://" + key
+		connect := dial
+		dial = func() (net.Conn, error) {
+			conn, err := connect()
+			if err != nil {
+				return nil, err
+			}
+			return s.tls.Client(conn, hostOf(target), deadline)
+		}
+	}
+
+	for {
+		conn, err := pool.Get(key, deadline, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := exchange(conn, out, header, deadline)
+		if err != nil {
+			conn.discard()
+
+			// Idle connections may have been closed by the upstream meanwhile, which is only noticed once they are used
+			if errors.Is(err, errStaleConnection) && conn.reused && isIdempotent(&out.Header) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to exchange request with %s: %w", target, err)
+		}
+
+		// Passing the challenge on would ask the client for credentials it does not know about
+		if parent != nil && !parent.socks && !secure && header.StatusCode() == fasthttp.StatusProxyAuthRequired {
+			conn.discard()
+			return nil, fmt.Errorf("parent proxy %s rejected the configured credentials", parent.name)
+		}
+
+		return body, nil
+	}
+}
+
+// exchange writes the request to the connection and reads the header of its response.
+func exchange(conn *pooledConn, out *fasthttp.Request, header *fasthttp.ResponseHeader, deadline time.Time) (*upstreamBody, error) {
+	_ = conn.SetDeadline(deadline)
+
+	w := bufio.NewWriter(conn)
+	err := out.Write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errStaleConnection, err)
+	}
+
+	for {
+		if err := header.Read(conn.br); err != nil {
+			if err == io.EOF {
+				return nil, errStaleConnection
+			}
+			return nil, err
+		}
+
+		// Interim responses such as 100 Continue or 103 Early Hints are not passed on, as the request was already
+		// sent completely. 101 is final instead, as the connection switches protocols afterwards
+		if status := header.StatusCode(); status < 100 || status >= 200 || status == fasthttp.StatusSwitchingProtocols {
+			break
+		}
+	}
+
+	// The connection speaks another protocol from now on, hence it must neither be reused nor passed on
+	if header.StatusCode() == fasthttp.StatusSwitchingProtocols {
+		return nil, errSwitchedProtocols
+	}
+
+	body := &upstreamBody{conn: conn, reusable: !header.ConnectionClose()}
+	switch length := header.ContentLength(); {
+	case out.Header.IsHead() || !hasBody(header.StatusCode()) || length == 0:
+		body.r, body.size, body.done = eofReader{}, 0, true
+	case length > 0:
+		body.r, body.size = io.LimitReader(conn.br, int64(length)), length
+	case length == -1:
+		body.r, body.size, body.trailers = httputil.NewChunkedReader(conn.br), -1, header
+	default:
+		// Neither length nor chunked, hence the body lasts until the upstream closes the connection
+		body.r, body.size, body.reusable = conn.br, -1, false
+	}
+
+	return body, nil
+}
+
+// isIdempotent reports whether the request can be repeated without side effects (RFC 7231 4.2.2).
+func isIdempotent(h *fasthttp.RequestHeader) bool {
+	return h.IsGet() || h.IsHead() || h.IsPut() || h.IsDelete() || h.IsOptions() || h.IsTrace()
+}
+
+// isSafe reports whether the request is read-only (RFC 7231 4.2.1).
+func isSafe(h *fasthttp.RequestHeader) bool {
+	return h.IsGet() || h.IsHead() || h.IsOptions() || h.IsTrace()
+}
+
+// hasBody reports whether a response with the status code may contain a body (RFC 7230 3.3.3).
+func hasBody(status int) bool {
+	return status >= 200 && status != fasthttp.StatusNoContent && status != fasthttp.StatusNotModified
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// startRawUpstream answers every connection with the raw response, after the request header was read.
+func startRawUpstream(t *testing.T, response string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "should not fail listening")
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = http.ReadRequest(bufio.NewReader(conn))
+				_, _ = io.WriteString(conn, response)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestForwardHandler_Responses(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}, Destinations: loopbackAllowed}
+	proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+
+	h := NewForwardHandler(&conf)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		err := fasthttp.Serve(ln, h.HandleFastHTTP)
+		assert.NoError(t, err, "should not throw err")
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+		},
+		// Redirects have to reach the client as they are
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	t.Run("passes headers of the upstream on", func(t *testing.T) {
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Vary", "Accept")
+			w.Header().Add("Set-Cookie", "a=1")
+			w.Header().Add("Set-Cookie", "b=2")
+			_, _ = io.WriteString(w, `{"hello":"world"}`)
+		}))
+		defer srv.Close()
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+		assert.ElementsMatch(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+	})
+
+	t.Run("passes redirects on without following them", func(t *testing.T) {
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/moved", http.StatusFound)
+		}))
+		defer srv.Close()
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "/moved", resp.Header.Get("Location"))
+	})
+
+	t.Run("does not add a content type", func(t *testing.T) {
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = nil
+			_, _ = io.WriteString(w, "raw")
+		}))
+		defer srv.Close()
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.Empty(t, resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("strips hop-by-hop headers", func(t *testing.T) {
+		// net/http replaces the Connection header of handlers, as the proxy asks to close the connection
+		upstream := startRawUpstream(t, "HTTP/1.1 200 OK\r\nConnection: X-Session\r\nX-Session: abc\r\nKeep-Alive: timeout=5\r\nX-Kept: yes\r\nContent-Length: 2\r\n\r\nok")
+		defer upstream.Close()
+
+		resp, err := client.Get("http://" + upstream.Addr().String())
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "ok", string(body))
+		assert.Empty(t, resp.Header.Get("X-Session"))
+		assert.Empty(t, resp.Header.Get("Keep-Alive"))
+		assert.Equal(t, "yes", resp.Header.Get("X-Kept"))
+	})
+
+	t.Run("skips interim responses", func(t *testing.T) {
+		upstream := startRawUpstream(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\nHTTP/1.1 200 OK\r\nX-Final: yes\r\nContent-Length: 2\r\n\r\nok")
+		defer upstream.Close()
+
+		resp, err := client.Get("http://" + upstream.Addr().String())
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "should pass the final response on")
+		assert.Equal(t, "ok", string(body))
+		assert.Equal(t, "yes", resp.Header.Get("X-Final"))
+		assert.Empty(t, resp.Header.Get("Link"), "should not mix headers of interim responses in")
+	})
+
+	t.Run("rejects switched protocols", func(t *testing.T) {
+		upstream := startRawUpstream(t, "HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: websocket\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		defer upstream.Close()
+
+		resp, err := client.Get("http://" + upstream.Addr().String())
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "should not pass the switched connection on")
+
+		// Reusing the connection would read the bytes of the other protocol as response
+		resp, err = client.Get("http://" + upstream.Addr().String())
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "should not reuse the switched connection")
+	})
+
+	t.Run("keeps the content length of HEAD requests", func(t *testing.T) {
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1234")
+		}))
+		defer srv.Close()
+
+		resp, err := client.Head(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 1234, resp.ContentLength)
+	})
+
+	t.Run("passes trailers on", func(t *testing.T) {
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			_, _ = io.WriteString(w, "chunked body")
+			w.(http.Flusher).Flush()
+			w.Header().Set("X-Checksum", "42")
+		}))
+		defer srv.Close()
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "should not fail reading body")
+		assert.Equal(t, "chunked body", string(body))
+		assert.Equal(t, "42", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("streams the body", func(t *testing.T) {
+		received := make(chan struct{})
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "first\n")
+			w.(http.Flusher).Flush()
+
+			// The remainder is only sent once the client received the first part
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+			}
+			_, _ = io.WriteString(w, "second\n")
+		}))
+		defer srv.Close()
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		r := bufio.NewReader(resp.Body)
+		start := time.Now()
+		first, err := r.ReadString('\n')
+		assert.NoError(t, err, "should not fail reading first part")
+		assert.Equal(t, "first\n", first)
+		assert.True(t, time.Since(start) < 4*time.Second, "should receive the first part before the upstream finished")
+		close(received)
+
+		rest, err := ioutil.ReadAll(r)
+		assert.NoError(t, err, "should not fail reading remainder")
+		assert.Equal(t, "second\n", string(rest))
+	})
+
+	t.Run("streams large bodies of known length", func(t *testing.T) {
+		payload := strings.Repeat("0123456789", 1<<20)
+		srv := startHTTPTestEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "10485760")
+			_, _ = io.WriteString(w, payload)
+		}))
+		defer srv.Close()
+
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "should not fail reading body")
+		assert.EqualValues(t, len(payload), resp.ContentLength)
+		assert.Equal(t, len(payload), len(body))
+	})
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnel is a live CONNECT tunnel between a client and an upstream. Intercepted tunnels have no dest, as their
+// requests are forwarded one by one.
+type tunnel struct {
+	target string
+	origin net.Conn
+	dest   net.Conn
+	// release frees the concurrency slots of the tunnel, which is nil for tunnels without slots
+	release func()
+
+	closedByDrain int32
+}
+
+func (t *tunnel) close() {
+	_ = t.origin.Close()
+	if t.dest != nil {
+		_ = t.dest.Close()
+	}
+}
+
+// done frees the concurrency slots of the tunnel once it terminated.
+func (t *tunnel) done() {
+	if t.release != nil {
+		t.release()
+	}
+}
+
+// forced reports whether the tunnel was closed forcefully while draining.
+func (t *tunnel) forced() bool {
+	return atomic.LoadInt32(&t.closedByDrain) == 1
+}
+
+// tunnelRegistry tracks all live tunnels, so they can be drained during shutdown. Once closed
+// it refuses to register new tunnels.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	tunnels map[*tunnel]struct{}
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: make(map[*tunnel]struct{})}
+}
+
+// Register adds the tunnel to the registry and returns false if the registry is already closed.
+func (r *tunnelRegistry) Register(t *tunnel) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	r.tunnels[t] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+// Unregister removes a tunnel that was previously registered.
+func (r *tunnelRegistry) Unregister(t *tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.tunnels[t]; found {
+		delete(r.tunnels, t)
+		r.wg.Done()
+	}
+}
+
+// Closed reports whether the registry stopped accepting new tunnels.
+func (r *tunnelRegistry) Closed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Len returns the number of live tunnels.
+func (r *tunnelRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.tunnels)
+}
+
+// Close stops accepting new tunnels, while live tunnels are left untouched.
+func (r *tunnelRegistry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+// Drain stops accepting new tunnels and waits up to timeout for the live tunnels to finish. The remaining
+// tunnels are closed forcefully afterwards. It returns the number of drained and force closed tunnels.
+func (r *tunnelRegistry) Drain(timeout time.Duration) (int, int) {
+	r.mu.Lock()
+	r.closed = true
+	live := len(r.tunnels)
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return live, 0
+	case <-time.After(timeout):
+	}
+
+	r.mu.Lock()
+	remaining := make([]*tunnel, 0, len(r.tunnels))
+	for t := range r.tunnels {
+		remaining = append(remaining, t)
+	}
+	r.mu.Unlock()
+
+	for _, t := range remaining {
+		log.Debugf("Force closing tunnel towards %s", t.target)
+		atomic.StoreInt32(&t.closedByDrain, 1)
+		t.close()
+	}
+
+	<-done
+	return live - len(remaining), len(remaining)
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func newPipeTunnel(target string) (*tunnel, net.Conn, net.Conn) {
+	origin, originPeer := net.Pipe()
+	dest, destPeer := net.Pipe()
+	return &tunnel{target: target, origin: origin, dest: dest}, originPeer, destPeer
+}
+
+func TestTunnelRegistry(t *testing.T) {
+	t.Run("tracks registered tunnels", func(t *testing.T) {
+		registry := newTunnelRegistry()
+		first, _, _ := newPipeTunnel("example.com:443")
+		second, _, _ := newPipeTunnel("example.org:443")
+
+		assert.True(t, registry.Register(first))
+		assert.True(t, registry.Register(second))
+		assert.Equal(t, 2, registry.Len())
+
+		registry.Unregister(first)
+		registry.Unregister(first) // Unregistering twice should be harmless
+		assert.Equal(t, 1, registry.Len())
+	})
+
+	t.Run("drain without tunnels returns immediately", func(t *testing.T) {
+		registry := newTunnelRegistry()
+
+		drained, forced := registry.Drain(time.Minute)
+
+		assert.Equal(t, 0, drained)
+		assert.Equal(t, 0, forced)
+		assert.True(t, registry.Closed())
+	})
+
+	t.Run("close refuses new tunnels but keeps live ones", func(t *testing.T) {
+		registry := newTunnelRegistry()
+		live, _, _ := newPipeTunnel("example.com:443")
+		registry.Register(live)
+
+		registry.Close()
+
+		tun, _, _ := newPipeTunnel("example.org:443")
+		assert.False(t, registry.Register(tun))
+		assert.True(t, registry.Closed())
+		assert.Equal(t, 1, registry.Len())
+	})
+
+	t.Run("refuses new tunnels after drain started", func(t *testing.T) {
+		registry := newTunnelRegistry()
+		registry.Drain(time.Millisecond)
+
+		tun, _, _ := newPipeTunnel("example.com:443")
+		assert.False(t, registry.Register(tun))
+		assert.Equal(t, 0, registry.Len())
+	})
+
+	t.Run("waits for tunnels finishing within timeout", func(t *testing.T) {
+		registry := newTunnelRegistry()
+		tun, _, _ := newPipeTunnel("example.com:443")
+		registry.Register(tun)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			registry.Unregister(tun)
+		}()
+
+		drained, forced := registry.Drain(time.Minute)
+
+		assert.Equal(t, 1, drained)
+		assert.Equal(t, 0, forced)
+	})
+
+	t.Run("force closes tunnels exceeding timeout", func(t *testing.T) {
+		registry := newTunnelRegistry()
+		tun, originPeer, _ := newPipeTunnel("example.com:443")
+		registry.Register(tun)
+
+		// Simulates the hijack handler, which unregisters once its connections are closed
+		go func() {
+			_, _ = tun.origin.Read(make([]byte, 1))
+			registry.Unregister(tun)
+		}()
+
+		drained, forced := registry.Drain(20 * time.Millisecond)
+
+		assert.Equal(t, 0, drained)
+		assert.Equal(t, 1, forced)
+
+		_, err := originPeer.Write([]byte("x"))
+		assert.Error(t, err, "connection should be closed")
+	})
+}
+
+func TestForwardHandler_Shutdown(t *testing.T) {
+	conf := config.ForwardProxyConfig{Proxy: config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s", Drain: "1s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}}}
+	h := NewForwardHandler(&conf)
+
+	h.Shutdown()
+
+	var req fasthttp.Request
+	req.Header.SetMethod(fasthttp.MethodConnect)
+	req.SetRequestURI("example.com:443")
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+
+	h.HandleFastHTTP(&ctx)
+
+	assert.EqualValues(t, 503, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "proxy is shutting down")
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/socks5"
+	"github.com/valyala/fasthttp"
+)
+
+// parentProxy is a HTTP or SOCKS5 proxy that requests are chained through. As its address is configured by the
+// operator, it is not checked against the destinations policy. The final destination is resolved by the parent
+// instead, apart from IP addresses, which are checked before they are routed towards the parent.
+type parentProxy struct {
+	name          string
+	socks         bool
+	address       string
+	username      string
+	password      string
+	authorization string
+	timeout       time.Duration
+}
+
+func newParentProxy(conf config.Parent, timeout time.Duration) *parentProxy {
+	p := &parentProxy{
+		name:     conf.Name,
+		socks:    conf.Type == config.ParentSOCKS5,
+		address:  conf.Address,
+		username: conf.Username,
+		password: conf.Password,
+		timeout:  timeout,
+	}
+	if len(conf.Username) > 0 {
+		p.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(conf.Username+":"+conf.Password))
+	}
+	return p
+}
+
+func (p *parentProxy) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.address, p.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("parent proxy %s is unreachable: %w", p.name, err)
+	}
+	return conn, nil
+}
+
+// Connect opens a tunnel towards target by issuing a CONNECT request or command to the parent. The handshake is
+// bound by the connect timeout, while the returned connection has no deadline set.
+func (p *parentProxy) Connect(target string) (net.Conn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(p.timeout))
+
+	if p.socks {
+		if err := socks5.Connect(conn, target, p.username, p.password); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("parent proxy %s refused to connect towards %s: %w", p.name, target, err)
+		}
+
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodConnect)
+	req.SetRequestURI(target)
+	req.Header.SetHost(target)
+	if len(p.authorization) > 0 {
+		req.Header.Set(fasthttp.HeaderProxyAuthorization, p.authorization)
+	}
+
+	w := bufio.NewWriter(conn)
+	_, err = req.Header.WriteTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("parent proxy %s failed to receive CONNECT: %w", p.name, err)
+	}
+
+	var header fasthttp.ResponseHeader
+	r := bufio.NewReader(conn)
+	if err := header.Read(r); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("parent proxy %s did not answer CONNECT: %w", p.name, err)
+	}
+
+	if header.StatusCode() != fasthttp.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("parent proxy %s refused CONNECT towards %s with status %d", p.name, target, header.StatusCode())
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	// Data the upstream sent right after the handshake must not get lost
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn serves reads from r first, which holds data that was read past the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type upstreamRoute struct {
+	domains *domainList
+	parent  *parentProxy
+}
+
+// upstreamRouter decides per destination domain whether it is reached directly or through a parent proxy,
+// where the first matching route wins.
+type upstreamRouter struct {
+	routes   []upstreamRoute
+	fallback *parentProxy
+}
+
+func newUpstreamRouter(conf config.Upstream, timeout time.Duration) *upstreamRouter {
+	parents := make(map[string]*parentProxy, len(conf.Parents))
+	for _, parent := range conf.Parents {
+		parents[parent.Name] = newParentProxy(parent, timeout)
+	}
+
+	// Lookups of direct yield nil, which is exactly how direct routes are represented
+	router := &upstreamRouter{fallback: parents[conf.Default]}
+	for _, rule := range conf.Rules {
+		router.routes = append(router.routes, upstreamRoute{domains: newDomainList(rule.Domains), parent: parents[rule.Via]})
+	}
+
+	return router
+}
+
+// Route returns the parent proxy the domain is reached through, where nil means the domain is dialed directly.
+func (r *upstreamRouter) Route(domain string) *parentProxy {
+	for _, route := range r.routes {
+		if route.domains.Matches(domain) {
+			return route.parent
+		}
+	}
+	return r.fallback
+}
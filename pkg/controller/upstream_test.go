@@ -0,0 +1,403 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Templum/Spediteur/pkg/config"
+	"github.com/Templum/Spediteur/pkg/socks5"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestUpstreamRouter_Route(t *testing.T) {
+	conf := config.Upstream{
+		Default: "corporate",
+		Parents: []config.Parent{{Name: "corporate", Address: "proxy.corp:3128"}, {Name: "backup", Address: "10.0.0.2:8080"}},
+		Rules: []config.UpstreamRule{
+			{Domains: []string{"*.corp", "localhost"}, Via: config.RouteDirect},
+			{Domains: []string{"*.github.com"}, Via: "backup"},
+			{Domains: []string{"*"}, Via: "corporate"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		conf   config.Upstream
+		domain string
+		want   string
+	}{
+		{name: "matching direct rule", conf: conf, domain: "git.corp", want: config.RouteDirect},
+		{name: "matching parent rule", conf: conf, domain: "api.github.com", want: "backup"},
+		{name: "first matching rule wins", conf: conf, domain: "LOCALHOST", want: config.RouteDirect},
+		{name: "catch all rule", conf: conf, domain: "example.com", want: "corporate"},
+		{name: "default without rules", conf: config.Upstream{Default: "corporate", Parents: conf.Parents}, domain: "example.com", want: "corporate"},
+		{name: "direct by default", conf: config.Upstream{Default: config.RouteDirect}, domain: "example.com", want: config.RouteDirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := newUpstreamRouter(tt.conf, time.Second).Route(tt.domain)
+
+			if tt.want == config.RouteDirect {
+				assert.Nil(t, parent, "should be reached directly")
+			} else {
+				assert.NotNil(t, parent, "should be reached via parent")
+				assert.Equal(t, tt.want, parent.name)
+			}
+		})
+	}
+}
+
+func TestParentProxy_Connect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "should not throw error")
+	defer ln.Close()
+
+	// Answers the CONNECT and greets right away, like protocols where the server speaks first
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			var header fasthttp.RequestHeader
+			_ = header.Read(bufio.NewReader(conn))
+
+			if string(header.Peek("Proxy-Authorization")) != "Basic Y2k6c2VjcmV0" {
+				_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			} else {
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n220 "+string(header.RequestURI())+"\r\n")
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	t.Run("tunnel is established", func(t *testing.T) {
+		parent := newParentProxy(config.Parent{Name: "corporate", Address: ln.Addr().String(), Username: "ci", Password: "secret"}, time.Second)
+
+		conn, err := parent.Connect("mail.example.com:25")
+		assert.NoError(t, err, "should not throw error")
+		defer conn.Close()
+
+		greeting, _ := ioutil.ReadAll(conn)
+		assert.Equal(t, "220 mail.example.com:25\r\n", string(greeting), "should not lose data sent along the response")
+	})
+
+	t.Run("refused tunnel", func(t *testing.T) {
+		parent := newParentProxy(config.Parent{Name: "corporate", Address: ln.Addr().String()}, time.Second)
+
+		conn, err := parent.Connect("mail.example.com:25")
+		assert.Nil(t, conn, "should not return a connection")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "parent proxy corporate refused CONNECT towards mail.example.com:25 with status 407")
+	})
+}
+
+func TestForwardHandler_Upstream(t *testing.T) {
+	t.Parallel()
+
+	// The parent is a Spediteur itself, which requires credentials and reaches loopback on behalf of its children
+	parentConf := config.ForwardProxyConfig{
+		Proxy:          config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+		Destinations:   loopbackAllowed,
+		Authentication: config.Authentication{Realm: "Parent"},
+	}
+	parentHandler := NewForwardHandler(&parentConf)
+	parentHandler.SetAuthenticator(staticAuthenticator{"spediteur": "secret"})
+
+	parentLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "should not throw error")
+	defer parentLn.Close()
+
+	go func() {
+		_ = fasthttp.Serve(parentLn, parentHandler.HandleFastHTTP)
+	}()
+
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = io.WriteString(w, "<html><body>Hello World!</body></html>")
+	}
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(upstream))
+	defer srv.Close()
+
+	tlsSrv, certpool := startHTTPSTestEndpoint(http.HandlerFunc(upstream))
+	defer tlsSrv.Close()
+
+	childFor := func(upstream config.Upstream, destinations config.Destinations) *http.Client {
+		conf := config.ForwardProxyConfig{
+			Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+			Upstream:     upstream,
+			Destinations: destinations,
+		}
+
+		h := NewForwardHandler(&conf)
+		ln := fasthttputil.NewInmemoryListener()
+		go func() {
+			_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+		}()
+
+		proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+		return &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+			TLSClientConfig: &tls.Config{RootCAs: certpool},
+		}}
+	}
+
+	viaParent := childFor(config.Upstream{
+		Default: "parent",
+		Parents: []config.Parent{{Name: "parent", Address: parentLn.Addr().String(), Username: "spediteur", Password: "secret"}},
+	}, loopbackAllowed)
+
+	t.Run("[forwarding] request is chained through parent", func(t *testing.T) {
+		resp, err := viaParent.Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 200, resp.StatusCode)
+		assert.EqualValues(t, "<html><body>Hello World!</body></html>", actualBody)
+	})
+
+	t.Run("[connect request] tunnel is chained through parent", func(t *testing.T) {
+		resp, err := viaParent.Get(tlsSrv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 200, resp.StatusCode)
+		assert.EqualValues(t, "<html><body>Hello World!</body></html>", actualBody)
+	})
+
+	wrongCredentials := childFor(config.Upstream{
+		Default: "parent",
+		Parents: []config.Parent{{Name: "parent", Address: parentLn.Addr().String(), Username: "spediteur", Password: "wrong"}},
+	}, loopbackAllowed)
+
+	t.Run("[forwarding] rejected credentials are reported as unreachable", func(t *testing.T) {
+		resp, err := wrongCredentials.Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 503, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Proxy-Authenticate"), "challenge of parent should not be passed on")
+	})
+
+	t.Run("[connect request] refused tunnel is reported as unreachable", func(t *testing.T) {
+		resp, err := wrongCredentials.Get(tlsSrv.URL)
+
+		assert.Nil(t, resp, "should not return a response")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "Service Unavailable")
+	})
+
+	// Neither child is permitted to reach loopback itself
+	restricted := childFor(config.Upstream{
+		Default: "parent",
+		Parents: []config.Parent{{Name: "parent", Address: parentLn.Addr().String(), Username: "spediteur", Password: "secret"}},
+	}, config.Destinations{})
+
+	t.Run("[forwarding] forbidden addresses are not routed to parent", func(t *testing.T) {
+		resp, err := restricted.Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 403, resp.StatusCode)
+	})
+
+	t.Run("[connect request] forbidden addresses are not routed to parent", func(t *testing.T) {
+		resp, err := restricted.Get(tlsSrv.URL)
+
+		assert.Nil(t, resp, "should not return a response")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "Forbidden")
+	})
+
+	t.Run("[forwarding] names are resolved by parent", func(t *testing.T) {
+		_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		resp, err := restricted.Get("http://localhost:" + port)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 200, resp.StatusCode)
+	})
+
+	direct := childFor(config.Upstream{
+		Default: "parent",
+		Parents: []config.Parent{{Name: "parent", Address: parentLn.Addr().String(), Username: "spediteur", Password: "secret"}},
+		Rules:   []config.UpstreamRule{{Domains: []string{"127.0.0.1"}, Via: config.RouteDirect}},
+	}, config.Destinations{})
+
+	t.Run("[forwarding] direct rule bypasses parent", func(t *testing.T) {
+		resp, err := direct.Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 403, resp.StatusCode)
+	})
+}
+
+// startSOCKS5Parent serves a minimal SOCKS5 gateway, which requires the provided credentials.
+func startSOCKS5Parent(username string, password string) net.Listener {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+
+		greeting := make([]byte, 2)
+		_, _ = io.ReadFull(conn, greeting)
+		_, _ = io.ReadFull(conn, make([]byte, greeting[1]))
+		_, _ = conn.Write([]byte{socks5.Version, socks5.MethodUserPass})
+
+		size := make([]byte, 2)
+		_, _ = io.ReadFull(conn, size)
+		user := make([]byte, size[1])
+		_, _ = io.ReadFull(conn, user)
+		_, _ = io.ReadFull(conn, size[:1])
+		pass := make([]byte, size[0])
+		_, _ = io.ReadFull(conn, pass)
+
+		if string(user) != username || string(pass) != password {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+
+		_, _ = io.ReadFull(conn, make([]byte, 3))
+		target, _ := socks5.ReadAddress(conn)
+
+		dest, err := net.Dial("tcp", target)
+		if err != nil {
+			_, _ = conn.Write([]byte{socks5.Version, socks5.ReplyConnectionRefused, 0x00, socks5.AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer dest.Close()
+		_, _ = conn.Write([]byte{socks5.Version, socks5.ReplySucceeded, 0x00, socks5.AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+		go func() {
+			_, _ = io.Copy(dest, conn)
+			_ = dest.Close()
+		}()
+		_, _ = io.Copy(conn, dest)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return ln
+}
+
+func TestForwardHandler_SOCKS5Upstream(t *testing.T) {
+	t.Parallel()
+
+	parentLn := startSOCKS5Parent("spediteur", "secret")
+	defer parentLn.Close()
+
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = io.WriteString(w, "<html><body>Hello World!</body></html>")
+	}
+
+	srv := startHTTPTestEndpoint(http.HandlerFunc(upstream))
+	defer srv.Close()
+
+	tlsSrv, certpool := startHTTPSTestEndpoint(http.HandlerFunc(upstream))
+	defer tlsSrv.Close()
+
+	clientFor := func(password string) *http.Client {
+		conf := config.ForwardProxyConfig{
+			Proxy:        config.Proxy{Timeouts: config.Timeouts{Connect: "30s", Write: "30s"}, BufferSizes: config.BufferSizes{Read: 1024, Write: 1024}},
+			Destinations: loopbackAllowed,
+			Upstream: config.Upstream{
+				Default: config.RouteDirect,
+				Parents: []config.Parent{{Name: "gateway", Type: config.ParentSOCKS5, Address: parentLn.Addr().String(), Username: "spediteur", Password: password}},
+				Rules:   []config.UpstreamRule{{Domains: []string{"127.0.0.1"}, Via: "gateway"}},
+			},
+		}
+
+		h := NewForwardHandler(&conf)
+		ln := fasthttputil.NewInmemoryListener()
+		go func() {
+			_ = fasthttp.Serve(ln, h.HandleFastHTTP)
+		}()
+
+		proxyURL, _ := url.Parse("http://mysuperproxy:18080")
+		return &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+			TLSClientConfig: &tls.Config{RootCAs: certpool},
+		}}
+	}
+
+	viaGateway := clientFor("secret")
+
+	t.Run("[forwarding] request is chained through gateway", func(t *testing.T) {
+		resp, err := viaGateway.Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 200, resp.StatusCode)
+		assert.EqualValues(t, "<html><body>Hello World!</body></html>", actualBody)
+	})
+
+	t.Run("[connect request] tunnel is chained through gateway", func(t *testing.T) {
+		resp, err := viaGateway.Get(tlsSrv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		actualBody, _ := ioutil.ReadAll(resp.Body)
+		assert.EqualValues(t, 200, resp.StatusCode)
+		assert.EqualValues(t, "<html><body>Hello World!</body></html>", actualBody)
+	})
+
+	wrongCredentials := clientFor("wrong")
+
+	t.Run("[forwarding] rejected credentials are reported as unreachable", func(t *testing.T) {
+		resp, err := wrongCredentials.Get(srv.URL)
+
+		assert.NoError(t, err, "should not throw error")
+		defer resp.Body.Close()
+
+		assert.EqualValues(t, 503, resp.StatusCode)
+	})
+
+	t.Run("[connect request] rejected credentials are reported as unreachable", func(t *testing.T) {
+		resp, err := wrongCredentials.Get(tlsSrv.URL)
+
+		assert.Nil(t, resp, "should not return a response")
+		assert.Error(t, err, "should throw error")
+		assert.Contains(t, err.Error(), "Service Unavailable")
+	})
+}
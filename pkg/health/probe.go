@@ -0,0 +1,49 @@
+package health
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Probe tracks whether the proxy is ready to accept traffic and serves the liveness and readiness
+// endpoints for orchestrators. A new Probe is live but not ready.
+type Probe struct {
+	ready int32
+}
+
+func New() *Probe {
+	return &Probe{}
+}
+
+// SetReady flips the readiness, which should be true once the proxy listener is bound and false while draining.
+func (p *Probe) SetReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&p.ready, value)
+}
+
+// Ready reports the current readiness.
+func (p *Probe) Ready() bool {
+	return atomic.LoadInt32(&p.ready) == 1
+}
+
+// Liveness responds with 200 as long as the process is able to serve requests.
+func (p *Probe) Liveness(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, "ok")
+}
+
+// Readiness responds with 200 if the proxy is ready and 503 otherwise.
+func (p *Probe) Readiness(w http.ResponseWriter, _ *http.Request) {
+	if !p.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "not ready")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, "ready")
+}
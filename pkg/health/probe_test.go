@@ -0,0 +1,47 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe_Liveness(t *testing.T) {
+	probe := New()
+	recorder := httptest.NewRecorder()
+
+	probe.Liveness(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ok", recorder.Body.String())
+}
+
+func TestProbe_Readiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		transition []bool
+		wantCode   int
+		wantBody   string
+	}{
+		{name: "new probe is not ready", transition: nil, wantCode: http.StatusServiceUnavailable, wantBody: "not ready"},
+		{name: "ready after listener is bound", transition: []bool{true}, wantCode: http.StatusOK, wantBody: "ready"},
+		{name: "not ready after shutdown signal", transition: []bool{true, false}, wantCode: http.StatusServiceUnavailable, wantBody: "not ready"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe := New()
+			for _, ready := range tt.transition {
+				probe.SetReady(ready)
+			}
+
+			recorder := httptest.NewRecorder()
+			probe.Readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			assert.Equal(t, tt.wantBody, recorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "spediteur"
+
+// Values for the type label, which differentiates between CONNECT tunnels, forwarded requests and SOCKS5 tunnels
+const (
+	TypeConnect = "connect"
+	TypeProxy   = "proxy"
+	TypeSOCKS5  = "socks5"
+)
+
+// Values for the direction label, where upload is from client to upstream and download vice versa
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+// Values for the category label of Errors
+const (
+	ErrorClientRejected       = "client_rejected"
+	ErrorAuthentication       = "authentication"
+	ErrorAccessDenied         = "access_denied"
+	ErrorPolicyDenied         = "policy_denied"
+	ErrorDestinationForbidden = "destination_forbidden"
+	ErrorUpstreamUnreachable  = "upstream_unreachable"
+	ErrorTransfer             = "transfer"
+	ErrorInterception         = "interception"
+	ErrorSNIMismatch          = "sni_mismatch"
+	ErrorCache                = "cache"
+	ErrorRateLimited          = "rate_limited"
+	ErrorOverloaded           = "overloaded"
+)
+
+// Values for the limit label of ConcurrencyInUse and ConcurrencyQueued
+const (
+	LimitTunnels       = "tunnels"
+	LimitClientTunnels = "client_tunnels"
+	LimitHostRequests  = "host_requests"
+)
+
+// Values for the scope label of RateLimited
+const (
+	ScopeClient      = "client"
+	ScopeUser        = "user"
+	ScopeDestination = "destination"
+)
+
+// Values for the result label of CacheLookups
+const (
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CacheRevalidated = "revalidated"
+	CacheChanged     = "changed"
+)
+
+// Values for the result label of CoalescedRequests
+const (
+	CoalescedShared   = "shared"
+	CoalescedUnshared = "unshared"
+	CoalescedTimeout  = "timeout"
+)
+
+// Values for the tier label of CacheSize and CacheEntries
+const (
+	TierMemory = "memory"
+	TierDisk   = "disk"
+)
+
+// Values for the result label of SNIChecks
+const (
+	SNIMatched    = "matched"
+	SNIAllowed    = "allowed"
+	SNIMismatched = "mismatched"
+	SNIMissing    = "missing"
+)
+
+// Values for the result label of DialDuration
+const (
+	ResultSuccess   = "success"
+	ResultFailure   = "failure"
+	ResultForbidden = "forbidden"
+)
+
+// Values for the result label of InterceptionCertificates
+const (
+	CertificateCached = "cached"
+	CertificateMinted = "minted"
+)
+
+// Values for the result label of PooledConnections
+const (
+	PoolHit  = "hit"
+	PoolMiss = "miss"
+)
+
+var (
+	// Requests counts the handled requests by type and the status code that was returned to the client.
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of handled requests by type and returned status code.",
+	}, []string{"type", "code"})
+
+	// RequestDuration observes how long it took to handle a request. For tunnels this only covers the setup.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of handling requests by type, which covers only the setup for tunnels.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	// DialDuration observes the latency of dialing upstreams including the DNS resolution.
+	DialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_duration_seconds",
+		Help:      "Latency of dialing upstream servers including name resolution by result.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15},
+	}, []string{"result"})
+
+	// TransferredBytes counts the bytes that were transferred between clients and upstreams.
+	TransferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Number of bytes transferred by type and direction.",
+	}, []string{"type", "direction"})
+
+	// ActiveTunnels tracks the number of currently open CONNECT tunnels.
+	ActiveTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_tunnels",
+		Help:      "Number of currently open CONNECT tunnels.",
+	})
+
+	// TunnelDuration observes how long CONNECT tunnels were open.
+	TunnelDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tunnel_duration_seconds",
+		Help:      "Duration CONNECT tunnels were open.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	})
+
+	// InterceptedTunnels counts the CONNECT tunnels whose TLS was terminated to inspect their requests.
+	InterceptedTunnels = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "intercepted_tunnels_total",
+		Help:      "Number of CONNECT tunnels whose TLS was terminated by the proxy.",
+	})
+
+	// InterceptionCertificates counts the certificates presented to clients of intercepted tunnels, where cached
+	// means the certificate was minted before and minted that it had to be signed for the handshake.
+	InterceptionCertificates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interception_certificates_total",
+		Help:      "Number of certificates presented to clients of intercepted tunnels by result.",
+	}, []string{"result"})
+
+	// CacheLookups counts the cacheable requests by how they were answered. Revalidated means that the upstream
+	// confirmed the stored response, while changed means that it replaced the stored response.
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Number of cacheable requests by result of the cache lookup.",
+	}, []string{"result"})
+
+	// CoalescedRequests counts the requests that waited for an identical request by whether they received its
+	// response. Unshared means that the response could not be shared, while timeout means that waiting took too long.
+	CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Number of requests that waited for an identical request by result.",
+	}, []string{"result"})
+
+	// RateLimited counts the requests that were rejected as they exceeded the rate limit of a scope.
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected by rate limits by scope.",
+	}, []string{"scope"})
+
+	// ConcurrencyInUse tracks the slots that are currently held per concurrency limit, where client tunnels and host
+	// requests are summed over all clients and hosts.
+	ConcurrencyInUse = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrency_in_use",
+		Help:      "Number of held slots by concurrency limit.",
+	}, []string{"limit"})
+
+	// ConcurrencyQueued tracks the requests that currently wait for a slot per concurrency limit.
+	ConcurrencyQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrency_queued",
+		Help:      "Number of requests waiting for a slot by concurrency limit.",
+	}, []string{"limit"})
+
+	// CacheSize tracks the bytes occupied by stored responses per tier.
+	CacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_size_bytes",
+		Help:      "Bytes occupied by stored responses by tier.",
+	}, []string{"tier"})
+
+	// CacheEntries tracks the number of stored responses per tier.
+	CacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_entries",
+		Help:      "Number of stored responses by tier.",
+	}, []string{"tier"})
+
+	// SNIChecks counts the server names that were peeked from tunnels by how they relate to the requested host, where
+	// allowed means that only the allow list permitted the server name.
+	SNIChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnel_sni_checks_total",
+		Help:      "Number of server names peeked from tunnels by result.",
+	}, []string{"result"})
+
+	// PooledConnections counts how connections for forwarded requests were obtained, where hit means an idle
+	// connection was reused and miss that a new one had to be dialed.
+	PooledConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_pool_requests_total",
+		Help:      "Number of upstream connections taken from the pool by result.",
+	}, []string{"result"})
+
+	// IdleConnections tracks the number of upstream connections that are currently kept open for reuse.
+	IdleConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_idle_connections",
+		Help:      "Number of idle upstream connections kept open for reuse.",
+	})
+
+	// Errors counts errors and rejections by their category.
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Number of errors and rejected requests by category.",
+	}, []string{"category"})
+)
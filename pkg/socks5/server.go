@@ -0,0 +1,123 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Negotiate reads the greeting of a client and selects the authentication method. If authenticate is nil no
+// authentication is required, otherwise the client has to provide credentials using RFC 1929. It returns the
+// authenticated user, which is empty without authentication.
+func Negotiate(conn io.ReadWriter, authenticate func(user string, password string) bool) (string, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return "", err
+	}
+	if greeting[0] != Version {
+		return "", fmt.Errorf("socks5: client greeted with version %d", greeting[0])
+	}
+
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	wanted := byte(MethodNoAuth)
+	if authenticate != nil {
+		wanted = MethodUserPass
+	}
+
+	if !containsMethod(methods, wanted) {
+		_, _ = conn.Write([]byte{Version, MethodNoAcceptable})
+		return "", ErrNoAcceptableMethod
+	}
+
+	if _, err := conn.Write([]byte{Version, wanted}); err != nil {
+		return "", err
+	}
+
+	if authenticate == nil {
+		return "", nil
+	}
+
+	user, password, err := readCredentials(conn)
+	if err != nil {
+		return "", err
+	}
+
+	if !authenticate(user, password) {
+		_, _ = conn.Write([]byte{userPassVersion, 0x01})
+		return user, ErrAuthenticationFailed
+	}
+
+	_, err = conn.Write([]byte{userPassVersion, 0x00})
+	return user, err
+}
+
+func containsMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func readCredentials(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != userPassVersion {
+		return "", "", fmt.Errorf("socks5: client authenticated with version %d", header[0])
+	}
+
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return "", "", err
+	}
+
+	password := make([]byte, size[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+
+	return string(user), string(password), nil
+}
+
+// ReadRequest reads the request following the negotiation and returns its command and target in host:port form.
+func ReadRequest(r io.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != Version {
+		return 0, "", fmt.Errorf("socks5: client requested with version %d", header[0])
+	}
+
+	target, err := ReadAddress(r)
+	return header[1], target, err
+}
+
+// WriteReply answers the request, where bound is the local address of the connection towards the target. It is
+// sent as unspecified address if it is nil.
+func WriteReply(w io.Writer, reply byte, bound net.Addr) error {
+	address := "0.0.0.0:0"
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		address = tcp.String()
+	}
+
+	response, err := AppendAddress([]byte{Version, reply, 0x00}, address)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(response)
+	return err
+}
@@ -0,0 +1,222 @@
+// Package socks5 implements the parts of RFC 1928 and RFC 1929 that are needed to chain connections
+// through a SOCKS5 server and to serve SOCKS5 clients, where only the CONNECT command is supported.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const Version = 5
+
+// Authentication methods
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+
+	userPassVersion = 1
+)
+
+// Commands
+const (
+	CommandConnect = 0x01
+)
+
+// Address types
+const (
+	AddrIPv4   = 0x01
+	AddrDomain = 0x03
+	AddrIPv6   = 0x04
+)
+
+// Replies
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddressNotSupported = 0x08
+)
+
+var replyMessages = map[byte]string{
+	ReplyGeneralFailure:      "general SOCKS server failure",
+	ReplyNotAllowed:          "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:  "network unreachable",
+	ReplyHostUnreachable:     "host unreachable",
+	ReplyConnectionRefused:   "connection refused",
+	ReplyTTLExpired:          "TTL expired",
+	ReplyCommandNotSupported: "command not supported",
+	ReplyAddressNotSupported: "address type not supported",
+}
+
+var (
+	ErrAuthenticationFailed = errors.New("socks5: authentication failed")
+	ErrNoAcceptableMethod   = errors.New("socks5: no acceptable authentication method")
+)
+
+// ReplyError is returned if the server answered the request with anything but ReplySucceeded.
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	if message, found := replyMessages[byte(e)]; found {
+		return "socks5: " + message
+	}
+	return fmt.Sprintf("socks5: unknown reply %d", byte(e))
+}
+
+// Connect performs the handshake on conn, which asks the server to connect to target in host:port form.
+// Username and password are offered using RFC 1929, if username is not empty.
+func Connect(conn io.ReadWriter, target string, username string, password string) error {
+	methods := []byte{MethodNoAuth}
+	if len(username) > 0 {
+		methods = []byte{MethodUserPass}
+	}
+
+	if _, err := conn.Write(append([]byte{Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	selection := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selection); err != nil {
+		return err
+	}
+	if selection[0] != Version {
+		return fmt.Errorf("socks5: server answered with version %d", selection[0])
+	}
+
+	switch selection[1] {
+	case MethodNoAuth:
+	case MethodUserPass:
+		if err := authenticate(conn, username, password); err != nil {
+			return err
+		}
+	default:
+		return ErrNoAcceptableMethod
+	}
+
+	request := []byte{Version, CommandConnect, 0x00}
+	request, err := AppendAddress(request, target)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != ReplySucceeded {
+		return ReplyError(reply[1])
+	}
+
+	// The bound address is of no interest, but has to be consumed
+	_, err = ReadAddress(conn)
+	return err
+}
+
+func authenticate(conn io.ReadWriter, username string, password string) error {
+	if len(username) == 0 || len(username) > 255 || len(password) > 255 {
+		return ErrAuthenticationFailed
+	}
+
+	request := []byte{userPassVersion, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	if status[1] != 0x00 {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+// AppendAddress appends address in host:port form as SOCKS5 address to b.
+func AppendAddress(b []byte, address string) ([]byte, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %s", rawPort)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			b = append(append(b, AddrIPv4), v4...)
+		} else {
+			b = append(append(b, AddrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host %s is too long", host)
+		}
+		b = append(append(b, AddrDomain, byte(len(host))), host...)
+	}
+
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// ReadAddress reads a SOCKS5 address and returns it in host:port form.
+func ReadAddress(r io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addrType[0] {
+	case AddrIPv4, AddrIPv6:
+		size := net.IPv4len
+		if addrType[0] == AddrIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case AddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", ReplyError(ReplyAddressNotSupported)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,173 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		want    []byte
+	}{
+		{name: "ipv4", address: "10.0.0.1:443", want: []byte{AddrIPv4, 10, 0, 0, 1, 0x01, 0xbb}},
+		{name: "ipv6", address: "[::1]:22", want: []byte{AddrIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x16}},
+		{name: "domain", address: "example.com:80", want: append(append([]byte{AddrDomain, 11}, "example.com"...), 0x00, 0x50)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := AppendAddress(nil, tt.address)
+			assert.NoError(t, err, "should not throw error")
+			assert.Equal(t, tt.want, encoded)
+
+			decoded, err := ReadAddress(bytes.NewReader(encoded))
+			assert.NoError(t, err, "should not throw error")
+			assert.Equal(t, tt.address, decoded)
+		})
+	}
+
+	t.Run("invalid port", func(t *testing.T) {
+		_, err := AppendAddress(nil, "example.com:http")
+		assert.Error(t, err, "should throw error")
+	})
+
+	t.Run("unknown address type", func(t *testing.T) {
+		_, err := ReadAddress(bytes.NewReader([]byte{0x05}))
+		assert.Equal(t, ReplyError(ReplyAddressNotSupported), err)
+	})
+}
+
+// serve answers a single handshake of Connect the way a SOCKS5 server would.
+func serve(conn net.Conn, method byte, authOk bool, reply byte) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	_, _ = io.ReadFull(conn, header)
+	_, _ = io.ReadFull(conn, make([]byte, header[1]))
+	_, _ = conn.Write([]byte{Version, method})
+
+	if method == MethodNoAcceptable {
+		return
+	}
+
+	if method == MethodUserPass {
+		size := make([]byte, 2)
+		_, _ = io.ReadFull(conn, size)
+		_, _ = io.ReadFull(conn, make([]byte, size[1]))
+		_, _ = io.ReadFull(conn, size[:1])
+		_, _ = io.ReadFull(conn, make([]byte, size[0]))
+
+		if !authOk {
+			_, _ = conn.Write([]byte{userPassVersion, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{userPassVersion, 0x00})
+	}
+
+	_, _ = io.ReadFull(conn, make([]byte, 3))
+	_, _ = ReadAddress(conn)
+	_, _ = conn.Write([]byte{Version, reply, 0x00, AddrIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		method   byte
+		authOk   bool
+		reply    byte
+		wantErr  error
+	}{
+		{name: "without authentication", method: MethodNoAuth, reply: ReplySucceeded},
+		{name: "with authentication", username: "ci", method: MethodUserPass, authOk: true, reply: ReplySucceeded},
+		{name: "rejected credentials", username: "ci", method: MethodUserPass, authOk: false, wantErr: ErrAuthenticationFailed},
+		{name: "no acceptable method", method: MethodNoAcceptable, wantErr: ErrNoAcceptableMethod},
+		{name: "refused connection", method: MethodNoAuth, reply: ReplyConnectionRefused, wantErr: ReplyError(ReplyConnectionRefused)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			go serve(server, tt.method, tt.authOk, tt.reply)
+
+			err := Connect(client, "example.com:443", tt.username, "secret")
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestReplyError_Error(t *testing.T) {
+	assert.Equal(t, "socks5: connection not allowed by ruleset", ReplyError(ReplyNotAllowed).Error())
+	assert.Equal(t, "socks5: unknown reply 42", ReplyError(42).Error())
+}
+
+func TestNegotiate(t *testing.T) {
+	accept := func(user string, password string) bool {
+		return user == "ci" && password == "secret"
+	}
+
+	tests := []struct {
+		name         string
+		authenticate func(string, string) bool
+		username     string
+		password     string
+		wantUser     string
+		wantErr      error
+	}{
+		{name: "without authentication", wantErr: nil},
+		{name: "valid credentials", authenticate: accept, username: "ci", password: "secret", wantUser: "ci"},
+		{name: "invalid credentials", authenticate: accept, username: "ci", password: "wrong", wantUser: "ci", wantErr: ErrAuthenticationFailed},
+		{name: "client without credentials", authenticate: accept, wantErr: ErrNoAcceptableMethod},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+
+			// The server has to finish before the subtest does, as it asserts on t
+			target := make(chan string, 1)
+			done := make(chan struct{})
+			defer func() {
+				_ = client.Close()
+				<-done
+			}()
+
+			go func() {
+				defer close(done)
+				defer server.Close()
+
+				user, err := Negotiate(server, tt.authenticate)
+				assert.Equal(t, tt.wantUser, user)
+				assert.Equal(t, tt.wantErr, err)
+				if err != nil {
+					return
+				}
+
+				command, address, err := ReadRequest(server)
+				assert.NoError(t, err, "should not throw error")
+				assert.EqualValues(t, CommandConnect, command)
+				target <- address
+
+				_ = WriteReply(server, ReplySucceeded, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000})
+			}()
+
+			err := Connect(client, "example.com:443", tt.username, tt.password)
+			if tt.wantErr != nil {
+				assert.Error(t, err, "should throw error")
+				return
+			}
+
+			assert.NoError(t, err, "should not throw error")
+			assert.Equal(t, "example.com:443", <-target)
+		})
+	}
+}